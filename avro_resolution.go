@@ -0,0 +1,555 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// avroSchema is a parsed Avro schema used for resolving data written with
+// one schema into another.
+// See: https://avro.apache.org/docs/1.8.2/spec.html#Schema+Resolution
+type avroSchema struct {
+	// Type is a primitive type name, "record", "enum", "array", "map",
+	// "fixed", or "union"
+	Type        string
+	Name        string
+	Aliases     []string
+	LogicalType string
+	Fields      []avroField
+	Symbols     []string
+	Items       *avroSchema
+	Values      *avroSchema
+	Branches    []*avroSchema
+}
+
+// avroField is a field of an Avro record
+type avroField struct {
+	Name       string
+	Aliases    []string
+	Type       *avroSchema
+	Default    interface{}
+	HasDefault bool
+}
+
+var avroPrimitiveTypes = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// parseAvroSchema parses an Avro schema from its JSON representation
+func parseAvroSchema(schema string) (*avroSchema, error) {
+	var schemaJSON interface{}
+	if err := json.Unmarshal([]byte(schema), &schemaJSON); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %s", err.Error())
+	}
+	return parseAvroSchemaJSON(schemaJSON, "", make(map[string]*avroSchema))
+}
+
+// parseAvroSchemaJSON parses a decoded JSON Avro schema. Named types are
+// registered in names as they are parsed so that later references, including
+// recursive ones, resolve to the same schema.
+func parseAvroSchemaJSON(schemaJSON interface{}, namespace string, names map[string]*avroSchema) (*avroSchema, error) {
+	switch s := schemaJSON.(type) {
+	case string:
+		if avroPrimitiveTypes[s] {
+			return &avroSchema{Type: s}, nil
+		}
+		if named, ok := names[avroFullName(s, namespace)]; ok {
+			return named, nil
+		}
+		if named, ok := names[s]; ok {
+			return named, nil
+		}
+		return nil, fmt.Errorf("unknown Avro type %s", s)
+	case []interface{}:
+		union := &avroSchema{Type: "union", Branches: make([]*avroSchema, len(s))}
+		for i, branch := range s {
+			parsed, err := parseAvroSchemaJSON(branch, namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			union.Branches[i] = parsed
+		}
+		return union, nil
+	case map[string]interface{}:
+		return parseAvroComplexSchema(s, namespace, names)
+	default:
+		return nil, fmt.Errorf("invalid Avro schema %v", schemaJSON)
+	}
+}
+
+func parseAvroComplexSchema(s map[string]interface{}, namespace string, names map[string]*avroSchema) (*avroSchema, error) {
+	typeName, ok := s["type"].(string)
+	if !ok {
+		// a nested type definition such as {"type": {"type": "array", ...}}
+		return parseAvroSchemaJSON(s["type"], namespace, names)
+	}
+	schema := &avroSchema{Type: typeName}
+	schema.LogicalType, _ = s["logicalType"].(string)
+	switch typeName {
+	case "record", "error", "enum", "fixed":
+		name, _ := s["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("Avro %s schema has no name", typeName)
+		}
+		if ns, ok := s["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		schema.Name = avroFullName(name, namespace)
+		if i := strings.LastIndex(schema.Name, "."); i >= 0 {
+			namespace = schema.Name[:i]
+		}
+		schema.Aliases = avroAliases(s["aliases"], namespace)
+		names[schema.Name] = schema
+	}
+	switch typeName {
+	case "record", "error":
+		schema.Type = "record"
+		fields, _ := s["fields"].([]interface{})
+		for _, f := range fields {
+			fieldJSON, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid field in Avro record %s", schema.Name)
+			}
+			field := avroField{}
+			field.Name, _ = fieldJSON["name"].(string)
+			field.Aliases = avroAliases(fieldJSON["aliases"], "")
+			field.Default, field.HasDefault = fieldJSON["default"]
+			fieldType, err := parseAvroSchemaJSON(fieldJSON["type"], namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			field.Type = fieldType
+			schema.Fields = append(schema.Fields, field)
+		}
+	case "enum":
+		symbols, _ := s["symbols"].([]interface{})
+		for _, symbol := range symbols {
+			if symbolString, ok := symbol.(string); ok {
+				schema.Symbols = append(schema.Symbols, symbolString)
+			}
+		}
+	case "array":
+		items, err := parseAvroSchemaJSON(s["items"], namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		schema.Items = items
+	case "map":
+		values, err := parseAvroSchemaJSON(s["values"], namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		schema.Values = values
+	case "fixed":
+	default:
+		if !avroPrimitiveTypes[typeName] {
+			return parseAvroSchemaJSON(typeName, namespace, names)
+		}
+	}
+	return schema, nil
+}
+
+func avroFullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func avroAliases(aliasesJSON interface{}, namespace string) []string {
+	aliases, _ := aliasesJSON.([]interface{})
+	names := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		if aliasString, ok := alias.(string); ok {
+			names = append(names, avroFullName(aliasString, namespace))
+		}
+	}
+	return names
+}
+
+// avroShortName returns a name without its namespace
+func avroShortName(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// branchName returns the name goavro uses as the key for a value of this
+// schema when it is part of a union
+func (as *avroSchema) branchName() string {
+	if as.Name != "" {
+		return as.Name
+	}
+	if as.LogicalType != "" {
+		return as.Type + "." + as.LogicalType
+	}
+	return as.Type
+}
+
+// matchesBranch returns whether the goavro union key identifies this schema
+func (as *avroSchema) matchesBranch(key string) bool {
+	if as.Name != "" {
+		return as.Name == key || avroShortName(as.Name) == avroShortName(key)
+	}
+	return key == as.Type || strings.HasPrefix(key, as.Type+".")
+}
+
+// matches returns whether data written with the writer schema can be read
+// with this schema. Record names are not compared, since reader schemas
+// derived from Go types rarely share the names used by producers.
+func (as *avroSchema) matches(writer *avroSchema) bool {
+	switch as.Type {
+	case "record", "array", "map":
+		return as.Type == writer.Type
+	case "enum", "fixed":
+		if as.Type != writer.Type {
+			return false
+		}
+		if avroShortName(as.Name) == avroShortName(writer.Name) {
+			return true
+		}
+		for _, alias := range as.Aliases {
+			if avroShortName(alias) == avroShortName(writer.Name) {
+				return true
+			}
+		}
+		return false
+	case "long":
+		return writer.Type == "long" || writer.Type == "int"
+	case "float":
+		return writer.Type == "float" || writer.Type == "long" || writer.Type == "int"
+	case "double":
+		return writer.Type == "double" || writer.Type == "float" || writer.Type == "long" || writer.Type == "int"
+	case "string", "bytes":
+		return writer.Type == "string" || writer.Type == "bytes"
+	default:
+		return as.Type == writer.Type
+	}
+}
+
+// resolveAvro converts a value decoded by goavro with the writer schema into
+// the shape it would have had if it were decoded with the reader schema,
+// applying the Avro schema resolution rules: fields are matched by name or
+// alias, missing fields take their defaults, and numeric and string/bytes
+// types are promoted.
+func resolveAvro(writer, reader *avroSchema, value interface{}) (interface{}, error) {
+	if writer.Type == "union" {
+		if value == nil {
+			for _, branch := range writer.Branches {
+				if branch.Type == "null" {
+					return resolveAvro(branch, reader, nil)
+				}
+			}
+			return nil, fmt.Errorf("null value for Avro union without null")
+		}
+		wrapped, ok := value.(map[string]interface{})
+		if !ok || len(wrapped) != 1 {
+			return nil, fmt.Errorf("invalid value %v for Avro union", value)
+		}
+		for key, nested := range wrapped {
+			for _, branch := range writer.Branches {
+				if branch.matchesBranch(key) {
+					return resolveAvro(branch, reader, nested)
+				}
+			}
+			return nil, fmt.Errorf("Avro union has no branch %s", key)
+		}
+	}
+	if reader.Type == "union" {
+		for _, branch := range reader.Branches {
+			if !branch.matches(writer) {
+				continue
+			}
+			resolved, err := resolveAvro(writer, branch, value)
+			if err != nil || branch.Type == "null" {
+				return nil, err
+			}
+			return map[string]interface{}{branch.branchName(): resolved}, nil
+		}
+		return nil, fmt.Errorf("no branch of the reader union matches Avro type %s", writer.branchName())
+	}
+	if !reader.matches(writer) {
+		return nil, fmt.Errorf("Avro type %s cannot be read as %s", writer.branchName(), reader.branchName())
+	}
+	switch reader.Type {
+	case "record":
+		return resolveAvroRecord(writer, reader, value)
+	case "enum":
+		symbol, _ := value.(string)
+		for _, readerSymbol := range reader.Symbols {
+			if symbol == readerSymbol {
+				return symbol, nil
+			}
+		}
+		return nil, fmt.Errorf("Avro enum %s has no symbol %s", reader.Name, symbol)
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v for Avro array", value)
+		}
+		resolved := make([]interface{}, len(items))
+		for i, item := range items {
+			resolvedItem, err := resolveAvro(writer.Items, reader.Items, item)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = resolvedItem
+		}
+		return resolved, nil
+	case "map":
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v for Avro map", value)
+		}
+		resolved := make(map[string]interface{}, len(values))
+		for key, mapValue := range values {
+			resolvedValue, err := resolveAvro(writer.Values, reader.Values, mapValue)
+			if err != nil {
+				return nil, err
+			}
+			resolved[key] = resolvedValue
+		}
+		return resolved, nil
+	default:
+		return promoteAvro(reader.Type, value), nil
+	}
+}
+
+func resolveAvroRecord(writer, reader *avroSchema, value interface{}) (interface{}, error) {
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid value %v for Avro record", value)
+	}
+	writerFields := make(map[string]*avroField, len(writer.Fields))
+	for i := range writer.Fields {
+		writerFields[writer.Fields[i].Name] = &writer.Fields[i]
+	}
+	resolved := make(map[string]interface{}, len(reader.Fields))
+	for _, readerField := range reader.Fields {
+		writerField, ok := writerFields[readerField.Name]
+		for _, alias := range readerField.Aliases {
+			if ok {
+				break
+			}
+			writerField, ok = writerFields[alias]
+		}
+		if ok {
+			resolvedField, err := resolveAvro(writerField.Type, readerField.Type, record[writerField.Name])
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %s", readerField.Name, err.Error())
+			}
+			resolved[readerField.Name] = resolvedField
+			continue
+		}
+		if !readerField.HasDefault {
+			return nil, fmt.Errorf(
+				"field %s is not in the writer schema and has no default", readerField.Name)
+		}
+		defaultValue, err := avroDefault(readerField.Type, readerField.Default)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", readerField.Name, err.Error())
+		}
+		resolved[readerField.Name] = defaultValue
+	}
+	return resolved, nil
+}
+
+// promoteAvro converts a primitive value to the native type goavro uses for
+// the reader type
+func promoteAvro(readerType string, value interface{}) interface{} {
+	switch readerType {
+	case "long":
+		if v, ok := value.(int32); ok {
+			return int64(v)
+		}
+	case "float":
+		switch v := value.(type) {
+		case int32:
+			return float32(v)
+		case int64:
+			return float32(v)
+		}
+	case "double":
+		switch v := value.(type) {
+		case int32:
+			return float64(v)
+		case int64:
+			return float64(v)
+		case float32:
+			return float64(v)
+		}
+	case "string":
+		if v, ok := value.([]byte); ok {
+			return string(v)
+		}
+	case "bytes":
+		if v, ok := value.(string); ok {
+			return []byte(v)
+		}
+	}
+	return value
+}
+
+// kafkaValueFromAvro converts a value decoded by goavro into the types that
+// the kafkaMessageDecoder sets fields from. Records become kafkaRecords and
+// maps become kafkaMaps, so that neither is mistaken for a Kafka Connect
+// nullable value, and union values are unwrapped from their branch.
+func kafkaValueFromAvro(schema *avroSchema, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch schema.Type {
+	case "union":
+		wrapped, ok := value.(map[string]interface{})
+		if !ok || len(wrapped) != 1 {
+			return value
+		}
+		for key, nested := range wrapped {
+			for _, branch := range schema.Branches {
+				if branch.matchesBranch(key) {
+					return kafkaValueFromAvro(branch, nested)
+				}
+			}
+		}
+	case "record":
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return value
+		}
+		record := make(kafkaRecord, len(fields))
+		for _, field := range schema.Fields {
+			if fieldValue, ok := fields[field.Name]; ok {
+				record[field.Name] = kafkaValueFromAvro(field.Type, fieldValue)
+			}
+		}
+		return record
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return value
+		}
+		converted := make([]interface{}, len(items))
+		for i, item := range items {
+			converted[i] = kafkaValueFromAvro(schema.Items, item)
+		}
+		return converted
+	case "map":
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return value
+		}
+		converted := make(kafkaMap, len(values))
+		for key, mapValue := range values {
+			converted[key] = kafkaValueFromAvro(schema.Values, mapValue)
+		}
+		return converted
+	}
+	return value
+}
+
+// avroDefault converts a field default from its JSON representation to the
+// native type goavro uses for the schema. Defaults for unions correspond to
+// the first branch of the union.
+func avroDefault(schema *avroSchema, defaultJSON interface{}) (interface{}, error) {
+	switch schema.Type {
+	case "null":
+		return nil, nil
+	case "union":
+		if len(schema.Branches) == 0 {
+			return nil, fmt.Errorf("Avro union has no branches")
+		}
+		first := schema.Branches[0]
+		value, err := avroDefault(first, defaultJSON)
+		if err != nil || first.Type == "null" {
+			return nil, err
+		}
+		return map[string]interface{}{first.branchName(): value}, nil
+	case "boolean":
+		if b, ok := defaultJSON.(bool); ok {
+			return b, nil
+		}
+	case "int", "long", "float", "double":
+		if n, ok := defaultJSON.(float64); ok {
+			switch schema.Type {
+			case "int":
+				return int32(n), nil
+			case "long":
+				return int64(n), nil
+			case "float":
+				return float32(n), nil
+			}
+			return n, nil
+		}
+	case "string", "enum":
+		if s, ok := defaultJSON.(string); ok {
+			return s, nil
+		}
+	case "bytes", "fixed":
+		if s, ok := defaultJSON.(string); ok {
+			// byte defaults are strings of code points 0-255
+			b := make([]byte, 0, len(s))
+			for _, r := range s {
+				b = append(b, byte(r))
+			}
+			return b, nil
+		}
+	case "array":
+		if items, ok := defaultJSON.([]interface{}); ok {
+			resolved := make([]interface{}, len(items))
+			for i, item := range items {
+				value, err := avroDefault(schema.Items, item)
+				if err != nil {
+					return nil, err
+				}
+				resolved[i] = value
+			}
+			return resolved, nil
+		}
+	case "map":
+		if values, ok := defaultJSON.(map[string]interface{}); ok {
+			resolved := make(map[string]interface{}, len(values))
+			for key, mapValue := range values {
+				value, err := avroDefault(schema.Values, mapValue)
+				if err != nil {
+					return nil, err
+				}
+				resolved[key] = value
+			}
+			return resolved, nil
+		}
+	case "record":
+		if fields, ok := defaultJSON.(map[string]interface{}); ok {
+			resolved := make(map[string]interface{}, len(schema.Fields))
+			for _, field := range schema.Fields {
+				fieldDefault, ok := fields[field.Name]
+				if !ok {
+					fieldDefault, ok = field.Default, field.HasDefault
+				}
+				if !ok {
+					return nil, fmt.Errorf("default for record %s has no value for %s", schema.Name, field.Name)
+				}
+				value, err := avroDefault(field.Type, fieldDefault)
+				if err != nil {
+					return nil, err
+				}
+				resolved[field.Name] = value
+			}
+			return resolved, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid default %v for Avro type %s", defaultJSON, schema.Type)
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"testing"
+
+	"github.com/linkedin/goavro"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const writerSchemaV1 = `{
+	"type": "record",
+	"name": "chef",
+	"namespace": "flavortown",
+	"fields": [
+		{"name": "full_name", "type": "string"},
+		{"name": "age", "type": "int"},
+		{"name": "rating", "type": "float"},
+		{"name": "nickname", "type": ["null", "string"], "default": null},
+		{"name": "restaurants", "type": {"type": "array", "items": "int"}}
+	]
+}`
+
+const readerSchemaV2 = `{
+	"type": "record",
+	"name": "chef",
+	"namespace": "flavortown",
+	"fields": [
+		{"name": "name", "aliases": ["full_name"], "type": "string"},
+		{"name": "age", "type": "long"},
+		{"name": "rating", "type": "double"},
+		{"name": "nickname", "type": ["null", "string"], "default": null},
+		{"name": "restaurants", "type": {"type": "array", "items": "long"}},
+		{"name": "hometown", "type": "string", "default": "Flavortown"},
+		{"name": "spiky", "type": ["boolean", "null"], "default": true}
+	]
+}`
+
+func encodeAvro(t *testing.T, schema string, value map[string]interface{}) (*avroCodec, interface{}) {
+	codec, err := newAvroCodec(schema)
+	require.NoError(t, err)
+	encoded, err := codec.BinaryFromNative(nil, value)
+	require.NoError(t, err)
+	decoded, _, err := codec.NativeFromBinary(encoded)
+	require.NoError(t, err)
+	return codec, decoded
+}
+
+func TestResolveAvro(t *testing.T) {
+	codec, decoded := encodeAvro(t, writerSchemaV1, map[string]interface{}{
+		"full_name":   "Guy Fieri",
+		"age":         int32(50),
+		"rating":      float32(4.5),
+		"nickname":    goavro.Union("string", "Guy"),
+		"restaurants": []interface{}{int32(1), int32(2)},
+	})
+	writer, err := codec.writerSchema()
+	require.NoError(t, err)
+	reader, err := parseAvroSchema(readerSchemaV2)
+	require.NoError(t, err)
+
+	resolved, err := resolveAvro(writer, reader, decoded)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"name":        "Guy Fieri",
+		"age":         int64(50),
+		"rating":      float64(4.5),
+		"nickname":    map[string]interface{}{"string": "Guy"},
+		"restaurants": []interface{}{int64(1), int64(2)},
+		"hometown":    "Flavortown",
+		"spiky":       map[string]interface{}{"boolean": true},
+	}, resolved)
+}
+
+func TestResolveAvro_Errors(t *testing.T) {
+	codec, decoded := encodeAvro(t, writerSchemaV1, map[string]interface{}{
+		"full_name":   "Guy Fieri",
+		"age":         int32(50),
+		"rating":      float32(4.5),
+		"nickname":    nil,
+		"restaurants": []interface{}{},
+	})
+	writer, err := codec.writerSchema()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		reader string
+	}{
+		{
+			"missing field without default",
+			`{"type": "record", "name": "chef", "fields": [{"name": "hometown", "type": "string"}]}`,
+		}, {
+			"type that cannot be promoted",
+			`{"type": "record", "name": "chef", "fields": [{"name": "rating", "type": "int"}]}`,
+		}, {
+			"union without a matching branch",
+			`{"type": "record", "name": "chef", "fields": [{"name": "age", "type": ["null", "string"]}]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := parseAvroSchema(test.reader)
+			require.NoError(t, err)
+			_, err = resolveAvro(writer, reader, decoded)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseAvroSchema_Recursive(t *testing.T) {
+	schema, err := parseAvroSchema(`{
+		"type": "record",
+		"name": "node",
+		"namespace": "flavortown",
+		"fields": [{"name": "next", "type": ["null", "node"]}]
+	}`)
+	require.NoError(t, err)
+	assert.Equal(t, "flavortown.node", schema.Name)
+	assert.Equal(t, schema, schema.Fields[0].Type.Branches[1])
+
+	_, err = parseAvroSchema(`{"type": "record", "name": "node", "fields": [{"name": "next", "type": "missing"}]}`)
+	assert.Error(t, err)
+}
+
+func TestUnmarshalMessage_ReaderSchema(t *testing.T) {
+	type chef struct {
+		Name     string  `kafka:"name"`
+		Age      int     `kafka:"age"`
+		Hometown string  `kafka:"hometown"`
+		Nickname *string `kafka:"nickname"`
+	}
+	codec, err := goavro.NewCodec(writerSchemaV1)
+	require.NoError(t, err)
+	encoded, err := codec.BinaryFromNative([]byte{0, 0, 0, 0, 77}, map[string]interface{}{
+		"full_name":   "Guy Fieri",
+		"age":         int32(50),
+		"rating":      float32(4.5),
+		"nickname":    nil,
+		"restaurants": []interface{}{},
+	})
+	require.NoError(t, err)
+
+	t.Run("explicit reader schema", func(t *testing.T) {
+		mockClient := &SchemaRegistryClientMock{}
+		mockClient.On("getSchema", 77, mock.Anything).Return(writerSchemaV1, nil)
+		config := &SchemaRegistryConfig{
+			client:             mockClient,
+			messageUnmarshaler: &kafkaMessageDecoder{},
+			ReaderSchema:       readerSchemaV2,
+		}
+		target := &chef{}
+		errs := config.unmarshalMessage(context.Background(), encoded, target)
+		require.Empty(t, errs)
+		assert.Equal(t, &chef{Name: "Guy Fieri", Age: 50, Hometown: "Flavortown"}, target)
+	})
+
+	t.Run("reader schema derived from target", func(t *testing.T) {
+		type renamedChef struct {
+			Name  string  `kafka:"full_name"`
+			Age   int64   `kafka:"age"`
+			Email *string `kafka:"email"`
+		}
+		mockClient := &SchemaRegistryClientMock{}
+		mockClient.On("getSchema", 77, mock.Anything).Return(writerSchemaV1, nil)
+		config := &SchemaRegistryConfig{
+			client:                 mockClient,
+			messageUnmarshaler:     &kafkaMessageDecoder{},
+			ReaderSchemaFromTarget: true,
+		}
+		target := &renamedChef{}
+		errs := config.unmarshalMessage(context.Background(), encoded, target)
+		require.Empty(t, errs)
+		assert.Equal(t, &renamedChef{Name: "Guy Fieri", Age: 50}, target)
+
+		// targets with required fields the writer doesn't have can't be resolved
+		errs = config.unmarshalMessage(context.Background(), encoded, &chef{})
+		assert.NotEmpty(t, errs)
+	})
+
+	t.Run("pointer fields with values", func(t *testing.T) {
+		type nullableChef struct {
+			Name     *string `kafka:"full_name"`
+			Age      *int64  `kafka:"age"`
+			Nickname *string `kafka:"nickname"`
+			Email    *string `kafka:"email"`
+		}
+		withNickname, err := codec.BinaryFromNative([]byte{0, 0, 0, 0, 77}, map[string]interface{}{
+			"full_name":   "Guy Fieri",
+			"age":         int32(50),
+			"rating":      float32(4.5),
+			"nickname":    goavro.Union("string", "Guy"),
+			"restaurants": []interface{}{},
+		})
+		require.NoError(t, err)
+		mockClient := &SchemaRegistryClientMock{}
+		mockClient.On("getSchema", 77, mock.Anything).Return(writerSchemaV1, nil)
+		config := &SchemaRegistryConfig{
+			client:                 mockClient,
+			messageUnmarshaler:     &kafkaMessageDecoder{},
+			ReaderSchemaFromTarget: true,
+		}
+		target := &nullableChef{}
+		errs := config.unmarshalMessage(context.Background(), withNickname, target)
+		require.Empty(t, errs)
+		require.NotNil(t, target.Name)
+		assert.Equal(t, "Guy Fieri", *target.Name)
+		require.NotNil(t, target.Age)
+		assert.Equal(t, int64(50), *target.Age)
+		require.NotNil(t, target.Nickname)
+		assert.Equal(t, "Guy", *target.Nickname)
+		assert.Nil(t, target.Email)
+	})
+}
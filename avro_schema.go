@@ -0,0 +1,208 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/linkedin/goavro"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// invalidAvroNameChars matches characters that may not appear in Avro names
+var invalidAvroNameChars = regexp.MustCompile("[^A-Za-z0-9_]")
+
+// avroRecordSchema is the JSON representation of a generated record schema.
+// Structs are used instead of maps so that keys are written in a readable
+// order.
+type avroRecordSchema struct {
+	Type      string            `json:"type"`
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace,omitempty"`
+	Fields    []avroRecordField `json:"fields"`
+}
+
+// avroRecordField is the JSON representation of a generated record field
+type avroRecordField struct {
+	Name    string           `json:"name"`
+	Doc     string           `json:"doc,omitempty"`
+	Type    interface{}      `json:"type"`
+	Default *json.RawMessage `json:"default,omitempty"`
+}
+
+// avroSchemaGenerator tracks the records defined while generating a schema,
+// since Avro requires every named type to be defined exactly once
+type avroSchemaGenerator struct {
+	namespace string
+	records   map[reflect.Type]string
+	names     map[string]reflect.Type
+}
+
+// GenerateAvroSchema derives an Avro record schema from a struct so that
+// schemas registered in Schema Registry can't drift from the Go types
+// consuming them. Each struct field with a `kafka` tag becomes a record field
+// with the tag's name, and fields without the tag are skipped. Go types are
+// mapped to Avro types as follows:
+//
+// bool is boolean; int8, int16, int32, uint8, and uint16 are int; all other
+// integers are long; float32 is float; float64 is double; string is string;
+// []byte is bytes; time.Time is a long with the timestamp-millis logical
+// type; other slices are arrays; maps with string keys are maps; and nested
+// structs are records. Pointers are unions with null that default to null.
+//
+// The `avro_doc` tag sets the documentation of a field, and the
+// `avro_default` tag sets its default as a JSON value, e.g.
+// `kafka:"hometown" avro_default:"\"Flavortown\""`.
+func GenerateAvroSchema(target interface{}, namespace string) (string, error) {
+	t := reflect.TypeOf(target)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct || t == timeType {
+		return "", fmt.Errorf("cannot generate Avro record schema for %v: not a struct", t)
+	}
+	return generateAvroSchema(t, namespace)
+}
+
+func generateAvroSchema(t reflect.Type, namespace string) (string, error) {
+	generator := &avroSchemaGenerator{
+		namespace: namespace,
+		records:   make(map[reflect.Type]string),
+		names:     make(map[string]reflect.Type),
+	}
+	schemaJSON, err := generator.schemaForType(t, "")
+	if err != nil {
+		return "", err
+	}
+	schema, err := json.MarshalIndent(schemaJSON, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	// make sure the generated schema is one producers will be able to use
+	if _, err := goavro.NewCodec(string(schema)); err != nil {
+		return "", fmt.Errorf("generated invalid Avro schema for %s: %s", t, err.Error())
+	}
+	return string(schema), nil
+}
+
+// schemaForType returns the JSON representation of the Avro schema for a Go
+// type. The name is used for anonymous structs.
+func (asg *avroSchemaGenerator) schemaForType(t reflect.Type, name string) (interface{}, error) {
+	if t == timeType {
+		return map[string]interface{}{"type": "long", "logicalType": "timestamp-millis"}, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return "int", nil
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "long", nil
+	case reflect.Float32:
+		return "float", nil
+	case reflect.Float64:
+		return "double", nil
+	case reflect.String:
+		return "string", nil
+	case reflect.Ptr:
+		elem, err := asg.schemaForType(t.Elem(), name)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{"null", elem}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes", nil
+		}
+		items, err := asg.schemaForType(t.Elem(), name)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("cannot generate Avro schema for %s: map keys must be strings", t)
+		}
+		values, err := asg.schemaForType(t.Elem(), name)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "map", "values": values}, nil
+	case reflect.Struct:
+		return asg.recordForType(t, name)
+	default:
+		return nil, fmt.Errorf("cannot generate Avro schema for %s", t)
+	}
+}
+
+// recordForType returns the record schema for a struct, or a reference to
+// the record by name if it has already been defined
+func (asg *avroSchemaGenerator) recordForType(t reflect.Type, name string) (interface{}, error) {
+	if recordName, ok := asg.records[t]; ok {
+		return recordName, nil
+	}
+	if t.Name() != "" {
+		name = t.Name()
+	}
+	name = invalidAvroNameChars.ReplaceAllString(name, "_")
+	if name == "" {
+		name = "record"
+	}
+	if existing, ok := asg.names[name]; ok {
+		return nil, fmt.Errorf("cannot generate Avro schema: %s and %s are both named %s", existing, t, name)
+	}
+	asg.records[t] = name
+	asg.names[name] = t
+
+	record := avroRecordSchema{Type: "record", Name: name, Namespace: asg.namespace, Fields: make([]avroRecordField, 0)}
+	if len(asg.records) > 1 {
+		// nested records inherit the namespace of the top level record
+		record.Namespace = ""
+	}
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		tag := structField.Tag.Get("kafka")
+		if tag == "" || tag == "-" || structField.PkgPath != "" {
+			continue
+		}
+		fieldType, err := asg.schemaForType(structField.Type, tag)
+		if err != nil {
+			return nil, err
+		}
+		field := avroRecordField{Name: tag, Doc: structField.Tag.Get("avro_doc"), Type: fieldType}
+		if defaultTag, ok := structField.Tag.Lookup("avro_default"); ok {
+			var defaultValue interface{}
+			if err := json.Unmarshal([]byte(defaultTag), &defaultValue); err != nil {
+				return nil, fmt.Errorf("invalid avro_default for field %s of %s: %s", tag, t, err.Error())
+			}
+			if union, ok := fieldType.([]interface{}); ok && defaultValue != nil {
+				// defaults of unions must match the first type of the union
+				field.Type = []interface{}{union[1], union[0]}
+			}
+			rawDefault := json.RawMessage(defaultTag)
+			field.Default = &rawDefault
+		} else if structField.Type.Kind() == reflect.Ptr {
+			rawDefault := json.RawMessage("null")
+			field.Default = &rawDefault
+		}
+		record.Fields = append(record.Fields, field)
+	}
+	return record, nil
+}
@@ -0,0 +1,299 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type generatedAddress struct {
+	City string `kafka:"city"`
+}
+
+type generatedChef struct {
+	ID          int64                  `kafka:"id" avro_doc:"Unique chef id"`
+	Name        string                 `kafka:"name"`
+	Age         int32                  `kafka:"age"`
+	Rating      float64                `kafka:"rating"`
+	Spiky       bool                   `kafka:"spiky"`
+	Hometown    string                 `kafka:"hometown" avro_default:"\"Flavortown\""`
+	Nickname    *string                `kafka:"nickname"`
+	Catchphrase *string                `kafka:"catchphrase" avro_default:"\"Winner winner\""`
+	Signature   []byte                 `kafka:"signature"`
+	Joined      time.Time              `kafka:"joined"`
+	Shows       []string               `kafka:"shows"`
+	Ratings     map[string]float32     `kafka:"ratings"`
+	Home        generatedAddress       `kafka:"home"`
+	Restaurants []generatedAddress     `kafka:"restaurants"`
+	Sous        *struct{ Name string } `kafka:"sous"`
+	Untagged    string
+	internal    string `kafka:"internal"`
+}
+
+const generatedChefSchema = `{
+  "type": "record",
+  "name": "generatedChef",
+  "namespace": "flavortown",
+  "fields": [
+    {
+      "name": "id",
+      "doc": "Unique chef id",
+      "type": "long"
+    },
+    {
+      "name": "name",
+      "type": "string"
+    },
+    {
+      "name": "age",
+      "type": "int"
+    },
+    {
+      "name": "rating",
+      "type": "double"
+    },
+    {
+      "name": "spiky",
+      "type": "boolean"
+    },
+    {
+      "name": "hometown",
+      "type": "string",
+      "default": "Flavortown"
+    },
+    {
+      "name": "nickname",
+      "type": [
+        "null",
+        "string"
+      ],
+      "default": null
+    },
+    {
+      "name": "catchphrase",
+      "type": [
+        "string",
+        "null"
+      ],
+      "default": "Winner winner"
+    },
+    {
+      "name": "signature",
+      "type": "bytes"
+    },
+    {
+      "name": "joined",
+      "type": {
+        "logicalType": "timestamp-millis",
+        "type": "long"
+      }
+    },
+    {
+      "name": "shows",
+      "type": {
+        "items": "string",
+        "type": "array"
+      }
+    },
+    {
+      "name": "ratings",
+      "type": {
+        "type": "map",
+        "values": "float"
+      }
+    },
+    {
+      "name": "home",
+      "type": {
+        "type": "record",
+        "name": "generatedAddress",
+        "fields": [
+          {
+            "name": "city",
+            "type": "string"
+          }
+        ]
+      }
+    },
+    {
+      "name": "restaurants",
+      "type": {
+        "items": "generatedAddress",
+        "type": "array"
+      }
+    },
+    {
+      "name": "sous",
+      "type": [
+        "null",
+        {
+          "type": "record",
+          "name": "sous",
+          "fields": []
+        }
+      ],
+      "default": null
+    }
+  ]
+}`
+
+func TestGenerateAvroSchema(t *testing.T) {
+	schema, err := GenerateAvroSchema(&generatedChef{}, "flavortown")
+	require.NoError(t, err)
+	assert.Equal(t, generatedChefSchema, schema)
+}
+
+// Test that messages encoded with a generated schema unmarshal back into the
+// struct the schema was generated from
+func TestGenerateAvroSchema_RoundTrip(t *testing.T) {
+	type roundTripChef struct {
+		Name        string                      `kafka:"name"`
+		Nickname    *string                     `kafka:"nickname"`
+		Signature   []byte                      `kafka:"signature"`
+		Shows       []string                    `kafka:"shows"`
+		Ratings     map[string]int32            `kafka:"ratings"`
+		Home        generatedAddress            `kafka:"home"`
+		Hideout     *generatedAddress           `kafka:"hideout"`
+		Vacation    *generatedAddress           `kafka:"vacation"`
+		Restaurants []generatedAddress          `kafka:"restaurants"`
+		Franchises  map[string]generatedAddress `kafka:"franchises"`
+	}
+	schema, err := GenerateAvroSchema(roundTripChef{}, "flavortown")
+	require.NoError(t, err)
+	codec, err := goavro.NewCodec(schema)
+	require.NoError(t, err)
+	encoded, err := codec.BinaryFromNative([]byte{0, 0, 0, 0, 77}, map[string]interface{}{
+		"name":        "Guy Fieri",
+		"nickname":    goavro.Union("string", "Guy"),
+		"signature":   []byte("GF"),
+		"shows":       []interface{}{"Diners, Drive-Ins and Dives"},
+		"ratings":     map[string]interface{}{"string": int32(5)},
+		"home":        map[string]interface{}{"city": "Flavortown"},
+		"hideout":     goavro.Union("flavortown.generatedAddress", map[string]interface{}{"city": "Novato"}),
+		"vacation":    nil,
+		"restaurants": []interface{}{map[string]interface{}{"city": "Santa Rosa"}},
+		"franchises":  map[string]interface{}{"las-vegas": map[string]interface{}{"city": "Las Vegas"}},
+	})
+	require.NoError(t, err)
+	nickname := "Guy"
+	expected := roundTripChef{
+		Name:        "Guy Fieri",
+		Nickname:    &nickname,
+		Signature:   []byte("GF"),
+		Shows:       []string{"Diners, Drive-Ins and Dives"},
+		Ratings:     map[string]int32{"string": 5},
+		Home:        generatedAddress{City: "Flavortown"},
+		Hideout:     &generatedAddress{City: "Novato"},
+		Restaurants: []generatedAddress{{City: "Santa Rosa"}},
+		Franchises:  map[string]generatedAddress{"las-vegas": {City: "Las Vegas"}},
+	}
+
+	for _, readerSchemaFromTarget := range []bool{false, true} {
+		mockClient := &SchemaRegistryClientMock{}
+		mockClient.On("getSchema", 77, mock.Anything).Return(schema, nil)
+		config := &SchemaRegistryConfig{
+			client:                 mockClient,
+			messageUnmarshaler:     &kafkaMessageDecoder{},
+			ReaderSchemaFromTarget: readerSchemaFromTarget,
+		}
+		target := roundTripChef{}
+		errs := config.unmarshalMessage(context.Background(), encoded, &target)
+		require.Empty(t, errs)
+		assert.Equal(t, expected, target)
+	}
+}
+
+func TestGenerateAvroSchema_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		target interface{}
+	}{
+		{"not a struct", "Guy Fieri"},
+		{"time is not a record", time.Time{}},
+		{"unsupported type", struct {
+			Callback func() `kafka:"callback"`
+		}{}},
+		{"non-string map keys", struct {
+			Counts map[int]int `kafka:"counts"`
+		}{}},
+		{"invalid default", struct {
+			Name string `kafka:"name" avro_default:"Guy"`
+		}{}},
+		{"default of the wrong type", struct {
+			Name string `kafka:"name" avro_default:"1"`
+		}{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := GenerateAvroSchema(test.target, "")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAvroSchemaCobraCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "avro-schema")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	types := map[string]interface{}{"address": generatedAddress{}}
+	expected, err := GenerateAvroSchema(generatedAddress{}, "flavortown")
+	require.NoError(t, err)
+
+	t.Run("print to stdout", func(t *testing.T) {
+		cmd := AvroSchemaCobraCommand(types)
+		out := &bytes.Buffer{}
+		cmd.SetOutput(out)
+		cmd.SetArgs([]string{"--namespace", "flavortown"})
+		require.NoError(t, cmd.Execute())
+		assert.Equal(t, expected+"\n", out.String())
+	})
+
+	t.Run("write and check files", func(t *testing.T) {
+		cmd := AvroSchemaCobraCommand(types)
+		cmd.SetArgs([]string{"address", "--namespace", "flavortown", "--output-dir", dir})
+		require.NoError(t, cmd.Execute())
+		written, err := ioutil.ReadFile(filepath.Join(dir, "address.avsc"))
+		require.NoError(t, err)
+		assert.Equal(t, expected+"\n", string(written))
+
+		cmd = AvroSchemaCobraCommand(types)
+		cmd.SetArgs([]string{"--namespace", "flavortown", "--output-dir", dir, "--check"})
+		assert.NoError(t, cmd.Execute())
+
+		// a schema that has drifted from the type fails the check
+		cmd = AvroSchemaCobraCommand(types)
+		cmd.SetOutput(ioutil.Discard)
+		cmd.SetArgs([]string{"--namespace", "kitchen", "--output-dir", dir, "--check"})
+		assert.Error(t, cmd.Execute())
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		cmd := AvroSchemaCobraCommand(types)
+		cmd.SetOutput(ioutil.Discard)
+		cmd.SetArgs([]string{"chef"})
+		assert.Error(t, cmd.Execute())
+	})
+}
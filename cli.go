@@ -15,9 +15,14 @@
 package tools
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -56,11 +61,106 @@ func CobraBindEnvironmentVariables(prefix string) func(cmd *cobra.Command, _ []s
 	}
 }
 
+// AvroSchemaCobraCommand returns a cobra command that generates Avro schemas
+// from Go types with GenerateAvroSchema. types maps the names that may be
+// given as arguments on the command line to a value of each type, e.g.
+// {"chef": Chef{}}. If no arguments are given, schemas for all types are
+// generated.
+//
+// By default, schemas are printed to stdout. With --output-dir, each schema
+// is written to <name>.avsc in the directory instead, and with --check the
+// command fails if any file in the directory differs from the generated
+// schema, which is useful for catching drift in CI.
+func AvroSchemaCobraCommand(types map[string]interface{}) *cobra.Command {
+	var namespace, outputDir string
+	var check bool
+	cmd := &cobra.Command{
+		Use:   "avro-schema [type]...",
+		Short: "Generate Avro schemas from Go types",
+		Long: fmt.Sprintf(
+			"Generate Avro schemas from Go types. Available types: %s",
+			strings.Join(sortedKeys(types), ", ")),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				args = sortedKeys(types)
+			}
+			if check && outputDir == "" {
+				return fmt.Errorf("--check requires --output-dir")
+			}
+			for _, name := range args {
+				target, ok := types[name]
+				if !ok {
+					return fmt.Errorf("unknown type %s", name)
+				}
+				schema, err := GenerateAvroSchema(target, namespace)
+				if err != nil {
+					return err
+				}
+				schema += "\n"
+				if outputDir == "" {
+					fmt.Fprint(cmd.OutOrStdout(), schema)
+					continue
+				}
+				path := filepath.Join(outputDir, name+".avsc")
+				if check {
+					existing, err := ioutil.ReadFile(path)
+					if err != nil {
+						return err
+					}
+					if string(existing) != schema {
+						return fmt.Errorf("%s is out of date with type %s", path, name)
+					}
+					continue
+				}
+				if err := ioutil.WriteFile(path, []byte(schema), 0644); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&namespace, "namespace", "", "Namespace of the generated records")
+	flags.StringVar(&outputDir, "output-dir", "", "Directory to write <type>.avsc files to instead of stdout")
+	flags.BoolVar(&check, "check", false, "Fail if the schemas in --output-dir differ from the generated schemas")
+	return cmd
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // RegisterViperFlags registers HTTP flags with Viper CLIs
 func (c *HTTPServerConfig) RegisterViperFlags(flags *pflag.FlagSet, defaultPort int) {
 	flags.StringVarP(&c.Address, "address", "a", "localhost", "Address for server")
 	flags.IntVarP(&c.Port, "port", "p", defaultPort, "Port for server")
 	flags.StringVar(&c.Name, "server-name", c.Name, "Server Name")
+	flags.DurationVar(&c.ReadTimeout, "read-timeout", defaultHTTPReadTimeout, "Maximum duration for reading an entire request, including the body. A negative value means no timeout.")
+	flags.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", 5*time.Second, "Maximum duration for reading request headers. 0 means the read timeout is used, and a negative value means no timeout.")
+	flags.DurationVar(&c.WriteTimeout, "write-timeout", defaultHTTPWriteTimeout, "Maximum duration before timing out writes of a response. A negative value means no timeout, e.g. for streaming.")
+	flags.DurationVar(&c.IdleTimeout, "idle-timeout", 120*time.Second, "Maximum duration to wait for the next request on a keep-alive connection")
+	flags.IntVar(&c.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers in bytes")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", defaultHTTPShutdownTimeout, "Grace period for in-flight requests to complete on shutdown")
+	flags.DurationVar(&c.PreShutdownDelay, "pre-shutdown-delay", 0, "How long to keep serving with a failing readiness probe before shutting down, so that endpoint removal can propagate")
+	flags.StringVar(&c.TLSCrtPath, "tls-crt-path", "", "Server TLS Certificate Path. TLS is enabled if set, and the certificate is reloaded when it changes.")
+	flags.StringVar(&c.TLSKeyPath, "tls-key-path", "", "Server TLS Key Path")
+	flags.StringVar(&c.TLSClientCaCrtPath, "tls-client-ca-crt-path", "", "CA Certificate Path for verifying client certificates. Requires clients to present a certificate if set.")
+	flags.BoolVar(&c.H2C, "h2c", false, "Serve HTTP/2 without TLS")
+	flags.StringVar(&c.AdminAddress, "admin-address", "", "Address for the admin server. Binds to all interfaces by default; set to localhost to only allow local access.")
+	flags.IntVar(&c.AdminPort, "admin-port", 0, "Port for the admin server serving health, metrics, and pprof endpoints. If 0, they are served on --port.")
+	flags.DurationVar(&c.HealthChecks.CacheDuration, "health-check-cache-duration", time.Second, "How long health check results are reused by the /livez, /readyz, and /startupz probes")
+	flags.Float64Var(&c.RateLimit.Rate, "rate-limit", 0, "Requests per second allowed for each rate limit key. Rate limiting is disabled if 0.")
+	flags.IntVar(&c.RateLimit.Burst, "rate-limit-burst", 0, "Requests that may be made at once for each rate limit key. Defaults to --rate-limit.")
+	flags.Var(&c.RateLimit.Key, "rate-limit-key", "What requests share a rate limit, one of ip, header, or route")
+	flags.StringVar(&c.RateLimit.Header, "rate-limit-header", "", "Request header that requests are rate limited by when --rate-limit-key is header")
+	flags.IntVar(&c.ConcurrencyLimit.MaxInFlight, "max-in-flight-requests", 0, "Maximum number of requests handled at once. Unlimited if 0.")
+	flags.IntVar(&c.ConcurrencyLimit.MaxQueued, "max-queued-requests", 0, "Maximum number of requests waiting for --max-in-flight-requests. Requests over this are rejected with 503.")
+	flags.DurationVar(&c.ConcurrencyLimit.QueueTimeout, "request-queue-timeout", time.Second, "How long queued requests wait to be handled before being rejected with 503. 0 means no timeout.")
 }
 
 // RegisterViperFlags registers Kafka flags with Viper CLIs
@@ -71,7 +171,12 @@ func (kc *KafkaConfig) RegisterViperFlags(flags *pflag.FlagSet) {
 	flags.StringVar(&kc.TLSCrtPath, "kafka-client-crt-path", "", "Kafka Client TLS Certificate Path")
 	flags.StringVar(&kc.TLSKeyPath, "kafka-client-key-path", "", "Kafka Client TLS Key Path")
 	flags.BoolVar(&kc.Verbose, "kafka-verbose", false, "When this flag is set Kafka will log verbosely")
-	flags.BoolVar(&kc.JSONEnabled, "enable-json", true, "When this flag is set, messages from Kafka will be consumed as JSON instead of Avro")
+	kc.MessageFormat = JSONMessageFormat
+	flags.Var(&kc.MessageFormat, "kafka-message-format", "Format of messages consumed from Kafka, one of json, avro, protobuf, auto, connect-json, or debezium")
+	// --enable-json is kept for existing deployments, and sets the message format
+	flags.VarPF(&kafkaJSONEnabledFlag{format: &kc.MessageFormat}, "enable-json", "", "When this flag is set, messages from Kafka will be consumed as JSON instead of Avro").NoOptDefVal = "true"
+	_ = flags.MarkDeprecated("enable-json", "use --kafka-message-format instead")
+	flags.Var(&kc.KeyFormat, "kafka-key-format", "Format of the keys of messages consumed from Kafka, one of raw, string, json, or avro")
 }
 
 // RegisterViperFlags register Logging flags with Viper CLIs
@@ -85,9 +190,23 @@ func (lc *LoggingConfig) RegisterViperFlags(flags *pflag.FlagSet) {
 	flags.IntVar(&lc.SamplingThereafter, "log-sampling-thereafter", 100, "Keep every Nth log with a given message and threshold after log-sampling-initial is exceeded. Only valid when not using the development logger.")
 }
 
-// RegisterViperFlags registers Kafka flags with Viper CLIs
+// RegisterViperFlags registers Schema Registry flags with Viper CLIs
 func (src *SchemaRegistryConfig) RegisterViperFlags(flags *pflag.FlagSet) {
 	flags.StringVarP(&src.SchemaRegistryURL, "kafka-schema-registry", "r", "http://localhost:8081", "Kafka Schema Registry Address")
+	flags.StringVar(&src.Username, "kafka-schema-registry-username", "", "Kafka Schema Registry basic auth username")
+	flags.StringVar(&src.Password, "kafka-schema-registry-password", "", "Kafka Schema Registry basic auth password")
+	flags.StringVar(&src.BearerToken, "kafka-schema-registry-bearer-token", "", "Kafka Schema Registry bearer token. Takes precedence over basic auth.")
+	flags.StringVar(&src.TLSCaCrtPath, "kafka-schema-registry-ca-crt-path", "", "Kafka Schema Registry TLS CA Certificate Path")
+	flags.StringVar(&src.TLSCrtPath, "kafka-schema-registry-client-crt-path", "", "Kafka Schema Registry Client TLS Certificate Path")
+	flags.StringVar(&src.TLSKeyPath, "kafka-schema-registry-client-key-path", "", "Kafka Schema Registry Client TLS Key Path")
+	flags.DurationVar(&src.Timeout, "kafka-schema-registry-timeout", defaultSchemaRegistryTimeout, "Kafka Schema Registry request timeout")
+	flags.IntVar(&src.MaxRetries, "kafka-schema-registry-max-retries", 3, "Number of times to retry failed Kafka Schema Registry requests")
+	flags.DurationVar(&src.RetryBackoff, "kafka-schema-registry-retry-backoff", 100*time.Millisecond, "Delay before the first retry of a failed Kafka Schema Registry request, doubled on each retry")
+	flags.StringVar(&src.SchemaCacheDir, "kafka-schema-registry-cache-dir", "", "Directory in which to persist Kafka Schema Registry schemas across restarts. Disabled if empty.")
+	flags.Int64Var(&src.SchemaCacheMaxBytes, "kafka-schema-registry-cache-max-bytes", 64*1024*1024, "Maximum total size of the Kafka Schema Registry cache directory in bytes. Unlimited if 0.")
+	flags.Var(subjectNameStrategyValue{&src.SubjectNameStrategy}, "kafka-schema-registry-subject-name-strategy", "Strategy for the Kafka Schema Registry subjects of produced messages, one of topic, record, or topic-record")
+	flags.BoolVar(&src.AutoRegisterSchemas, "kafka-schema-registry-auto-register", false, "Register schemas of produced messages with Kafka Schema Registry")
+	flags.BoolVar(&src.ReaderSchemaFromTarget, "kafka-avro-reader-schema-from-target", false, "Resolve Avro messages into a reader schema derived from the unmarshal target type")
 }
 
 // RegisterViperFlags registers Sentry flags with Viper CLIs
@@ -95,6 +214,12 @@ func (sc *SentryConfig) RegisterViperFlags(flags *pflag.FlagSet) {
 	flags.StringVar(&sc.DSN, "sentry-dsn", "", "Sentry DSN")
 }
 
+// RegisterViperFlags registers New Relic flags with Viper CLIs
+func (nrc *NewRelicConfig) RegisterViperFlags(flags *pflag.FlagSet, defaultAppName string) {
+	flags.StringVar(&nrc.LicenseKey, "newrelic-license-key", "", "New Relic license key. New Relic is disabled if empty.")
+	flags.StringVar(&nrc.AppName, "newrelic-app-name", defaultAppName, "New Relic application name")
+}
+
 // RegisterViperFlags registers Tracer flags with Viper CLIs
 func (tc *TracingConfig) RegisterViperFlags(flags *pflag.FlagSet, defaultTracerName string) {
 	flags.BoolVarP(&tc.Enabled, "tracer-enabled", "t", true, "Enable tracing")
@@ -0,0 +1,54 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spothero/tools"
+)
+
+// newRootCmd creates the tools CLI, which decodes and encodes Kafka message
+// payloads for debugging. With --schema-dir, schemas are read from a
+// directory of <schema id>.avsc files, such as the schema cache directory
+// of a consumer, instead of Schema Registry.
+func newRootCmd() *cobra.Command {
+	config := &tools.SchemaRegistryConfig{}
+	var schemaDir string
+	bindEnvironmentVariables := tools.CobraBindEnvironmentVariables("tools")
+	cmd := &cobra.Command{
+		Use:   "tools",
+		Short: "SpotHero Kafka payload tools",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			bindEnvironmentVariables(cmd, args)
+			if schemaDir != "" {
+				config.SchemaRegistryURL = ""
+				config.SchemaCacheDir = schemaDir
+			}
+		},
+	}
+	flags := cmd.PersistentFlags()
+	config.RegisterViperFlags(flags)
+	flags.StringVar(&schemaDir, "schema-dir", "", "Directory of <schema id>.avsc files to use instead of Schema Registry")
+	cmd.AddCommand(tools.KafkaDecodeCobraCommand(config), tools.KafkaEncodeCobraCommand(config))
+	return cmd
+}
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
@@ -47,7 +47,7 @@ func newRootCmd(args []string) *cobra.Command {
 		Version:          fmt.Sprintf("%s (%s)", version, gitSHA),
 		PersistentPreRun: tools.CobraBindEnvironmentVariables("example_server"),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			config.RunHTTPServer(nil, nil, registerMuxes)
+			config.RunHTTPServer(nil, nil, registerRoutes)
 			return nil
 		},
 	}
@@ -57,12 +57,12 @@ func newRootCmd(args []string) *cobra.Command {
 	return cmd
 }
 
-// RegisterMuxes is a callback used to register HTTP endpoints to the default server
+// registerRoutes is a callback used to register HTTP endpoints to the default server
 // NOTE: The HTTP server automatically registers /health and /metrics -- Have a look in your
 // browser!
-func registerMuxes(mux *http.ServeMux) {
-	mux.HandleFunc("/", helloWorld)
-	mux.HandleFunc("/best-language", bestLanguage)
+func registerRoutes(router tools.HTTPRouter) {
+	router.Handle("/", http.HandlerFunc(helloWorld))
+	router.Handle("/best-language", http.HandlerFunc(bestLanguage))
 }
 
 // helloWorld simply writes "hello world" to the caller. It is ended for use as an HTTP callback.
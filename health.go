@@ -0,0 +1,241 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HealthProbe identifies the Kubernetes probes that a health check applies
+// to. Probes may be combined, e.g. ReadinessProbe | StartupProbe.
+type HealthProbe int
+
+const (
+	// ReadinessProbe checks whether the service should receive traffic
+	ReadinessProbe HealthProbe = 1 << iota
+	// LivenessProbe checks whether the service should be restarted
+	LivenessProbe
+	// StartupProbe checks whether the service has finished starting
+	StartupProbe
+)
+
+const defaultHealthCheckTimeout = 5 * time.Second
+
+// Health statuses reported by health checks and probes
+const (
+	HealthPass = "pass"
+	HealthFail = "fail"
+)
+
+// HealthCheck is a named check of the health of a service or one of its
+// dependencies
+type HealthCheck struct {
+	Name string
+	// Check returns an error if the check fails. The context is cancelled
+	// after Timeout.
+	Check func(ctx context.Context) error
+	// Timeout after which the check fails. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Critical checks fail the probes they apply to when they fail, while
+	// failures of other checks are only reported
+	Critical bool
+	// Probes the check applies to. Defaults to ReadinessProbe.
+	Probes HealthProbe
+}
+
+// HealthCheckResult is the result of running a health check
+type HealthCheckResult struct {
+	Status    string    `json:"status"`
+	Critical  bool      `json:"critical"`
+	Error     string    `json:"error,omitempty"`
+	Duration  float64   `json:"duration_seconds"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// HealthReport is the result of a probe, with the result of each check
+type HealthReport struct {
+	Status string                       `json:"status"`
+	Error  string                       `json:"error,omitempty"`
+	Checks map[string]HealthCheckResult `json:"checks"`
+}
+
+// HealthCheckRegistry holds the health checks of a service and serves them
+// as Kubernetes probes. The zero value is ready to use.
+type HealthCheckRegistry struct {
+	// CacheDuration is how long the result of a check is reused before the
+	// check is run again. Results are not cached if 0.
+	CacheDuration time.Duration
+	mutex         sync.Mutex
+	checks        []HealthCheck
+	results       map[string]HealthCheckResult
+	started       bool
+	shuttingDown  bool
+}
+
+// Register adds a health check to the registry. Check names must be unique.
+func (hcr *HealthCheckRegistry) Register(check HealthCheck) error {
+	if check.Name == "" || check.Check == nil {
+		return fmt.Errorf("health checks require a name and a check function")
+	}
+	if check.Timeout == 0 {
+		check.Timeout = defaultHealthCheckTimeout
+	}
+	if check.Probes == 0 {
+		check.Probes = ReadinessProbe
+	}
+	hcr.mutex.Lock()
+	defer hcr.mutex.Unlock()
+	for _, registered := range hcr.checks {
+		if registered.Name == check.Name {
+			return fmt.Errorf("health check %s is already registered", check.Name)
+		}
+	}
+	hcr.checks = append(hcr.checks, check)
+	return nil
+}
+
+// SetShuttingDown makes the readiness probe fail from now on, so that
+// Kubernetes stops routing traffic to the service while it shuts down
+func (hcr *HealthCheckRegistry) SetShuttingDown() {
+	hcr.mutex.Lock()
+	defer hcr.mutex.Unlock()
+	hcr.shuttingDown = true
+}
+
+// Run runs the checks that apply to a probe, concurrently, and reports
+// whether the probe passes. The readiness probe fails while shutting down,
+// and the startup probe passes without running checks once it has passed.
+func (hcr *HealthCheckRegistry) Run(ctx context.Context, probe HealthProbe) HealthReport {
+	report := HealthReport{Status: HealthPass, Checks: make(map[string]HealthCheckResult)}
+	hcr.mutex.Lock()
+	if probe == StartupProbe && hcr.started {
+		hcr.mutex.Unlock()
+		return report
+	}
+	if probe == ReadinessProbe && hcr.shuttingDown {
+		hcr.mutex.Unlock()
+		report.Status = HealthFail
+		report.Error = "shutting down"
+		return report
+	}
+	var checks []HealthCheck
+	for _, check := range hcr.checks {
+		if check.Probes&probe != 0 {
+			checks = append(checks, check)
+		}
+	}
+	hcr.mutex.Unlock()
+
+	results := make([]HealthCheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			results[i] = hcr.result(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+	for i, check := range checks {
+		report.Checks[check.Name] = results[i]
+		if results[i].Status == HealthFail && check.Critical {
+			report.Status = HealthFail
+		}
+	}
+	if probe == StartupProbe && report.Status == HealthPass {
+		hcr.mutex.Lock()
+		hcr.started = true
+		hcr.mutex.Unlock()
+	}
+	return report
+}
+
+// result returns the cached result of a check, or runs the check if there
+// is no cached result
+func (hcr *HealthCheckRegistry) result(ctx context.Context, check HealthCheck) HealthCheckResult {
+	hcr.mutex.Lock()
+	cached, ok := hcr.results[check.Name]
+	hcr.mutex.Unlock()
+	if ok && time.Since(cached.CheckedAt) < hcr.CacheDuration {
+		return cached
+	}
+	result := HealthCheckResult{Status: HealthPass, Critical: check.Critical, CheckedAt: time.Now()}
+	if err := runHealthCheck(ctx, check); err != nil {
+		result.Status = HealthFail
+		result.Error = err.Error()
+		Logger.Warn(
+			"Health check failed", zap.String("check", check.Name),
+			zap.Bool("critical", check.Critical), zap.Error(err))
+	}
+	result.Duration = time.Since(result.CheckedAt).Seconds()
+	hcr.mutex.Lock()
+	if hcr.results == nil {
+		hcr.results = make(map[string]HealthCheckResult)
+	}
+	hcr.results[check.Name] = result
+	hcr.mutex.Unlock()
+	return result
+}
+
+// runHealthCheck runs a check with its timeout, failing the check when the
+// timeout expires even if the check ignores its context
+func runHealthCheck(ctx context.Context, check HealthCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errs <- fmt.Errorf("health check panicked: %v", r)
+			}
+		}()
+		errs <- check.Check(ctx)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("health check timed out after %s", check.Timeout)
+	}
+}
+
+// handler serves a probe, responding with the JSON report and a 200 status
+// if the probe passes, or a 503 status if it fails
+func (hcr *HealthCheckRegistry) handler(probe HealthProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := hcr.Run(r.Context(), probe)
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != HealthPass {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			Logger.Error("Unable to write health report", zap.Error(err))
+		}
+	}
+}
+
+// registerHandlers mounts the probes at /livez, /readyz, and /startupz
+func (hcr *HealthCheckRegistry) registerHandlers(mux *http.ServeMux) {
+	mux.Handle("/livez", hcr.handler(LivenessProbe))
+	mux.Handle("/readyz", hcr.handler(ReadinessProbe))
+	mux.Handle("/startupz", hcr.handler(StartupProbe))
+}
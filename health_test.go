@@ -0,0 +1,178 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingCheck returns a check function that counts its calls and returns
+// the error pointed to
+func countingCheck(calls *int32, err *error) func(context.Context) error {
+	return func(context.Context) error {
+		atomic.AddInt32(calls, 1)
+		return *err
+	}
+}
+
+func TestHealthCheckRegistry_Register(t *testing.T) {
+	registry := &HealthCheckRegistry{}
+	check := func(context.Context) error { return nil }
+	require.NoError(t, registry.Register(HealthCheck{Name: "kafka", Check: check}))
+	assert.Error(t, registry.Register(HealthCheck{Name: "kafka", Check: check}))
+	assert.Error(t, registry.Register(HealthCheck{Name: "postgres"}))
+	assert.Error(t, registry.Register(HealthCheck{Check: check}))
+	// defaults are applied
+	assert.Equal(t, defaultHealthCheckTimeout, registry.checks[0].Timeout)
+	assert.Equal(t, ReadinessProbe, registry.checks[0].Probes)
+}
+
+func TestHealthCheckRegistry_Run(t *testing.T) {
+	registry := &HealthCheckRegistry{}
+	var kafkaErr, cacheErr error
+	var kafkaCalls, cacheCalls int32
+	require.NoError(t, registry.Register(HealthCheck{
+		Name:     "kafka",
+		Check:    countingCheck(&kafkaCalls, &kafkaErr),
+		Critical: true,
+		Probes:   ReadinessProbe | StartupProbe,
+	}))
+	require.NoError(t, registry.Register(HealthCheck{
+		Name:  "cache",
+		Check: countingCheck(&cacheCalls, &cacheErr),
+	}))
+	require.NoError(t, registry.Register(HealthCheck{
+		Name:     "deadlock",
+		Check:    func(context.Context) error { return nil },
+		Critical: true,
+		Probes:   LivenessProbe,
+	}))
+	ctx := context.Background()
+
+	report := registry.Run(ctx, ReadinessProbe)
+	assert.Equal(t, HealthPass, report.Status)
+	assert.Len(t, report.Checks, 2)
+
+	// non-critical failures are reported without failing the probe
+	cacheErr = fmt.Errorf("cache unavailable")
+	report = registry.Run(ctx, ReadinessProbe)
+	assert.Equal(t, HealthPass, report.Status)
+	assert.Equal(t, HealthFail, report.Checks["cache"].Status)
+	assert.Equal(t, "cache unavailable", report.Checks["cache"].Error)
+
+	kafkaErr = fmt.Errorf("no brokers")
+	report = registry.Run(ctx, ReadinessProbe)
+	assert.Equal(t, HealthFail, report.Status)
+	assert.True(t, report.Checks["kafka"].Critical)
+
+	// only checks that apply to a probe are run
+	report = registry.Run(ctx, LivenessProbe)
+	assert.Equal(t, HealthPass, report.Status)
+	assert.Len(t, report.Checks, 1)
+	assert.Contains(t, report.Checks, "deadlock")
+
+	// startup passes without running checks once it has passed
+	assert.Equal(t, HealthFail, registry.Run(ctx, StartupProbe).Status)
+	kafkaErr = nil
+	assert.Equal(t, HealthPass, registry.Run(ctx, StartupProbe).Status)
+	calls := atomic.LoadInt32(&kafkaCalls)
+	kafkaErr = fmt.Errorf("no brokers")
+	assert.Equal(t, HealthPass, registry.Run(ctx, StartupProbe).Status)
+	assert.Equal(t, calls, atomic.LoadInt32(&kafkaCalls))
+
+	// readiness fails while shutting down
+	kafkaErr = nil
+	registry.SetShuttingDown()
+	report = registry.Run(ctx, ReadinessProbe)
+	assert.Equal(t, HealthFail, report.Status)
+	assert.Equal(t, "shutting down", report.Error)
+	assert.Equal(t, HealthPass, registry.Run(ctx, LivenessProbe).Status)
+}
+
+func TestHealthCheckRegistry_Cache(t *testing.T) {
+	registry := &HealthCheckRegistry{CacheDuration: time.Hour}
+	var err error
+	var calls int32
+	require.NoError(t, registry.Register(HealthCheck{Name: "kafka", Check: countingCheck(&calls, &err)}))
+	registry.Run(context.Background(), ReadinessProbe)
+	registry.Run(context.Background(), ReadinessProbe)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	registry.CacheDuration = 0
+	registry.Run(context.Background(), ReadinessProbe)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestHealthCheckRegistry_Timeout(t *testing.T) {
+	registry := &HealthCheckRegistry{}
+	blocked := make(chan struct{})
+	defer close(blocked)
+	require.NoError(t, registry.Register(HealthCheck{
+		Name: "stuck",
+		// a check that ignores its context still times out
+		Check:    func(context.Context) error { <-blocked; return nil },
+		Timeout:  10 * time.Millisecond,
+		Critical: true,
+	}))
+	require.NoError(t, registry.Register(HealthCheck{
+		Name:     "panics",
+		Check:    func(context.Context) error { panic("flavortown") },
+		Critical: false,
+	}))
+	report := registry.Run(context.Background(), ReadinessProbe)
+	assert.Equal(t, HealthFail, report.Status)
+	assert.Contains(t, report.Checks["stuck"].Error, "timed out")
+	assert.Contains(t, report.Checks["panics"].Error, "flavortown")
+}
+
+func TestHealthCheckRegistry_Handlers(t *testing.T) {
+	registry := &HealthCheckRegistry{}
+	require.NoError(t, registry.Register(HealthCheck{
+		Name:     "kafka",
+		Check:    func(context.Context) error { return fmt.Errorf("no brokers") },
+		Critical: true,
+	}))
+	mux := http.NewServeMux()
+	registry.registerHandlers(mux)
+
+	tests := map[string]int{
+		"/livez":    http.StatusOK,
+		"/readyz":   http.StatusServiceUnavailable,
+		"/startupz": http.StatusOK,
+	}
+	for path, status := range tests {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, status, recorder.Code, path)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		report := HealthReport{}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+		if status == http.StatusOK {
+			assert.Equal(t, HealthPass, report.Status, path)
+		} else {
+			assert.Equal(t, "no brokers", report.Checks["kafka"].Error)
+		}
+	}
+}
@@ -15,24 +15,32 @@
 package tools
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"net/http/pprof"
 	"os"
 	"os/signal"
-	"strconv"
+	"regexp"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/getsentry/raven-go"
 	"github.com/newrelic/go-agent"
-	"github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	defaultHTTPReadTimeout     = 5 * time.Second
+	defaultHTTPWriteTimeout    = 30 * time.Second
+	defaultHTTPShutdownTimeout = 5 * time.Second
 )
 
 // HTTPServerConfig contains the basic configuration necessary for running an HTTP Server
@@ -45,24 +53,165 @@ type HTTPServerConfig struct {
 	GitSHA     string
 	Logging    LoggingConfig
 	Tracer     TracingConfig
+	NewRelic   NewRelicConfig
+	// Timeouts and limits of the public server, as in http.Server.
+	// ReadTimeout and WriteTimeout default to 5 and 30 seconds, and negative
+	// values mean no timeout. Other zero values mean the net/http default.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// ShutdownTimeout is how long in-flight requests are given to complete
+	// on shutdown. Defaults to 5 seconds.
+	ShutdownTimeout time.Duration
+	// TLSCrtPath and TLSKeyPath enable TLS. The files are reloaded when they
+	// change. With TLSClientCaCrtPath, clients must present a certificate
+	// signed by the CA.
+	TLSCrtPath         string
+	TLSKeyPath         string
+	TLSClientCaCrtPath string
+	// H2C enables HTTP/2 without TLS, e.g. behind a proxy that terminates TLS
+	H2C bool
+	// PreShutdownDelay is how long the server keeps serving with a failing
+	// readiness probe before shutting down, giving load balancers time to
+	// stop routing requests to it
+	PreShutdownDelay time.Duration
+	shutdownHooks    []ShutdownHook
+	shutdownMutex    sync.Mutex
+	// Router routes application requests. Defaults to a ServeMuxRouter.
+	Router HTTPRouter
+	// AdminAddress and AdminPort are where the admin server listens. If
+	// AdminPort is 0, admin endpoints are served on the public port. An empty
+	// AdminAddress binds all interfaces so that probes and scrapes from
+	// outside the pod succeed; use localhost to only allow local access.
+	AdminAddress string
+	AdminPort    int
+	// AdminRoutes optionally registers additional admin endpoints
+	AdminRoutes func(mux *http.ServeMux)
+	// HealthChecks are served as probes at /livez, /readyz, and /startupz
+	// on the admin endpoints
+	HealthChecks HealthCheckRegistry
+	// PathNormalizer optionally maps the paths of requests that don't match a
+	// route to the path label of HTTP metrics
+	PathNormalizer HTTPPathNormalizer
+	// PanicResponse optionally returns the JSON body of responses to
+	// requests whose handler panicked. Defaults to DefaultHTTPPanicResponse.
+	PanicResponse HTTPPanicResponse
+	// RateLimit and ConcurrencyLimit protect the server from traffic spikes.
+	// Both are disabled by default.
+	RateLimit        HTTPRateLimitConfig
+	ConcurrencyLimit HTTPConcurrencyLimitConfig
+	limitsOnce       sync.Once
+	limits           []HTTPMiddleware
+	// Middleware wraps the router, outermost first, e.g. to add
+	// authentication, CORS, or compression. Defaults to DefaultMiddleware.
+	Middleware []HTTPMiddleware
+	// RouteMiddleware optionally replaces Middleware for requests matching a
+	// route template, as reported by the Router. Templates set with
+	// SetHTTPRouteTemplate are only known once the request has been routed,
+	// so they can't select middleware.
+	RouteMiddleware     map[string][]HTTPMiddleware
+	newRelicApplication newrelic.Application
 }
 
 type httpStatusRecorder struct {
 	http.ResponseWriter
-	StatusCode int
+	StatusCode  int
+	wroteHeader bool
 }
 
 func (hsr *httpStatusRecorder) WriteHeader(code int) {
 	hsr.StatusCode = code
+	hsr.wroteHeader = true
 	hsr.ResponseWriter.WriteHeader(code)
 }
 
+func (hsr *httpStatusRecorder) Write(b []byte) (int, error) {
+	hsr.wroteHeader = true
+	return hsr.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for streaming responses. Nothing is flushed
+// if the underlying writer isn't an http.Flusher.
+func (hsr *httpStatusRecorder) Flush() {
+	if flushHTTPResponse(hsr.ResponseWriter) {
+		hsr.wroteHeader = true
+	}
+}
+
+// Hijack implements http.Hijacker, e.g. for WebSockets, if the underlying
+// writer is an http.Hijacker
+func (hsr *httpStatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hijackHTTPResponse(hsr.ResponseWriter)
+	if err == nil {
+		hsr.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Push implements http.Pusher for HTTP/2 server push, if the underlying
+// writer is an http.Pusher
+func (hsr *httpStatusRecorder) Push(target string, opts *http.PushOptions) error {
+	return pushHTTPResponse(hsr.ResponseWriter, target, opts)
+}
+
+// flushHTTPResponse flushes the writer if it is an http.Flusher, and returns
+// whether it was flushed
+func flushHTTPResponse(w http.ResponseWriter) bool {
+	flusher, ok := w.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+	return ok
+}
+
+func hijackHTTPResponse(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the HTTP response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func pushHTTPResponse(w http.ResponseWriter, target string, opts *http.PushOptions) error {
+	pusher, ok := w.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return pusher.Push(target, opts)
+}
+
 type httpMetrics struct {
 	Server   string
 	Counter  *prometheus.CounterVec
 	Duration *prometheus.HistogramVec
 }
 
+// UnmatchedHTTPRoute is the path label of HTTP metrics for requests that
+// don't match a route, so that unknown paths don't each create new series
+const UnmatchedHTTPRoute = "unmatched"
+
+// HTTPPathNormalizer maps the path of a request that didn't match a route to
+// a low cardinality path label for HTTP metrics, e.g. /users/123 to
+// /users/{id}
+type HTTPPathNormalizer func(path string) string
+
+var httpPathIDPattern = regexp.MustCompile(
+	`^([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{24,})$`)
+
+// NormalizeHTTPPathIDs is an HTTPPathNormalizer that replaces path segments
+// that look like ids, i.e. integers, UUIDs, and long hex strings, with {id}
+func NormalizeHTTPPathIDs(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if httpPathIDPattern.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
 // HTTPMetricsRecorder defines an interface for recording prometheus metrics on HTTP requests
 type HTTPMetricsRecorder interface {
 	RecordHttpMetrics(w http.ResponseWriter, r *http.Request) *prometheus.Timer
@@ -79,62 +228,97 @@ func (c *HTTPServerConfig) CLIRegistration(flags *pflag.FlagSet, defaultPort int
 
 	// Tracing Config
 	c.Tracer.RegisterViperFlags(flags, c.Name)
+
+	// New Relic Config
+	c.NewRelic.RegisterViperFlags(flags, c.Name)
 }
 
-// RunHTTPServer starts and runs a web server, waiting for a cancellation signal to exit
+// AddShutdownHook adds a hook that is run on shutdown, after the HTTP server
+// has drained, such as closing Kafka consumers and producers. Hooks run one
+// at a time in the order they were added.
+func (c *HTTPServerConfig) AddShutdownHook(hook ShutdownHook) {
+	c.shutdownMutex.Lock()
+	defer c.shutdownMutex.Unlock()
+	c.shutdownHooks = append(c.shutdownHooks, hook)
+}
+
+// RunHTTPServer starts and runs a web server, waiting for an interrupt or
+// termination signal to shut down gracefully
 func (c *HTTPServerConfig) RunHTTPServer(
-	preStart func(ctx context.Context, mux *http.ServeMux, server *http.Server),
+	preStart func(ctx context.Context, router HTTPRouter, server *http.Server),
 	postShutdown func(ctx context.Context),
-	registerMuxes func(*http.ServeMux),
+	registerRoutes func(HTTPRouter),
 ) {
 	c.Logging.InitializeLogger()
 	closer := c.Tracer.ConfigureTracer()
-	defer closer.Close()
 
 	// Setup a context to send cancellation signals to goroutines
 	ctx, cancel := context.WithCancel(context.Background())
 
-	// Start web server
-	var webWg sync.WaitGroup
-	webWg.Add(1)
-	go c.RunWebServer(ctx, &webWg, preStart, postShutdown, registerMuxes)
-
-	// Setup a channel to trap interrupt signal
+	// Setup a channel to trap interrupt and termination signals. Kubernetes
+	// sends SIGTERM to stop pods.
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	<-signals
-
-	// Send cancellation signal to running goroutines
-	Logger.Info("Received interrupt, shutting down")
-	cancel()
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		received := <-signals
+		// Send cancellation signal to running goroutines
+		Logger.Info("Received signal, shutting down", zap.String("signal", received.String()))
+		cancel()
+	}()
 
-	// Wait for web server to finish
-	webWg.Wait()
+	c.runWebServerAndTracer(ctx, closer, preStart, postShutdown, registerRoutes)
 	Logger.Info(fmt.Sprintf("%s service terminated", c.Name))
 	// Flush any remaining logs
 	Logger.Sync()
 }
 
-func makeHTTPCounter() *prometheus.CounterVec {
+// runWebServerAndTracer runs the web server until the context is done,
+// closing the tracer once the shutdown hooks have run so that it flushes
+// their spans
+func (c *HTTPServerConfig) runWebServerAndTracer(
+	ctx context.Context,
+	tracer io.Closer,
+	preStart func(ctx context.Context, router HTTPRouter, server *http.Server),
+	postShutdown func(ctx context.Context),
+	registerRoutes func(HTTPRouter),
+) {
+	var webWg sync.WaitGroup
+	webWg.Add(1)
+	c.RunWebServer(ctx, &webWg, preStart, postShutdown, registerRoutes)
+	runShutdownHooks([]ShutdownHook{{Name: "tracer", Hook: func(context.Context) error {
+		return tracer.Close()
+	}}})
+}
+
+func makeHTTPCounter(registry prometheus.Registerer) *prometheus.CounterVec {
 	counter := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
 			Help: "Total number of HTTP Requests received",
 		},
 		[]string{
-			// The path recording the request
+			// The route template or normalized path of the request
 			"path",
+			// The HTTP method of the request
+			"method",
 			// The HTTP status class
 			"status_class",
 			// The Specific HTTP Status Code
 			"status_code",
 		},
 	)
-	prometheus.MustRegister(counter)
+	if err := registry.Register(counter); err != nil {
+		// reuse the metrics of another server in the same process
+		if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return registered.ExistingCollector.(*prometheus.CounterVec)
+		}
+		panic(err)
+	}
 	return counter
 }
 
-func makeHTTPDurationHistogram() *prometheus.HistogramVec {
+func makeHTTPDurationHistogram(registry prometheus.Registerer) *prometheus.HistogramVec {
 	histogram := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "http_request_duration_seconds",
@@ -143,163 +327,318 @@ func makeHTTPDurationHistogram() *prometheus.HistogramVec {
 			Buckets: prometheus.ExponentialBuckets(0.001, 2.0, 16),
 		},
 		[]string{
-			// The path recording the request
+			// The route template or normalized path of the request
 			"path",
+			// The HTTP method of the request
+			"method",
 			// The HTTP status class
 			"status_class",
 			// The Specific HTTP Status Code
 			"status_code",
 		},
 	)
-	prometheus.MustRegister(histogram)
+	if err := registry.Register(histogram); err != nil {
+		// reuse the metrics of another server in the same process
+		if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return registered.ExistingCollector.(*prometheus.HistogramVec)
+		}
+		panic(err)
+	}
 	return histogram
 }
 
-func initHTTPMetrics(server string) *httpMetrics {
+func initHTTPMetrics(server string, registry prometheus.Registerer) *httpMetrics {
 	return &httpMetrics{
 		server,
-		makeHTTPCounter(),
-		makeHTTPDurationHistogram(),
+		makeHTTPCounter(registry),
+		makeHTTPDurationHistogram(registry),
 	}
 }
 
-func (hm *httpMetrics) recordHTTPMetrics(hsr *httpStatusRecorder, r *http.Request) *prometheus.Timer {
-	return prometheus.NewTimer(prometheus.ObserverFunc(func(durationSec float64) {
-		statusClass := ""
-		switch {
-		case hsr.StatusCode >= http.StatusInternalServerError:
-			statusClass = "5xx"
-		case hsr.StatusCode >= http.StatusBadRequest:
-			statusClass = "4xx"
-		case hsr.StatusCode >= http.StatusMultipleChoices:
-			statusClass = "3xx"
-		case hsr.StatusCode >= http.StatusOK:
-			statusClass = "2xx"
-		default:
-			statusClass = "1xx"
-		}
-		labels := prometheus.Labels{
-			"path":         r.URL.Path,
-			"status_class": statusClass,
-			"status_code":  strconv.Itoa(hsr.StatusCode),
-		}
-		hm.Counter.With(labels).Inc()
-		hm.Duration.With(labels).Observe(durationSec)
-	}))
+// BaseHTTPMonitoringHandler is meant to be used as middleware for every request. It will:
+// * Starts an opentracing span, place it in http.Request context, and close
+//   close the span when the request completes
+// * Identify the request by its X-Request-ID header or a new ID, as
+//   RequestIDMiddleware does
+// * Place a logger in the http.Request context that logs the request ID,
+//   method, route, remote address, and trace and span IDs. See
+//   LoggerFromContext.
+// * Capture metrics to Prometheus for the duration of the HTTP request, labeled
+//   by route template rather than path. See SetHTTPRouteTemplate.
+// * Starts a New Relic transaction, if the server has a New Relic application,
+//   place it in the http.Request context, and end it with the response status
+//   when the request completes. See NewRelicTransactionFromContext.
+// * Recover panics, as RecoveryMiddleware does, logging them so that they are
+//   sent to Sentry and responding with DefaultHTTPPanicResponse
+// Each of these is also available as standalone middleware. See
+// HTTPServerConfig.DefaultMiddleware.
+func BaseHTTPMonitoringHandler(next http.Handler, serverName string) http.HandlerFunc {
+	return HTTPMonitoringHandler(next, serverName, nil)
 }
 
-func (hm *httpMetrics) statusCodeLogger(hsr *httpStatusRecorder, r *http.Request) func() {
-	remoteAddress := zap.String("remote_address", r.RemoteAddr)
-	method := zap.String("method", r.Method)
-	hostname := zap.String("hostname", r.URL.Hostname())
-	port := zap.String("port", r.URL.Port())
-	Logger.Info("Request Received", remoteAddress, method, hostname, port)
+// HTTPMonitoringHandler is BaseHTTPMonitoringHandler with a path normalizer
+// for the path label of requests that don't match a route. If pathNormalizer
+// is nil, these requests are labeled UnmatchedHTTPRoute.
+func HTTPMonitoringHandler(next http.Handler, serverName string, pathNormalizer HTTPPathNormalizer) http.HandlerFunc {
+	return newHTTPMonitoringHandler(
+		next, pathNormalizer, initHTTPMetrics(serverName, prometheus.DefaultRegisterer), nil, nil)
+}
 
-	Logger.Debug("Request Headers", zap.Reflect("Headers", r.Header))
+// newHTTPMonitoringHandler returns the monitoring handler, reporting
+// transactions to the New Relic application unless it is nil and responding
+// to panics with panicResponse
+func newHTTPMonitoringHandler(
+	next http.Handler,
+	pathNormalizer HTTPPathNormalizer,
+	handlerMetrics *httpMetrics,
+	application newrelic.Application,
+	panicResponse HTTPPanicResponse,
+) http.HandlerFunc {
+	middleware := defaultHTTPMiddleware(handlerMetrics, nil, NewRelicMiddleware(application), panicResponse)
+	return newHTTPMiddlewareHandler(next, pathNormalizer, middleware, nil).ServeHTTP
+}
 
-	return func() {
-		Logger.Info(
-			"Returning Response",
-			remoteAddress, method, hostname, port, zap.Int("response_code", hsr.StatusCode))
-	}
+// DefaultMiddleware returns the middleware that the server wraps its router
+// with unless Middleware is set, in order: TracingMiddleware,
+// RequestIDMiddleware, LoggingMiddleware, MetricsMiddleware,
+// RateLimitMiddleware and ConcurrencyLimitMiddleware if they are enabled,
+// NewRelicMiddleware with the server's New Relic application, and
+// RecoveryMiddleware with PanicResponse. Without limits, this is the
+// behavior of BaseHTTPMonitoringHandler.
+//
+// The limits are created on the first call and shared by later calls, so
+// that route middleware built from DefaultMiddleware shares the rate limits
+// and in-flight cap of the rest of the server.
+func (c *HTTPServerConfig) DefaultMiddleware() []HTTPMiddleware {
+	return defaultHTTPMiddleware(
+		initHTTPMetrics(c.Name, prometheus.DefaultRegisterer), c.limitMiddleware(), c.newRelicMiddleware,
+		c.PanicResponse)
 }
 
-func (hm *httpMetrics) tracingHandler(hsr *httpStatusRecorder, r *http.Request) (func(), *http.Request) {
-	wireContext, err := opentracing.GlobalTracer().Extract(
-		opentracing.HTTPHeaders,
-		opentracing.HTTPHeadersCarrier(r.Header))
-	if err != nil {
-		Logger.Debug("Failed to extract opentracing context on an incoming HTTP request.")
-	}
-	span, spanCtx := opentracing.StartSpanFromContext(r.Context(), r.URL.Path, ext.RPCServerOption(wireContext))
-	span = span.SetTag("http.method", r.Method)
-	span = span.SetTag("http.hostname", r.URL.Hostname())
-	span = span.SetTag("http.port", r.URL.Port())
-	span = span.SetTag("http.remote_address", r.RemoteAddr)
-	return func() {
-		span.SetTag("http.status_code", strconv.Itoa(hsr.StatusCode))
-		// 5XX Errors are our fault -- note that this span belongs to an errored request
-		if hsr.StatusCode >= http.StatusInternalServerError {
-			span.SetTag("error", true)
+// limitMiddleware returns the enabled rate and concurrency limits of the
+// server, creating them on the first call
+func (c *HTTPServerConfig) limitMiddleware() []HTTPMiddleware {
+	c.limitsOnce.Do(func() {
+		if c.RateLimit.Rate > 0 {
+			c.limits = append(c.limits, RateLimitMiddleware(c.RateLimit))
+		}
+		if c.ConcurrencyLimit.MaxInFlight > 0 {
+			c.limits = append(c.limits, ConcurrencyLimitMiddleware(c.ConcurrencyLimit))
 		}
-		span.Finish()
-	}, r.WithContext(spanCtx)
+	})
+	return c.limits
 }
 
-// BaseHTTPMonitoringHandler is meant to be used as middleware for every request. It will:
-// * Starts an opentracing span, place it in http.Request context, and close
-//   close the span when the request completes
-// * Starts a New Relic transaction, place it in the http.Request context, and
-//   end it when the request completes
-// * Capture any unhandled errors and send them to Sentry
-// * Capture metrics to Prometheus for the duration of the HTTP request
-func BaseHTTPMonitoringHandler(next http.Handler, serverName string) http.HandlerFunc {
-	handlerMetrics := initHTTPMetrics(serverName)
+// newRelicMiddleware reports requests to the New Relic application started
+// by the server, which doesn't exist until the server runs
+func (c *HTTPServerConfig) newRelicMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Default to http.StatusOK which is the golang default if the status is not set.
-		wrappedWriter := &httpStatusRecorder{w, http.StatusOK}
-		tracerCallback, r := handlerMetrics.tracingHandler(wrappedWriter, r)
-		defer tracerCallback()
-		metricsTimer := handlerMetrics.recordHTTPMetrics(wrappedWriter, r)
-		defer metricsTimer.ObserveDuration()
-		statusCodeLogger := handlerMetrics.statusCodeLogger(wrappedWriter, r)
-		defer statusCodeLogger()
-		var transaction newrelic.Transaction
-		type newRelicContextKey string
-		r = r.WithContext(context.WithValue(r.Context(), newRelicContextKey("nrTransaction"), transaction))
-		raven.RecoveryHandler(next.ServeHTTP)(wrappedWriter, r)
+		NewRelicMiddleware(c.newRelicApplication)(next).ServeHTTP(w, r)
 	})
 }
 
-// healthHandler is a simple HTTP handler that returns 200 OK
+// healthHandler is a simple HTTP handler that returns 200 OK. See
+// HealthCheckRegistry for probes that check the health of dependencies.
 func healthHandler(w http.ResponseWriter, _ *http.Request) {
 	fmt.Fprint(w, "OK")
 }
 
-// RunWebServer starts and runs a new web server
+// shutdownServer gracefully shuts down a server, closing any connections
+// that haven't drained when the context is done
+func shutdownServer(ctx context.Context, server *http.Server) {
+	if err := server.Shutdown(ctx); err != nil {
+		Logger.Warn(
+			"HTTP connections did not drain in time, closing them",
+			zap.String("address", server.Addr), zap.Error(err))
+		server.Close()
+	}
+}
+
+// httpTimeout returns the configured timeout, the default timeout if it is
+// zero, or zero (no timeout) if it is negative
+func httpTimeout(timeout, defaultTimeout time.Duration) time.Duration {
+	switch {
+	case timeout < 0:
+		return 0
+	case timeout == 0:
+		return defaultTimeout
+	}
+	return timeout
+}
+
+// RunWebServer starts and runs a new web server. Application routes are
+// registered on the config's Router by registerRoutes. The admin endpoints,
+// /health, /metrics, /debug/pprof/, and any registered by AdminRoutes, are
+// served by a separate admin server if AdminPort is set, and are otherwise
+// mounted ahead of the router.
+//
+// When the context is done, the readiness probe fails for PreShutdownDelay,
+// in-flight requests are given ShutdownTimeout to complete, and then the
+// shutdown hooks are run.
 func (c *HTTPServerConfig) RunWebServer(
 	ctx context.Context,
 	wg *sync.WaitGroup,
-	preStart func(ctx context.Context, mux *http.ServeMux, server *http.Server),
+	preStart func(ctx context.Context, router HTTPRouter, server *http.Server),
 	postShutdown func(ctx context.Context),
-	registerMuxes func(*http.ServeMux),
+	registerRoutes func(HTTPRouter),
 ) {
-	// Setup server and listen for requests
 	defer wg.Done()
-	mux := http.NewServeMux()
+	if err := c.serveHTTP(ctx, preStart, postShutdown, registerRoutes); err != nil {
+		Logger.Error("HTTP server failed", zap.Error(err))
+	}
+}
+
+// LifecycleComponent returns a component that runs the web server as
+// RunWebServer does, for use with a Lifecycle. The logger and tracer are not
+// initialized by the component. Its StopTimeout covers PreShutdownDelay,
+// ShutdownTimeout, and one shutdown hook; slower cleanup should be added to
+// the Lifecycle as components that the server depends on.
+func (c *HTTPServerConfig) LifecycleComponent(
+	preStart func(ctx context.Context, router HTTPRouter, server *http.Server),
+	postShutdown func(ctx context.Context),
+	registerRoutes func(HTTPRouter),
+) LifecycleComponent {
+	shutdownTimeout := c.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultHTTPShutdownTimeout
+	}
+	return LifecycleComponent{
+		Name: "http-server",
+		Run: func(ctx context.Context) error {
+			return c.serveHTTP(ctx, preStart, postShutdown, registerRoutes)
+		},
+		StopTimeout: c.PreShutdownDelay + shutdownTimeout + defaultShutdownHookTimeout,
+	}
+}
+
+// serveHTTP runs the web server until the context is done, returning an
+// error if the server couldn't be configured or stopped serving early
+func (c *HTTPServerConfig) serveHTTP(
+	ctx context.Context,
+	preStart func(ctx context.Context, router HTTPRouter, server *http.Server),
+	postShutdown func(ctx context.Context),
+	registerRoutes func(HTTPRouter),
+) error {
+	// Setup server and listen for requests
+	router := c.Router
+	if router == nil {
+		router = NewServeMuxRouter()
+	}
+	adminMux := newAdminMux(&c.HealthChecks, c.AdminRoutes)
+	var handler HTTPRouter = router
+	var adminServer *http.Server
+	if c.AdminPort != 0 {
+		adminServer = &http.Server{
+			Addr:         fmt.Sprintf("%s:%d", c.AdminAddress, c.AdminPort),
+			Handler:      adminMux,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 60 * time.Second,
+		}
+	} else {
+		handler = &adminRouter{router, adminMux}
+	}
+	tlsConfig, err := c.tlsConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to configure TLS for HTTP server: %s", err.Error())
+	}
+	application, err := c.NewRelic.NewApplication()
+	if err != nil {
+		return fmt.Errorf("unable to start New Relic application: %s", err.Error())
+	}
+	c.newRelicApplication = application
+	middleware := c.Middleware
+	if middleware == nil {
+		middleware = c.DefaultMiddleware()
+	}
+	var serverHandler http.Handler = newHTTPMiddlewareHandler(
+		handler, c.PathNormalizer, middleware, c.RouteMiddleware)
+	if c.H2C && tlsConfig == nil {
+		serverHandler = h2c.NewHandler(serverHandler, &http2.Server{IdleTimeout: c.IdleTimeout})
+	}
 	server := &http.Server{
-		Addr:         fmt.Sprintf("%s:%d", c.Address, c.Port),
-		Handler:      BaseHTTPMonitoringHandler(mux, c.Name),
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		Addr:              fmt.Sprintf("%s:%d", c.Address, c.Port),
+		Handler:           serverHandler,
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       httpTimeout(c.ReadTimeout, defaultHTTPReadTimeout),
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      httpTimeout(c.WriteTimeout, defaultHTTPWriteTimeout),
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
 	}
-	mux.HandleFunc("/health", healthHandler)
-	mux.Handle("/metrics", promhttp.Handler())
-	// Profiling endpoints for use with go tool pprof
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-	if registerMuxes != nil {
-		registerMuxes(mux)
+	if registerRoutes != nil {
+		registerRoutes(router)
 	}
 	// Call any existing pre-start callback
 	if preStart != nil {
-		preStart(ctx, mux, server)
+		preStart(ctx, router, server)
 	}
+	// errors other than http.ErrServerClosed mean a server stopped early
+	serveErrs := make(chan error, 2)
+	var serving sync.WaitGroup
+	serving.Add(1)
 	go func() {
-		Logger.Info(fmt.Sprintf("HTTP server started on %s", server.Addr))
-		if err := server.ListenAndServe(); err != nil {
-			Logger.Info("HTTP server shutdown", zap.Error(err))
+		defer serving.Done()
+		Logger.Info(fmt.Sprintf("HTTP server started on %s", server.Addr), zap.Bool("tls", tlsConfig != nil))
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		Logger.Info("HTTP server shutdown", zap.Error(err))
+		if err != http.ErrServerClosed {
+			serveErrs <- err
 		}
 	}()
-	<-ctx.Done()
-	shutdown, cancel := context.WithTimeout(ctx, 5*time.Second)
+	if adminServer != nil {
+		serving.Add(1)
+		go func() {
+			defer serving.Done()
+			Logger.Info(fmt.Sprintf("HTTP admin server started on %s", adminServer.Addr))
+			err := adminServer.ListenAndServe()
+			Logger.Info("HTTP admin server shutdown", zap.Error(err))
+			if err != http.ErrServerClosed {
+				serveErrs <- err
+			}
+		}()
+	}
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-serveErrs:
+	}
+	c.HealthChecks.SetShuttingDown()
+	if c.PreShutdownDelay > 0 && serveErr == nil {
+		Logger.Info(
+			"Failing readiness before shutting down HTTP server",
+			zap.Duration("delay", c.PreShutdownDelay))
+		time.Sleep(c.PreShutdownDelay)
+	}
+	shutdownTimeout := c.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultHTTPShutdownTimeout
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
-	server.Shutdown(shutdown)
+	Logger.Info("Draining HTTP connections", zap.Duration("timeout", shutdownTimeout))
+	shutdownServer(shutdown, server)
+	if adminServer != nil {
+		// the admin server stops last so that metrics can be scraped while
+		// requests drain
+		shutdownServer(shutdown, adminServer)
+	}
+	serving.Wait()
+	if application != nil {
+		// flush transactions of drained requests
+		application.Shutdown(shutdownTimeout)
+	}
+	c.shutdownMutex.Lock()
+	hooks := c.shutdownHooks
+	c.shutdownMutex.Unlock()
+	runShutdownHooks(hooks)
 	// Call any existing post-shutdown callback
 	if postShutdown != nil {
 		postShutdown(ctx)
 	}
+	return serveErr
 }
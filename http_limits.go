@@ -0,0 +1,371 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// HTTPRateLimitKey defines what requests share a rate limit
+type HTTPRateLimitKey int
+
+const (
+	// RateLimitByClientIP limits requests by the IP address of the client
+	// connection. Behind a proxy, use RateLimitByHeader with a header set by
+	// the proxy, such as X-Real-IP, instead.
+	RateLimitByClientIP HTTPRateLimitKey = iota
+	// RateLimitByHeader limits requests by the value of a request header,
+	// e.g. an API key. Requests without the header share a limit.
+	RateLimitByHeader
+	// RateLimitByRoute limits requests by route template
+	RateLimitByRoute
+)
+
+var httpRateLimitKeyNames = map[HTTPRateLimitKey]string{
+	RateLimitByClientIP: "ip",
+	RateLimitByHeader:   "header",
+	RateLimitByRoute:    "route",
+}
+
+// String returns the name of the rate limit key
+func (hrlk HTTPRateLimitKey) String() string {
+	if name, ok := httpRateLimitKeyNames[hrlk]; ok {
+		return name
+	}
+	return fmt.Sprintf("HTTPRateLimitKey(%d)", int(hrlk))
+}
+
+// Set parses a rate limit key name, implementing the pflag.Value interface
+func (hrlk *HTTPRateLimitKey) Set(name string) error {
+	for key, keyName := range httpRateLimitKeyNames {
+		if strings.EqualFold(name, keyName) {
+			*hrlk = key
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown HTTP rate limit key %s", name)
+}
+
+// Type returns the type name used in CLI help, implementing the pflag.Value interface
+func (hrlk *HTTPRateLimitKey) Type() string {
+	return "key"
+}
+
+// HTTPRateLimitConfig defines token bucket rate limits of HTTP requests.
+// Every key, e.g. every client IP, has a bucket of Burst tokens that refills
+// at Rate tokens per second, and each request takes a token. Requests are
+// rejected with a 429 status and a Retry-After header while the bucket is
+// empty.
+type HTTPRateLimitConfig struct {
+	// Rate is the number of requests per second allowed for each key. Rate
+	// limiting is disabled if 0.
+	Rate float64
+	// Burst is the number of requests that may be made at once. Defaults to
+	// Rate, rounded up.
+	Burst int
+	// Key defines what requests share a limit. Defaults to RateLimitByClientIP.
+	Key HTTPRateLimitKey
+	// Header is the request header of the RateLimitByHeader key
+	Header string
+}
+
+// HTTPConcurrencyLimitConfig caps the number of requests handled at once.
+// Requests over the cap wait in a queue for a request to complete, and are
+// rejected with a 503 status and a Retry-After header if the queue is full
+// or they wait longer than QueueTimeout.
+type HTTPConcurrencyLimitConfig struct {
+	// MaxInFlight is the number of requests handled at once. Concurrency
+	// limiting is disabled if 0.
+	MaxInFlight int
+	// MaxQueued is the number of requests that may wait to be handled. If 0,
+	// requests over MaxInFlight are rejected immediately.
+	MaxQueued int
+	// QueueTimeout is how long queued requests wait to be handled. If 0, they
+	// wait until they are handled or the client goes away.
+	QueueTimeout time.Duration
+}
+
+// Reasons that requests are rejected, as labeled in metrics
+const (
+	rateLimitedReason   = "rate_limit"
+	loadShedReason      = "load_shed"
+	queueTimeoutReason  = "queue_timeout"
+	queueCanceledReason = "queue_canceled"
+)
+
+func makeHTTPRejectedCounter(registry prometheus.Registerer) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_rejected_total",
+			Help: "Total number of HTTP Requests rejected by rate or concurrency limits",
+		},
+		[]string{
+			// The route template or normalized path of the request
+			"path",
+			// Why the request was rejected: rate_limit, load_shed,
+			// queue_timeout, or queue_canceled
+			"reason",
+		},
+	)
+	if err := registry.Register(counter); err != nil {
+		// reuse the metrics of another server in the same process
+		if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return registered.ExistingCollector.(*prometheus.CounterVec)
+		}
+		panic(err)
+	}
+	return counter
+}
+
+// rejectHTTPRequest responds to a request rejected by a limit with an
+// HTTPErrorResponse, asking the client to retry after the given delay
+func rejectHTTPRequest(
+	w http.ResponseWriter,
+	r *http.Request,
+	rejected *prometheus.CounterVec,
+	reason string,
+	status int,
+	retryAfter time.Duration,
+) {
+	_, r, state := httpRequestStateFor(w, r)
+	rejected.With(prometheus.Labels{"path": state.pathLabel(r), "reason": reason}).Inc()
+	LoggerFromContext(r.Context()).Debug("Rejected HTTP request", zap.String("reason", reason))
+	body, err := json.Marshal(HTTPErrorResponse{
+		Error:     http.StatusText(status),
+		RequestID: RequestIDFromContext(r.Context()),
+	})
+	if err != nil {
+		Logger.Error("Unable to encode HTTP error response", zap.Error(err))
+	}
+	// Retry-After is a whole number of seconds, so round up
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		Logger.Debug("Unable to write HTTP error response", zap.Error(err))
+	}
+}
+
+// tokenBucket holds the tokens of a key as of the last time it was used
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// idleBucketSweepInterval is how often buckets that have refilled are
+// removed, bounding the memory used by keys that are no longer seen
+const idleBucketSweepInterval = time.Minute
+
+// httpRateLimiter limits requests with a token bucket per key
+type httpRateLimiter struct {
+	config    HTTPRateLimitConfig
+	burst     float64
+	rejected  *prometheus.CounterVec
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newHTTPRateLimiter(config HTTPRateLimitConfig, rejected *prometheus.CounterVec) *httpRateLimiter {
+	burst := config.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(config.Rate))
+	}
+	return &httpRateLimiter{
+		config:    config,
+		burst:     float64(burst),
+		rejected:  rejected,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// key returns the key of the bucket a request takes a token from
+func (hrl *httpRateLimiter) key(r *http.Request) string {
+	switch hrl.config.Key {
+	case RateLimitByHeader:
+		return r.Header.Get(hrl.config.Header)
+	case RateLimitByRoute:
+		_, r, state := httpRequestStateFor(nil, r)
+		return state.pathLabel(r)
+	default:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+}
+
+// take takes a token from the bucket of the key, returning how long until a
+// token is available if the bucket is empty
+func (hrl *httpRateLimiter) take(key string) (bool, time.Duration) {
+	hrl.mutex.Lock()
+	defer hrl.mutex.Unlock()
+	now := hrl.now()
+	if now.Sub(hrl.lastSweep) >= idleBucketSweepInterval {
+		// full buckets are the same as new buckets
+		for bucketKey, bucket := range hrl.buckets {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*hrl.config.Rate >= hrl.burst {
+				delete(hrl.buckets, bucketKey)
+			}
+		}
+		hrl.lastSweep = now
+	}
+	bucket, ok := hrl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: hrl.burst, last: now}
+		hrl.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(hrl.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*hrl.config.Rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / hrl.config.Rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (hrl *httpRateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r, state := httpRequestStateFor(w, r)
+		if state.isAdminRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, retryAfter := hrl.take(hrl.key(r)); !ok {
+			rejectHTTPRequest(w, r, hrl.rejected, rateLimitedReason, http.StatusTooManyRequests, retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimitMiddleware limits the rate of requests as configured, counting
+// rejected requests in the http_requests_rejected_total metric. Requests are
+// passed through if the rate is 0. Requests for the admin endpoints served
+// alongside application routes, e.g. health probes and metrics scrapes, are
+// never limited.
+func RateLimitMiddleware(config HTTPRateLimitConfig) HTTPMiddleware {
+	if config.Rate <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return newHTTPRateLimiter(config, makeHTTPRejectedCounter(prometheus.DefaultRegisterer)).middleware
+}
+
+// httpConcurrencyLimiter limits the number of requests handled at once
+type httpConcurrencyLimiter struct {
+	config   HTTPConcurrencyLimitConfig
+	inFlight chan struct{}
+	queued   chan struct{}
+	rejected *prometheus.CounterVec
+}
+
+func newHTTPConcurrencyLimiter(
+	config HTTPConcurrencyLimitConfig,
+	rejected *prometheus.CounterVec,
+) *httpConcurrencyLimiter {
+	return &httpConcurrencyLimiter{
+		config:   config,
+		inFlight: make(chan struct{}, config.MaxInFlight),
+		queued:   make(chan struct{}, config.MaxQueued),
+		rejected: rejected,
+	}
+}
+
+// retryAfter is the delay clients are asked to retry after when the server
+// is overloaded
+func (hcl *httpConcurrencyLimiter) retryAfter() time.Duration {
+	if hcl.config.QueueTimeout > time.Second {
+		return hcl.config.QueueTimeout
+	}
+	return time.Second
+}
+
+// acquire waits for a request to be handled, returning the reason it was
+// rejected otherwise
+func (hcl *httpConcurrencyLimiter) acquire(r *http.Request) (string, bool) {
+	select {
+	case hcl.inFlight <- struct{}{}:
+		return "", true
+	default:
+	}
+	select {
+	case hcl.queued <- struct{}{}:
+		defer func() { <-hcl.queued }()
+	default:
+		return loadShedReason, false
+	}
+	var timeout <-chan time.Time
+	if hcl.config.QueueTimeout > 0 {
+		timer := time.NewTimer(hcl.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case hcl.inFlight <- struct{}{}:
+		return "", true
+	case <-timeout:
+		return queueTimeoutReason, false
+	case <-r.Context().Done():
+		return queueCanceledReason, false
+	}
+}
+
+func (hcl *httpConcurrencyLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r, state := httpRequestStateFor(w, r)
+		if state.isAdminRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reason, ok := hcl.acquire(r)
+		if !ok {
+			rejectHTTPRequest(w, r, hcl.rejected, reason, http.StatusServiceUnavailable, hcl.retryAfter())
+			return
+		}
+		defer func() { <-hcl.inFlight }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ConcurrencyLimitMiddleware limits the number of requests handled at once
+// as configured, counting rejected requests in the
+// http_requests_rejected_total metric. Requests are passed through if
+// MaxInFlight is 0. Like RateLimitMiddleware, admin endpoints are never
+// limited.
+func ConcurrencyLimitMiddleware(config HTTPConcurrencyLimitConfig) HTTPMiddleware {
+	if config.MaxInFlight <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return newHTTPConcurrencyLimiter(config, makeHTTPRejectedCounter(prometheus.DefaultRegisterer)).middleware
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rejectedCounts returns the http_requests_rejected_total counts in a
+// registry by reason
+func rejectedCounts(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	counts := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "http_requests_rejected_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" {
+					counts[label.GetValue()] += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return counts
+}
+
+func TestHTTPRateLimitKey_Set(t *testing.T) {
+	var key HTTPRateLimitKey
+	require.NoError(t, key.Set("Header"))
+	assert.Equal(t, RateLimitByHeader, key)
+	assert.Equal(t, "header", key.String())
+	assert.Error(t, key.Set("flavortown"))
+}
+
+func TestHTTPRateLimiter(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	limiter := newHTTPRateLimiter(HTTPRateLimitConfig{Rate: 2, Burst: 2}, makeHTTPRejectedCounter(registry))
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	handler := limiter.middleware(http.HandlerFunc(healthHandler))
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// the burst is allowed, then requests are limited per client IP
+	assert.Equal(t, http.StatusOK, serve("10.0.0.1:1234").Code)
+	assert.Equal(t, http.StatusOK, serve("10.0.0.1:5678").Code)
+	recorder := serve("10.0.0.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	var response HTTPErrorResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, http.StatusText(http.StatusTooManyRequests), response.Error)
+	assert.Equal(t, http.StatusOK, serve("10.0.0.2:1234").Code)
+	assert.Equal(t, map[string]float64{rateLimitedReason: 1}, rejectedCounts(t, registry))
+
+	// tokens refill at the rate
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, serve("10.0.0.1:1234").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.1:1234").Code)
+
+	// refilled buckets are swept
+	now = now.Add(idleBucketSweepInterval)
+	serve("10.0.0.1:1234")
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestHTTPRateLimiter_Key(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", healthHandler)
+	req := httptest.NewRequest(http.MethodGet, "/users/123", nil)
+	req.Header.Set("X-API-Key", "flavortown")
+
+	tests := []struct {
+		config HTTPRateLimitConfig
+		key    string
+	}{
+		{HTTPRateLimitConfig{}, "192.0.2.1"},
+		{HTTPRateLimitConfig{Key: RateLimitByHeader, Header: "X-API-Key"}, "flavortown"},
+		{HTTPRateLimitConfig{Key: RateLimitByRoute}, "/users/"},
+	}
+	for _, test := range tests {
+		limiter := newHTTPRateLimiter(test.config, nil)
+		var key string
+		handler := newHTTPMiddlewareHandler(mux, nil, []HTTPMiddleware{
+			func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					key = limiter.key(r)
+				})
+			},
+		}, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, test.key, key, test.config.Key.String())
+	}
+}
+
+func TestHTTPConcurrencyLimiter(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	limiter := newHTTPConcurrencyLimiter(
+		HTTPConcurrencyLimitConfig{MaxInFlight: 1, MaxQueued: 1, QueueTimeout: 50 * time.Millisecond},
+		makeHTTPRejectedCounter(registry))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := limiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	serve := func(path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+	rejections := func(reason string) float64 {
+		return rejectedCounts(t, registry)[reason]
+	}
+
+	slow := make(chan int)
+	go func() { slow <- serve("/slow") }()
+	<-started
+
+	// queued requests time out while the slot is taken
+	assert.Equal(t, http.StatusServiceUnavailable, serve("/fast"))
+	assert.Equal(t, 1.0, rejections(queueTimeoutReason))
+
+	// requests over the queue are shed, and queued requests are handled once
+	// the slot is released
+	queued := make(chan int)
+	limiter.config.QueueTimeout = 0
+	go func() { queued <- serve("/fast") }()
+	for len(limiter.queued) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, 1.0, rejections(loadShedReason))
+	close(release)
+	assert.Equal(t, http.StatusOK, <-slow)
+	assert.Equal(t, http.StatusOK, <-queued)
+
+	// queued requests of clients that went away are rejected
+	release = make(chan struct{})
+	go func() { slow <- serve("/slow") }()
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fast", nil).WithContext(ctx))
+	assert.Equal(t, 1.0, rejections(queueCanceledReason))
+	close(release)
+	<-slow
+}
+
+func TestHTTPServerConfig_DefaultMiddleware_SharedLimits(t *testing.T) {
+	config := &HTTPServerConfig{
+		Name:             "test",
+		ConcurrencyLimit: HTTPConcurrencyLimitConfig{MaxInFlight: 1},
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := ChainHTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), config.DefaultMiddleware()...)
+	// e.g. route middleware built from the default middleware
+	fast := ChainHTTPMiddleware(http.HandlerFunc(healthHandler), config.DefaultMiddleware()...)
+
+	done := make(chan struct{})
+	go func() {
+		slow.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		close(done)
+	}()
+	<-started
+	recorder := httptest.NewRecorder()
+	fast.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	close(release)
+	<-done
+}
+
+func TestHTTPLimits_AdminEndpoints(t *testing.T) {
+	router := &templateRouter{routes: make(map[string]http.Handler)}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router.Handle("/slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	registry := prometheus.NewRegistry()
+	limits := []HTTPMiddleware{
+		newHTTPRateLimiter(HTTPRateLimitConfig{Rate: 1, Burst: 1}, makeHTTPRejectedCounter(registry)).middleware,
+		newHTTPConcurrencyLimiter(HTTPConcurrencyLimitConfig{MaxInFlight: 1}, makeHTTPRejectedCounter(registry)).middleware,
+	}
+	handler := newHTTPMiddlewareHandler(
+		&adminRouter{router, newAdminMux(&HealthCheckRegistry{}, nil)}, nil, limits, nil)
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		close(done)
+	}()
+	<-started
+	// probes and scrapes aren't limited while the server is saturated
+	for _, path := range []string{"/livez", "/livez", "/metrics"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code, path)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	close(release)
+	<-done
+}
@@ -0,0 +1,325 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// HTTPMiddleware wraps an http.Handler, e.g. to authenticate requests or to
+// compress responses
+type HTTPMiddleware func(next http.Handler) http.Handler
+
+// ChainHTTPMiddleware wraps the handler with the middleware. The first
+// middleware is outermost, i.e. the first to see each request.
+func ChainHTTPMiddleware(handler http.Handler, middleware ...HTTPMiddleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// httpRequestState is shared by the middleware handling a request
+type httpRequestState struct {
+	// recorder records the status of the response written inside the
+	// middleware that created the state
+	recorder *httpStatusRecorder
+	// router is the handler at the end of the middleware chain, if known
+	router         http.Handler
+	pathNormalizer HTTPPathNormalizer
+	// template is the route template set with SetHTTPRouteTemplate
+	template string
+}
+
+type httpRequestStateContextKey struct{}
+
+// newHTTPRequestState returns the writer and request that middleware should
+// pass on with a new request state
+func newHTTPRequestState(
+	w http.ResponseWriter,
+	r *http.Request,
+	router http.Handler,
+	pathNormalizer HTTPPathNormalizer,
+) (http.ResponseWriter, *http.Request, *httpRequestState) {
+	state := &httpRequestState{
+		// Default to http.StatusOK which is the golang default if the status is not set.
+		recorder:       &httpStatusRecorder{ResponseWriter: w, StatusCode: http.StatusOK},
+		router:         router,
+		pathNormalizer: pathNormalizer,
+	}
+	return state.recorder, r.WithContext(context.WithValue(r.Context(), httpRequestStateContextKey{}, state)), state
+}
+
+// httpRequestStateFor returns the state of a request with the writer and
+// request that middleware should pass on. Requests that don't have a state,
+// e.g. when middleware is used on its own, are given a new state.
+func httpRequestStateFor(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, *httpRequestState) {
+	if state, ok := r.Context().Value(httpRequestStateContextKey{}).(*httpRequestState); ok {
+		return w, r, state
+	}
+	return newHTTPRequestState(w, r, nil, nil)
+}
+
+// SetHTTPRouteTemplate records the template of the route matched by a
+// request, e.g. /users/{id}, to be used as the path label of HTTP metrics
+// and the name of the request's span. Routers should call this once they
+// have matched a request handled by BaseHTTPMonitoringHandler, unless they
+// report route templates as an HTTPRouter or are an http.ServeMux.
+func SetHTTPRouteTemplate(r *http.Request, template string) {
+	if state, ok := r.Context().Value(httpRequestStateContextKey{}).(*httpRequestState); ok {
+		state.template = template
+	}
+}
+
+// httpRouteTemplater is implemented by HTTPRouters
+type httpRouteTemplater interface {
+	RouteTemplate(r *http.Request) string
+}
+
+// httpPatternMatcher is implemented by routers like http.ServeMux that can
+// return the pattern matching a request
+type httpPatternMatcher interface {
+	Handler(r *http.Request) (h http.Handler, pattern string)
+}
+
+// httpAdminMatcher is implemented by routers that serve the admin endpoints
+// alongside application routes
+type httpAdminMatcher interface {
+	isAdminRequest(r *http.Request) bool
+}
+
+// isAdminRequest returns whether the request is for an admin endpoint, such
+// as a health probe or the metrics endpoint, served by the router
+func (hrs *httpRequestState) isAdminRequest(r *http.Request) bool {
+	matcher, ok := hrs.router.(httpAdminMatcher)
+	return ok && matcher.isAdminRequest(r)
+}
+
+// routeTemplate returns the route template set by the router, or reported
+// by the router if it is an HTTPRouter or a router like http.ServeMux, or an
+// empty string if the request didn't match a route
+func (hrs *httpRequestState) routeTemplate(r *http.Request) string {
+	if hrs.template != "" {
+		return hrs.template
+	}
+	if router, ok := hrs.router.(httpRouteTemplater); ok {
+		return router.RouteTemplate(r)
+	}
+	if matcher, ok := hrs.router.(httpPatternMatcher); ok {
+		_, pattern := matcher.Handler(r)
+		return pattern
+	}
+	return ""
+}
+
+// pathLabel returns the path label of a request: its route template, the
+// normalized path, or UnmatchedHTTPRoute otherwise
+func (hrs *httpRequestState) pathLabel(r *http.Request) string {
+	if template := hrs.routeTemplate(r); template != "" {
+		return template
+	}
+	if hrs.pathNormalizer != nil {
+		return hrs.pathNormalizer(r.URL.Path)
+	}
+	return UnmatchedHTTPRoute
+}
+
+// httpMiddlewareHandler serves requests to a router through the middleware
+// of the route they match
+type httpMiddlewareHandler struct {
+	router         http.Handler
+	pathNormalizer HTTPPathNormalizer
+	chain          http.Handler
+	routeChains    map[string]http.Handler
+}
+
+// newHTTPMiddlewareHandler returns a handler that serves requests to the
+// router through the middleware, or the route middleware of the route
+// template they match
+func newHTTPMiddlewareHandler(
+	router http.Handler,
+	pathNormalizer HTTPPathNormalizer,
+	middleware []HTTPMiddleware,
+	routeMiddleware map[string][]HTTPMiddleware,
+) *httpMiddlewareHandler {
+	handler := &httpMiddlewareHandler{
+		router:         router,
+		pathNormalizer: pathNormalizer,
+		chain:          ChainHTTPMiddleware(router, middleware...),
+		routeChains:    make(map[string]http.Handler, len(routeMiddleware)),
+	}
+	for template, middleware := range routeMiddleware {
+		handler.routeChains[template] = ChainHTTPMiddleware(router, middleware...)
+	}
+	return handler
+}
+
+func (hmh *httpMiddlewareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w, r, state := newHTTPRequestState(w, r, hmh.router, hmh.pathNormalizer)
+	chain := hmh.chain
+	if template := state.routeTemplate(r); template != "" {
+		if routeChain, ok := hmh.routeChains[template]; ok {
+			chain = routeChain
+		}
+	}
+	chain.ServeHTTP(w, r)
+}
+
+// defaultHTTPMiddleware returns the middleware of BaseHTTPMonitoringHandler
+// with any limits. Limits follow the metrics middleware so that rejected
+// requests are logged, traced, and counted.
+func defaultHTTPMiddleware(
+	handlerMetrics *httpMetrics,
+	limits []HTTPMiddleware,
+	newRelic HTTPMiddleware,
+	panicResponse HTTPPanicResponse,
+) []HTTPMiddleware {
+	middleware := []HTTPMiddleware{
+		TracingMiddleware,
+		RequestIDMiddleware,
+		LoggingMiddleware,
+		handlerMetrics.middleware,
+	}
+	middleware = append(middleware, limits...)
+	return append(middleware, newRelic, RecoveryMiddleware(panicResponse))
+}
+
+// TracingMiddleware starts an OpenTracing span for every request, continuing
+// the trace of the caller, and places it in the request context. The span is
+// named by the route template of the request and tagged with the response
+// status when the request completes. Spans of 5xx responses are marked as
+// errored.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r, state := httpRequestStateFor(w, r)
+		wireContext, err := opentracing.GlobalTracer().Extract(
+			opentracing.HTTPHeaders,
+			opentracing.HTTPHeadersCarrier(r.Header))
+		if err != nil {
+			Logger.Debug("Failed to extract opentracing context on an incoming HTTP request.")
+		}
+		span, spanCtx := opentracing.StartSpanFromContext(r.Context(), r.URL.Path, ext.RPCServerOption(wireContext))
+		span = span.SetTag("http.method", r.Method)
+		span = span.SetTag("http.hostname", r.URL.Hostname())
+		span = span.SetTag("http.port", r.URL.Port())
+		span = span.SetTag("http.remote_address", r.RemoteAddr)
+		defer func() {
+			// name the span by route template once the request has been routed
+			span.SetOperationName(state.pathLabel(r))
+			span.SetTag("http.status_code", strconv.Itoa(state.recorder.StatusCode))
+			// 5XX Errors are our fault -- note that this span belongs to an errored request
+			if state.recorder.StatusCode >= http.StatusInternalServerError {
+				span.SetTag("error", true)
+			}
+			span.Finish()
+		}()
+		next.ServeHTTP(w, r.WithContext(spanCtx))
+	})
+}
+
+// MetricsMiddleware records the count and duration of requests as Prometheus
+// metrics, labeled by route template rather than path. See
+// SetHTTPRouteTemplate.
+func MetricsMiddleware(serverName string) HTTPMiddleware {
+	return initHTTPMetrics(serverName, prometheus.DefaultRegisterer).middleware
+}
+
+func (hm *httpMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r, state := httpRequestStateFor(w, r)
+		metricsTimer := hm.recordHTTPMetrics(state, r)
+		defer metricsTimer.ObserveDuration()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (hm *httpMetrics) recordHTTPMetrics(state *httpRequestState, r *http.Request) *prometheus.Timer {
+	return prometheus.NewTimer(prometheus.ObserverFunc(func(durationSec float64) {
+		hsr := state.recorder
+		statusClass := ""
+		switch {
+		case hsr.StatusCode >= http.StatusInternalServerError:
+			statusClass = "5xx"
+		case hsr.StatusCode >= http.StatusBadRequest:
+			statusClass = "4xx"
+		case hsr.StatusCode >= http.StatusMultipleChoices:
+			statusClass = "3xx"
+		case hsr.StatusCode >= http.StatusOK:
+			statusClass = "2xx"
+		default:
+			statusClass = "1xx"
+		}
+		labels := prometheus.Labels{
+			"path":         state.pathLabel(r),
+			"method":       r.Method,
+			"status_class": statusClass,
+			"status_code":  strconv.Itoa(hsr.StatusCode),
+		}
+		hm.Counter.With(labels).Inc()
+		hm.Duration.With(labels).Observe(durationSec)
+	}))
+}
+
+// LoggingMiddleware places a logger in the request context that logs the
+// request ID, method, route, remote address, and trace and span IDs of the
+// request, and logs when requests are received and responded to. See
+// LoggerFromContext.
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r, state := httpRequestStateFor(w, r)
+		r = withRequestLogger(r, state.pathLabel(r))
+		defer statusCodeLogger(state.recorder, r)()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func statusCodeLogger(hsr *httpStatusRecorder, r *http.Request) func() {
+	// the request logger identifies the request, method, and remote address
+	logger := LoggerFromContext(r.Context())
+	hostname := zap.String("hostname", r.URL.Hostname())
+	port := zap.String("port", r.URL.Port())
+	logger.Info("Request Received", hostname, port)
+
+	logger.Debug("Request Headers", zap.Reflect("Headers", r.Header))
+
+	return func() {
+		logger.Info(
+			"Returning Response",
+			hostname, port, zap.Int("response_code", hsr.StatusCode))
+	}
+}
+
+// withRequestLogger returns the request with a child of its context logger
+// that identifies the request by its method, route, remote address, and the
+// trace and span IDs of its span. The route is the path label known before
+// the request is handled, so route templates set with SetHTTPRouteTemplate
+// aren't included.
+func withRequestLogger(r *http.Request, route string) *http.Request {
+	fields := []zap.Field{
+		zap.String("method", r.Method),
+		zap.String("route", route),
+		zap.String("remote_address", r.RemoteAddr),
+	}
+	fields = append(fields, spanLogFields(opentracing.SpanFromContext(r.Context()))...)
+	logger := LoggerFromContext(r.Context()).With(fields...)
+	return r.WithContext(ContextWithLogger(r.Context(), logger))
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// headerMiddleware appends its name to the X-Middleware response header
+func headerMiddleware(name string) HTTPMiddleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Middleware", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestChainHTTPMiddleware(t *testing.T) {
+	handler := ChainHTTPMiddleware(
+		http.HandlerFunc(healthHandler), headerMiddleware("first"), headerMiddleware("second"))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, []string{"first", "second"}, recorder.Header()["X-Middleware"])
+	assert.Equal(t, "OK", recorder.Body.String())
+}
+
+func TestHTTPMiddlewareHandler_RouteMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", healthHandler)
+	mux.HandleFunc("/admin/", healthHandler)
+	handler := newHTTPMiddlewareHandler(
+		mux, nil,
+		[]HTTPMiddleware{headerMiddleware("default")},
+		map[string][]HTTPMiddleware{"/admin/": {headerMiddleware("auth"), headerMiddleware("default")}})
+
+	tests := []struct {
+		path       string
+		middleware []string
+	}{
+		{"/users/123", []string{"default"}},
+		{"/admin/123", []string{"auth", "default"}},
+		{"/flavortown", []string{"default"}},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		assert.Equal(t, test.middleware, recorder.Header()["X-Middleware"], test.path)
+	}
+}
+
+func TestMetricsMiddleware_Standalone(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	// without a middleware handler, routers set the route template themselves
+	handler := ChainHTTPMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/users/123" {
+				SetHTTPRouteTemplate(r, "/users/{id}")
+			}
+		}),
+		initHTTPMetrics("test", registry).middleware)
+	serveHTTPRequests(handler,
+		http.MethodGet, "/users/123",
+		http.MethodGet, "/flavortown")
+
+	assert.Equal(t, map[string]float64{
+		"GET /users/{id}":           1,
+		"GET " + UnmatchedHTTPRoute: 1,
+	}, requestCounts(t, registry))
+}
+
+func TestHTTPMonitoringHandler_MiddlewareOrder(t *testing.T) {
+	tracer, restoreTracer := useMockTracer()
+	defer restoreTracer()
+	registry := prometheus.NewRegistry()
+	handler := newHTTPMonitoringHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("flavortown")
+	}), nil, initHTTPMetrics("test", registry), nil, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// recovery is innermost, so the outer middleware see the panic as a 500
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "500", spans[0].Tag("http.status_code"))
+	assert.NotEmpty(t, spans[0].Tag("request_id"))
+}
+
+func TestRunWebServer_Middleware(t *testing.T) {
+	config := &HTTPServerConfig{
+		Address:      "localhost",
+		Port:         freePort(t),
+		Name:         "test",
+		AdminAddress: "localhost",
+		AdminPort:    freePort(t),
+	}
+	config.Middleware = append([]HTTPMiddleware{headerMiddleware("cors")}, config.DefaultMiddleware()...)
+	config.RouteMiddleware = map[string][]HTTPMiddleware{"/internal/": {headerMiddleware("auth")}}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go config.RunWebServer(ctx, &wg, nil, nil, func(router HTTPRouter) {
+		router.Handle("/users/", http.HandlerFunc(healthHandler))
+		router.Handle("/internal/", http.HandlerFunc(healthHandler))
+	})
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	public := fmt.Sprintf("http://localhost:%d", config.Port)
+	resp := waitForHTTP(t, public+"/users/123")
+	assert.Equal(t, []string{"cors"}, resp.Header["X-Middleware"])
+	assert.NotEmpty(t, resp.Header.Get(RequestIDHeader))
+	resp = waitForHTTP(t, public+"/internal/123")
+	assert.Equal(t, []string{"auth"}, resp.Header["X-Middleware"])
+	assert.Empty(t, resp.Header.Get(RequestIDHeader))
+}
+
+func TestHTTPMonitoringHandler_ResponseWriterInterfaces(t *testing.T) {
+	application := &stubNewRelicApplication{}
+	handler := newHTTPMonitoringHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// streaming handlers can flush through all of the middleware
+		flusher, ok := w.(http.Flusher)
+		require.True(t, ok)
+		_, err := w.Write([]byte("flavor"))
+		require.NoError(t, err)
+		flusher.Flush()
+		// the recorder used in tests can't be hijacked or push
+		hijacker, ok := w.(http.Hijacker)
+		require.True(t, ok)
+		_, _, err = hijacker.Hijack()
+		assert.Error(t, err)
+		pusher, ok := w.(http.Pusher)
+		require.True(t, ok)
+		assert.Equal(t, http.ErrNotSupported, pusher.Push("/town", nil))
+	}), nil, initHTTPMetrics("test", prometheus.NewRegistry()), application, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, recorder.Flushed)
+	assert.Equal(t, "flavor", recorder.Body.String())
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+// HTTPErrorResponse is the JSON body of error responses
+type HTTPErrorResponse struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// HTTPPanicResponse returns the body of the response to a request whose
+// handler panicked, which is encoded as JSON
+type HTTPPanicResponse func(r *http.Request, recovered interface{}) interface{}
+
+// DefaultHTTPPanicResponse is an HTTPPanicResponse that responds with an
+// HTTPErrorResponse with the ID of the request, without details of the panic
+func DefaultHTTPPanicResponse(r *http.Request, _ interface{}) interface{} {
+	return HTTPErrorResponse{
+		Error:     http.StatusText(http.StatusInternalServerError),
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+}
+
+// RecoveryMiddleware recovers panics in the next handler. Panics are logged
+// with their stack trace, so that they are sent to Sentry if the Sentry
+// logger is enabled, and mark the OpenTracing span of the request as
+// errored. If the response hasn't been started, the request is responded to
+// with a 500 status and the JSON body returned by response, or
+// DefaultHTTPPanicResponse if response is nil. Middleware outside of this one
+// see the request as failed with a 500 status even if the response had been
+// started. BaseHTTPMonitoringHandler includes this middleware.
+func RecoveryMiddleware(response HTTPPanicResponse) HTTPMiddleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w, r, state := httpRequestStateFor(w, r)
+			if serveRecovering(next, w, r, response) {
+				// report the failure even if the response had been started
+				state.recorder.StatusCode = http.StatusInternalServerError
+			}
+		})
+	}
+}
+
+// serveRecovering serves the request with the next handler, recovering
+// panics as RecoveryMiddleware does, and returns whether the handler
+// panicked
+func serveRecovering(
+	next http.Handler,
+	w http.ResponseWriter,
+	r *http.Request,
+	response HTTPPanicResponse,
+) (panicked bool) {
+	recorder := &httpStatusRecorder{ResponseWriter: w, StatusCode: http.StatusOK}
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		if recovered == http.ErrAbortHandler {
+			// net/http aborts the response without logging this panic
+			panic(recovered)
+		}
+		panicked = true
+		LoggerFromContext(r.Context()).Error(
+			"Recovered from panic in HTTP handler",
+			zap.String("panic", fmt.Sprint(recovered)), zap.Stack("stack"))
+		if span := opentracing.SpanFromContext(r.Context()); span != nil {
+			ext.Error.Set(span, true)
+			span.LogKV("event", "panic", "message", fmt.Sprint(recovered))
+		}
+		if recorder.wroteHeader {
+			// the status has been sent, so the response can't be changed
+			return
+		}
+		if response == nil {
+			response = DefaultHTTPPanicResponse
+		}
+		body, err := json.Marshal(response(r, recovered))
+		if err != nil {
+			Logger.Error("Unable to encode HTTP panic response", zap.Error(err))
+			body = []byte(`{"error":"Internal Server Error"}`)
+		}
+		recorder.Header().Set("Content-Type", "application/json")
+		recorder.WriteHeader(http.StatusInternalServerError)
+		if _, err := recorder.Write(body); err != nil {
+			Logger.Debug("Unable to write HTTP panic response", zap.Error(err))
+		}
+	}()
+	next.ServeHTTP(recorder, r)
+	return false
+}
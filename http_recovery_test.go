@@ -0,0 +1,123 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func panicHandler(w http.ResponseWriter, r *http.Request) {
+	panic("flavortown")
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	logs, restore := observeLogs()
+	defer restore()
+	handler := RecoveryMiddleware(nil)(http.HandlerFunc(panicHandler))
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(ContextWithRequestID(req.Context(), "guy-fieri"))
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	body := HTTPErrorResponse{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, HTTPErrorResponse{Error: "Internal Server Error", RequestID: "guy-fieri"}, body)
+	entries := logs.FilterMessage("Recovered from panic in HTTP handler").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "flavortown", entries[0].ContextMap()["panic"])
+	assert.Contains(t, entries[0].ContextMap()["stack"], "panicHandler")
+}
+
+func TestRecoveryMiddleware_Response(t *testing.T) {
+	response := func(r *http.Request, recovered interface{}) interface{} {
+		return map[string]string{"message": fmt.Sprintf("%v at %s", recovered, r.URL.Path)}
+	}
+	handler := RecoveryMiddleware(response)(http.HandlerFunc(panicHandler))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/chefs", nil))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.JSONEq(t, `{"message": "flavortown at /chefs"}`, recorder.Body.String())
+
+	// started responses aren't changed
+	handler = RecoveryMiddleware(response)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("flavortown")
+	}))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/chefs", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "partial", recorder.Body.String())
+
+	// aborted handlers are aborted by net/http
+	handler = RecoveryMiddleware(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	assert.Panics(t, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestHTTPMonitoringHandler_Panic(t *testing.T) {
+	_, restoreLogger := observeLogs()
+	defer restoreLogger()
+	tracer, restoreTracer := useMockTracer()
+	defer restoreTracer()
+	registry := prometheus.NewRegistry()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", panicHandler)
+	mux.HandleFunc("/partial", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("flavortown")
+	})
+	handler := newHTTPMonitoringHandler(mux, nil, initHTTPMetrics("test", registry), nil, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/partial", nil))
+
+	// both requests are recorded as failed
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	codes := make(map[string]string)
+	for _, family := range families {
+		if family.GetName() != "http_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			codes[labels["path"]] = labels["status_code"]
+		}
+	}
+	assert.Equal(t, map[string]string{"/panic": "500", "/partial": "500"}, codes)
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 2)
+	for _, span := range spans {
+		assert.Equal(t, true, span.Tag("error"))
+		assert.Equal(t, "500", span.Tag("http.status_code"))
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader is the header that carries request IDs between services
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the length of incoming request IDs, which are
+// logged with every line of a request
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+// ContextWithRequestID returns a copy of the context holding the request ID
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID held by the context, or an
+// empty string if the context doesn't hold a request ID
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random version 4 UUID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		Logger.Error("Unable to generate request ID", zap.Error(err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validRequestID returns whether an incoming request ID is short and only
+// contains printable ASCII characters without spaces
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDMiddleware identifies every request with the request ID in its
+// X-Request-ID header, or a new ID if the header is missing or invalid. The
+// ID is echoed in the response header, held by the request context, added to
+// the logger from LoggerFromContext, and tagged on the OpenTracing span of
+// the request. BaseHTTPMonitoringHandler includes this middleware.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, withRequestID(w, r))
+	})
+}
+
+// withRequestID returns the request with its request ID in the context
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	if span := opentracing.SpanFromContext(r.Context()); span != nil {
+		span.SetTag("request_id", id)
+	}
+	ctx := ContextWithRequestID(r.Context(), id)
+	ctx = ContextWithLogger(ctx, LoggerFromContext(ctx).With(zap.String("request_id", id)))
+	return r.WithContext(ctx)
+}
+
+// PropagateRequestID sets the X-Request-ID header of an outbound request to
+// the request ID held by its context, if it isn't already set
+func PropagateRequestID(r *http.Request) {
+	if id := RequestIDFromContext(r.Context()); id != "" && r.Header.Get(RequestIDHeader) == "" {
+		r.Header.Set(RequestIDHeader, id)
+	}
+}
+
+// RequestIDTransport is an http.RoundTripper that propagates the request ID
+// held by the context of outbound requests, e.g.
+//
+//	client := &http.Client{Transport: &tools.RequestIDTransport{}}
+//	req = req.WithContext(r.Context())
+type RequestIDTransport struct {
+	// Base is the transport that sends requests. Defaults to
+	// http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+// RoundTrip sends the request with the X-Request-ID header set
+func (rit *RequestIDTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := rit.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if id := RequestIDFromContext(r.Context()); id != "" && r.Header.Get(RequestIDHeader) == "" {
+		// round trippers must not modify the request, so set the header on
+		// a copy
+		propagated := new(http.Request)
+		*propagated = *r
+		propagated.Header = make(http.Header, len(r.Header)+1)
+		for key, values := range r.Header {
+			propagated.Header[key] = values
+		}
+		propagated.Header.Set(RequestIDHeader, id)
+		r = propagated
+	}
+	return base.RoundTrip(r)
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// observeLogs replaces Logger with a logger that records logs until the
+// returned function is called
+func observeLogs() (*observer.ObservedLogs, func()) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	original := Logger
+	Logger = zap.New(core)
+	return logs, func() { Logger = original }
+}
+
+// useMockTracer replaces the global tracer with a mock tracer until the
+// returned function is called
+func useMockTracer() (*mocktracer.MockTracer, func()) {
+	tracer := mocktracer.New()
+	original := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	return tracer, func() { opentracing.SetGlobalTracer(original) }
+}
+
+func TestNewRequestID(t *testing.T) {
+	id := newRequestID()
+	assert.Len(t, id, 36)
+	assert.Equal(t, byte('4'), id[14])
+	assert.True(t, validRequestID(id))
+	assert.NotEqual(t, id, newRequestID())
+}
+
+func TestValidRequestID(t *testing.T) {
+	assert.True(t, validRequestID("flavortown-123"))
+	assert.False(t, validRequestID(""))
+	assert.False(t, validRequestID("flavor town"))
+	assert.False(t, validRequestID("flavortown\n"))
+	assert.False(t, validRequestID(strings.Repeat("a", maxRequestIDLength+1)))
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var id string
+	var logger *zap.Logger
+	handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = RequestIDFromContext(r.Context())
+		logger = LoggerFromContext(r.Context())
+	}))
+
+	// incoming IDs are kept
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "flavortown")
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, "flavortown", id)
+	assert.Equal(t, "flavortown", recorder.Header().Get(RequestIDHeader))
+	assert.True(t, logger != Logger)
+
+	// missing and invalid IDs are replaced
+	for _, incoming := range []string{"", "flavor town"} {
+		recorder = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, incoming)
+		handler.ServeHTTP(recorder, req)
+		assert.Len(t, id, 36)
+		assert.Equal(t, id, recorder.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestBaseHTTPMonitoringHandler_RequestID(t *testing.T) {
+	logs, restoreLogger := observeLogs()
+	defer restoreLogger()
+	tracer, restoreTracer := useMockTracer()
+	defer restoreTracer()
+	metrics := initHTTPMetrics("test", prometheus.NewRegistry())
+	handler := newHTTPMonitoringHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LoggerFromContext(r.Context()).Info("Flavortown")
+	}), nil, metrics, nil, nil)
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "flavortown")
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, "flavortown", recorder.Header().Get(RequestIDHeader))
+	for _, message := range []string{"Request Received", "Flavortown", "Returning Response"} {
+		entries := logs.FilterMessage(message).All()
+		require.Len(t, entries, 1, message)
+		assert.Equal(t, "flavortown", entries[0].ContextMap()["request_id"], message)
+	}
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "flavortown", spans[0].Tag("request_id"))
+}
+
+func TestRequestIDTransport(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(RequestIDHeader)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &RequestIDTransport{}}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req = req.WithContext(ContextWithRequestID(context.Background(), "flavortown"))
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "flavortown", received)
+	// the original request isn't modified
+	assert.Empty(t, req.Header.Get(RequestIDHeader))
+
+	req, err = http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, received)
+}
+
+func TestPropagateRequestID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	PropagateRequestID(req)
+	assert.Empty(t, req.Header.Get(RequestIDHeader))
+	req = req.WithContext(ContextWithRequestID(req.Context(), "flavortown"))
+	PropagateRequestID(req)
+	assert.Equal(t, "flavortown", req.Header.Get(RequestIDHeader))
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// HTTPRouter defines an interface for the routers used by RunWebServer. A
+// router serves requests with the handlers registered for their paths, and
+// reports the template of the route matching a request, e.g. /users/{id},
+// which labels metrics and names traces instead of the raw path.
+//
+// ServeMuxRouter adapts http.ServeMux. Other routers need a small adapter,
+// e.g. for gorilla/mux:
+//
+//	type gorillaRouter struct{ *mux.Router }
+//
+//	func (gr gorillaRouter) Handle(pattern string, handler http.Handler) {
+//		gr.Router.Handle(pattern, handler)
+//	}
+//
+//	func (gr gorillaRouter) RouteTemplate(r *http.Request) string {
+//		var match mux.RouteMatch
+//		if !gr.Match(r, &match) || match.Route == nil {
+//			return ""
+//		}
+//		template, _ := match.Route.GetPathTemplate()
+//		return template
+//	}
+//
+// Routers that only know the matched route while serving a request, like
+// chi, may return "" from RouteTemplate and call SetHTTPRouteTemplate from
+// a middleware instead.
+type HTTPRouter interface {
+	http.Handler
+	// Handle registers a handler for a path pattern in the router's syntax
+	Handle(pattern string, handler http.Handler)
+	// RouteTemplate returns the template of the route matching a request, or
+	// an empty string if no route matches
+	RouteTemplate(r *http.Request) string
+}
+
+// ServeMuxRouter is an HTTPRouter using an http.ServeMux, whose route
+// templates are the registered patterns
+type ServeMuxRouter struct {
+	*http.ServeMux
+}
+
+// NewServeMuxRouter creates an HTTPRouter with a new http.ServeMux
+func NewServeMuxRouter() *ServeMuxRouter {
+	return &ServeMuxRouter{http.NewServeMux()}
+}
+
+// RouteTemplate implements the HTTPRouter interface
+func (smr *ServeMuxRouter) RouteTemplate(r *http.Request) string {
+	_, pattern := smr.Handler(r)
+	return pattern
+}
+
+// newAdminMux creates a mux with the admin endpoints mounted on every
+// server: health checks and probes, Prometheus metrics, pprof, and any
+// endpoints registered by adminRoutes
+func newAdminMux(healthChecks *HealthCheckRegistry, adminRoutes func(*http.ServeMux)) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	healthChecks.registerHandlers(mux)
+	mux.Handle("/metrics", promhttp.Handler())
+	// Profiling endpoints for use with go tool pprof
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if adminRoutes != nil {
+		adminRoutes(mux)
+	}
+	return mux
+}
+
+// adminRouter serves the admin endpoints ahead of an application router
+// when there is no separate admin server, so that they are mounted
+// regardless of the router's pattern syntax
+type adminRouter struct {
+	HTTPRouter
+	admin *http.ServeMux
+}
+
+// ServeHTTP implements the http.Handler interface
+func (ar *adminRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, pattern := ar.admin.Handler(r); pattern != "" {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	ar.HTTPRouter.ServeHTTP(w, r)
+}
+
+// isAdminRequest returns whether the request is served by the admin
+// endpoints
+func (ar *adminRouter) isAdminRequest(r *http.Request) bool {
+	_, pattern := ar.admin.Handler(r)
+	return pattern != ""
+}
+
+// RouteTemplate implements the HTTPRouter interface
+func (ar *adminRouter) RouteTemplate(r *http.Request) string {
+	if _, pattern := ar.admin.Handler(r); pattern != "" {
+		return pattern
+	}
+	return ar.HTTPRouter.RouteTemplate(r)
+}
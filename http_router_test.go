@@ -0,0 +1,108 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// templateRouter is a minimal HTTPRouter with {param} path segments
+type templateRouter struct {
+	routes map[string]http.Handler
+}
+
+func (tr *templateRouter) Handle(pattern string, handler http.Handler) {
+	tr.routes[pattern] = handler
+}
+
+func (tr *templateRouter) RouteTemplate(r *http.Request) string {
+	segments := strings.Split(r.URL.Path, "/")
+	for template := range tr.routes {
+		templateSegments := strings.Split(template, "/")
+		if len(templateSegments) != len(segments) {
+			continue
+		}
+		matches := true
+		for i, segment := range templateSegments {
+			if segment != segments[i] && !strings.HasPrefix(segment, "{") {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return template
+		}
+	}
+	return ""
+}
+
+func (tr *templateRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := tr.routes[tr.RouteTemplate(r)]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func TestServeMuxRouter(t *testing.T) {
+	router := NewServeMuxRouter()
+	router.Handle("/users/", http.HandlerFunc(healthHandler))
+	assert.Equal(t, "/users/", router.RouteTemplate(httptest.NewRequest(http.MethodGet, "/users/123", nil)))
+	assert.Equal(t, "", router.RouteTemplate(httptest.NewRequest(http.MethodGet, "/flavortown", nil)))
+}
+
+func TestAdminRouter(t *testing.T) {
+	router := &templateRouter{routes: make(map[string]http.Handler)}
+	router.Handle("/users/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "user")
+	}))
+	registry := prometheus.NewRegistry()
+	handler := newHTTPMonitoringHandler(
+		&adminRouter{router, newAdminMux(&HealthCheckRegistry{}, nil)}, nil, initHTTPMetrics("test", registry),
+		nil, nil)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/health", http.StatusOK, "OK"},
+		{"/debug/pprof/cmdline", http.StatusOK, ""},
+		{"/users/123", http.StatusOK, "user"},
+		{"/users/456", http.StatusOK, "user"},
+		{"/flavortown", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		assert.Equal(t, test.status, recorder.Code, test.path)
+		if test.body != "" {
+			assert.Equal(t, test.body, recorder.Body.String(), test.path)
+		}
+	}
+	assert.Equal(t, map[string]float64{
+		"GET /health":               1,
+		"GET /debug/pprof/cmdline":  1,
+		"GET /users/{id}":           2,
+		"GET " + UnmatchedHTTPRoute: 1,
+	}, requestCounts(t, registry))
+}
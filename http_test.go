@@ -0,0 +1,311 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber/jaeger-client-go"
+)
+
+// requestCounts returns the http_requests_total counts in a registry by
+// path and method
+func requestCounts(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	counts := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "http_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			counts[labels["method"]+" "+labels["path"]] += metric.GetCounter().GetValue()
+		}
+	}
+	return counts
+}
+
+func serveHTTPRequests(handler http.Handler, requests ...string) {
+	for i := 0; i < len(requests); i += 2 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(requests[i], requests[i+1], nil))
+	}
+}
+
+func TestHTTPMonitoringHandler_ServeMux(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/users/", healthHandler)
+	handler := newHTTPMonitoringHandler(mux, nil, initHTTPMetrics("test", registry), nil, nil)
+	serveHTTPRequests(handler,
+		http.MethodGet, "/health",
+		http.MethodGet, "/users/123",
+		http.MethodGet, "/users/456",
+		http.MethodPost, "/users/456",
+		http.MethodGet, "/flavortown/1",
+		http.MethodGet, "/flavortown/2")
+	assert.Equal(t, map[string]float64{
+		"GET /health":   1,
+		"GET /users/":   2,
+		"POST /users/":  1,
+		"GET unmatched": 2,
+	}, requestCounts(t, registry))
+}
+
+func TestHTTPMonitoringHandler_RouteTemplate(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	// a router that isn't an http.ServeMux reports the matched template
+	router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			SetHTTPRouteTemplate(r, "/users/{id}")
+		}
+	})
+	handler := newHTTPMonitoringHandler(router, NormalizeHTTPPathIDs, initHTTPMetrics("test", registry), nil, nil)
+	serveHTTPRequests(handler,
+		http.MethodGet, "/users/123",
+		http.MethodGet, "/users/456",
+		http.MethodGet, "/")
+	assert.Equal(t, map[string]float64{
+		"GET /users/{id}": 2,
+		"GET /":           1,
+	}, requestCounts(t, registry))
+
+	// setting a template outside of the monitoring handler is a no-op
+	SetHTTPRouteTemplate(httptest.NewRequest(http.MethodGet, "/", nil), "/")
+}
+
+func TestHTTPMonitoringHandler_RequestLogger(t *testing.T) {
+	logs, restoreLogger := observeLogs()
+	defer restoreLogger()
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewNullReporter())
+	defer closer.Close()
+	original := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(original)
+
+	mux := http.NewServeMux()
+	var traceID, spanID string
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
+		spanContext := opentracing.SpanFromContext(r.Context()).Context().(jaeger.SpanContext)
+		traceID = spanContext.TraceID().String()
+		spanID = spanContext.SpanID().String()
+		LoggerFromContext(r.Context()).Info("Flavortown")
+	})
+	handler := newHTTPMonitoringHandler(mux, nil, initHTTPMetrics("test", prometheus.NewRegistry()), nil, nil)
+	req := httptest.NewRequest(http.MethodPost, "/users/123", nil)
+	req.Header.Set(RequestIDHeader, "flavortown")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := logs.FilterMessage("Flavortown").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, map[string]interface{}{
+		"request_id":     "flavortown",
+		"method":         http.MethodPost,
+		"route":          "/users/",
+		"remote_address": req.RemoteAddr,
+		"trace_id":       traceID,
+		"span_id":        spanID,
+	}, entries[0].ContextMap())
+}
+
+func TestNormalizeHTTPPathIDs(t *testing.T) {
+	tests := map[string]string{
+		"/users/123":          "/users/{id}",
+		"/users/123/orders/9": "/users/{id}/orders/{id}",
+		"/users/1b4e28ba-2fa1-11d2-883f-0016d3cca427": "/users/{id}",
+		"/objects/5c8f9a2e4b0d3a1f2e7c6b9d":           "/objects/{id}",
+		"/users/guy":                                  "/users/guy",
+		"/v2/health":                                  "/v2/health",
+	}
+	for path, expected := range tests {
+		assert.Equal(t, expected, NormalizeHTTPPathIDs(path), path)
+	}
+}
+
+// freePort returns a port that is free to listen on
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// waitForHTTP gets a URL, retrying until the server is listening
+func waitForHTTP(t *testing.T, url string) *http.Response {
+	var err error
+	for i := 0; i < 50; i++ {
+		var resp *http.Response
+		if resp, err = http.Get(url); err == nil {
+			resp.Body.Close()
+			return resp
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	return nil
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	assert.Equal(t, defaultHTTPReadTimeout, httpTimeout(0, defaultHTTPReadTimeout))
+	assert.Equal(t, time.Minute, httpTimeout(time.Minute, defaultHTTPReadTimeout))
+	assert.Equal(t, time.Duration(0), httpTimeout(-1, defaultHTTPReadTimeout))
+}
+
+func TestRunWebServer_AdminServer(t *testing.T) {
+	config := &HTTPServerConfig{
+		Address:      "localhost",
+		Port:         freePort(t),
+		Name:         "test",
+		AdminAddress: "localhost",
+		AdminPort:    freePort(t),
+		AdminRoutes: func(mux *http.ServeMux) {
+			mux.HandleFunc("/flavortown", healthHandler)
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go config.RunWebServer(ctx, &wg, nil, nil, func(router HTTPRouter) {
+		router.Handle("/users/", http.HandlerFunc(healthHandler))
+	})
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	public := fmt.Sprintf("http://localhost:%d", config.Port)
+	admin := fmt.Sprintf("http://localhost:%d", config.AdminPort)
+	assert.Equal(t, http.StatusOK, waitForHTTP(t, public+"/users/123").StatusCode)
+	for _, path := range []string{"/health", "/metrics", "/debug/pprof/", "/flavortown"} {
+		assert.Equal(t, http.StatusNotFound, waitForHTTP(t, public+path).StatusCode, path)
+		assert.Equal(t, http.StatusOK, waitForHTTP(t, admin+path).StatusCode, path)
+	}
+	assert.Equal(t, http.StatusNotFound, waitForHTTP(t, admin+"/users/123").StatusCode)
+}
+
+func TestRunWebServer_GracefulShutdown(t *testing.T) {
+	config := &HTTPServerConfig{
+		Address:          "localhost",
+		Port:             freePort(t),
+		Name:             "test",
+		AdminAddress:     "localhost",
+		AdminPort:        freePort(t),
+		PreShutdownDelay: 200 * time.Millisecond,
+		ShutdownTimeout:  time.Second,
+	}
+	var hooks []string
+	var hooksMutex sync.Mutex
+	ranHooks := func() []string {
+		hooksMutex.Lock()
+		defer hooksMutex.Unlock()
+		return append([]string{}, hooks...)
+	}
+	for _, name := range []string{"consumer", "producer"} {
+		name := name
+		config.AddShutdownHook(ShutdownHook{Name: name, Hook: func(context.Context) error {
+			hooksMutex.Lock()
+			defer hooksMutex.Unlock()
+			hooks = append(hooks, name)
+			return nil
+		}})
+	}
+	started := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go config.RunWebServer(ctx, &wg, nil, nil, func(router HTTPRouter) {
+		router.Handle("/fast", http.HandlerFunc(healthHandler))
+		router.Handle("/slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(300 * time.Millisecond)
+			fmt.Fprint(w, "done")
+		}))
+	})
+	public := fmt.Sprintf("http://localhost:%d", config.Port)
+	admin := fmt.Sprintf("http://localhost:%d", config.AdminPort)
+	assert.Equal(t, http.StatusOK, waitForHTTP(t, admin+"/readyz").StatusCode)
+
+	// an in-flight request completes during shutdown
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(public + "/slow")
+		if err != nil {
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	// readiness fails while the server keeps serving during the delay
+	assert.Equal(t, http.StatusServiceUnavailable, waitForHTTP(t, admin+"/readyz").StatusCode)
+	assert.Equal(t, http.StatusOK, waitForHTTP(t, public+"/fast").StatusCode)
+	assert.Empty(t, ranHooks())
+	wg.Wait()
+	assert.Equal(t, http.StatusOK, <-slow)
+	assert.Equal(t, []string{"consumer", "producer"}, ranHooks())
+}
+
+// closerFunc is an io.Closer that calls a function
+type closerFunc func() error
+
+func (cf closerFunc) Close() error {
+	return cf()
+}
+
+func TestRunWebServerAndTracer_ClosesTracerLast(t *testing.T) {
+	config := &HTTPServerConfig{
+		Address:      "localhost",
+		Port:         freePort(t),
+		Name:         "test",
+		AdminAddress: "localhost",
+		AdminPort:    freePort(t),
+	}
+	var closed []string
+	config.AddShutdownHook(ShutdownHook{Name: "consumer", Hook: func(context.Context) error {
+		closed = append(closed, "consumer")
+		return nil
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	config.runWebServerAndTracer(ctx, closerFunc(func() error {
+		closed = append(closed, "tracer")
+		return nil
+	}), nil, nil, func(router HTTPRouter) {
+		// hooks added while registering routes also run before the tracer closes
+		config.AddShutdownHook(ShutdownHook{Name: "producer", Hook: func(context.Context) error {
+			closed = append(closed, "producer")
+			return nil
+		}})
+	})
+	assert.Equal(t, []string{"consumer", "producer", "tracer"}, closed)
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tlsReloadInterval is how often certificate files are checked for changes
+const tlsReloadInterval = 10 * time.Second
+
+// certificateReloader serves a TLS certificate from a certificate and key
+// file, reloading it when either file changes so that renewed certificates
+// are picked up without a restart
+type certificateReloader struct {
+	crtPath string
+	keyPath string
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertificateReloader loads the certificate and key
+func newCertificateReloader(crtPath, keyPath string) (*certificateReloader, error) {
+	cr := &certificateReloader{crtPath: crtPath, keyPath: keyPath}
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// latestModTime returns the latest modification time of the files
+func (cr *certificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.crtPath, cr.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate if the files changed since it was last
+// loaded, and reports whether it was reloaded. On errors, the previous
+// certificate is kept.
+func (cr *certificateReloader) reload() (bool, error) {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	cr.mutex.RLock()
+	unchanged := cr.cert != nil && modTime.Equal(cr.modTime)
+	cr.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.crtPath, cr.keyPath)
+	if err != nil {
+		return false, err
+	}
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return true, nil
+}
+
+// watch reloads the certificate every interval until the context is done
+func (cr *certificateReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := cr.reload()
+			if err != nil {
+				Logger.Error(
+					"Unable to reload TLS certificate, keeping the current certificate",
+					zap.String("crt_path", cr.crtPath), zap.Error(err))
+			} else if reloaded {
+				Logger.Info("Reloaded TLS certificate", zap.String("crt_path", cr.crtPath))
+			}
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, for use in tls.Config
+func (cr *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.cert, nil
+}
+
+// tlsConfig returns the TLS config of the server, or nil if TLS is not
+// configured. Certificates are reloaded until the context is done.
+func (c *HTTPServerConfig) tlsConfig(ctx context.Context) (*tls.Config, error) {
+	if c.TLSCrtPath == "" && c.TLSKeyPath == "" {
+		return nil, nil
+	}
+	if c.TLSCrtPath == "" || c.TLSKeyPath == "" {
+		return nil, fmt.Errorf("TLS requires both a certificate and a key")
+	}
+	reloader, err := newCertificateReloader(c.TLSCrtPath, c.TLSKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.watch(ctx, tlsReloadInterval)
+	tlsConfig := &tls.Config{GetCertificate: reloader.GetCertificate}
+	if c.TLSClientCaCrtPath != "" {
+		// mutual TLS: only clients with a certificate signed by the CA are accepted
+		caCert, err := ioutil.ReadFile(c.TLSClientCaCrtPath)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLSClientCaCrtPath)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// writeTestCertificate writes a self-signed certificate for localhost and
+// its key to the directory, returning the paths and the certificate
+func writeTestCertificate(t *testing.T, dir, name string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	crtPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	require.NoError(t, ioutil.WriteFile(crtPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return crtPath, keyPath, cert
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	crtPath, keyPath, original := writeTestCertificate(t, dir, "server")
+	reloader, err := newCertificateReloader(crtPath, keyPath)
+	require.NoError(t, err)
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, original.Raw, cert.Certificate[0])
+
+	// unchanged files aren't reloaded
+	reloaded, err := reloader.reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// renewed certificates are picked up
+	_, _, renewed := writeTestCertificate(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(crtPath, later, later))
+	reloaded, err = reloader.reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	cert, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, renewed.Raw, cert.Certificate[0])
+
+	// invalid files keep the current certificate
+	require.NoError(t, ioutil.WriteFile(crtPath, []byte("Flavortown"), 0644))
+	evenLater := later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(crtPath, evenLater, evenLater))
+	_, err = reloader.reload()
+	assert.Error(t, err)
+	cert, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, renewed.Raw, cert.Certificate[0])
+
+	_, err = newCertificateReloader(filepath.Join(dir, "missing.crt"), keyPath)
+	assert.Error(t, err)
+}
+
+func TestHTTPServerConfig_TLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	crtPath, keyPath, _ := writeTestCertificate(t, dir, "server")
+	caPath, _, _ := writeTestCertificate(t, dir, "client-ca")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tlsConfig, err := (&HTTPServerConfig{}).tlsConfig(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	_, err = (&HTTPServerConfig{TLSCrtPath: crtPath}).tlsConfig(ctx)
+	assert.Error(t, err)
+
+	tlsConfig, err = (&HTTPServerConfig{TLSCrtPath: crtPath, TLSKeyPath: keyPath}).tlsConfig(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth)
+
+	tlsConfig, err = (&HTTPServerConfig{
+		TLSCrtPath: crtPath, TLSKeyPath: keyPath, TLSClientCaCrtPath: caPath,
+	}).tlsConfig(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	_, err = (&HTTPServerConfig{
+		TLSCrtPath: crtPath, TLSKeyPath: keyPath, TLSClientCaCrtPath: keyPath,
+	}).tlsConfig(ctx)
+	assert.Error(t, err)
+}
+
+// runTestWebServer runs a web server with the config on a free port until
+// the returned function is called
+func runTestWebServer(t *testing.T, config *HTTPServerConfig) func() {
+	config.Address = "localhost"
+	config.Port = freePort(t)
+	config.Name = "test"
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go config.RunWebServer(ctx, &wg, nil, nil, nil)
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func TestRunWebServer_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	crtPath, keyPath, cert := writeTestCertificate(t, dir, "server")
+	config := &HTTPServerConfig{TLSCrtPath: crtPath, TLSKeyPath: keyPath}
+	defer runTestWebServer(t, config)()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get(fmt.Sprintf("https://localhost:%d/health", config.Port)); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotNil(t, resp.TLS)
+}
+
+func TestRunWebServer_H2C(t *testing.T) {
+	config := &HTTPServerConfig{H2C: true}
+	defer runTestWebServer(t, config)()
+	url := fmt.Sprintf("http://localhost:%d/health", config.Port)
+	waitForHTTP(t, url)
+
+	// HTTP/2 with prior knowledge over a plain connection
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+}
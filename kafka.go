@@ -18,14 +18,19 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/Shopify/sarama"
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rcrowley/go-metrics"
 	"go.uber.org/zap"
@@ -36,21 +41,138 @@ type KafkaMessageUnmarshaler interface {
 	UnmarshalMessage(ctx context.Context, msg *sarama.ConsumerMessage, target interface{}) error
 }
 
-// KafkaMessageHandler defines an interface for handling new messages received by the Kafka consumer
+// KafkaMessageHandler defines an interface for handling new messages received by the Kafka consumer.
+// The context holds a logger that logs the topic, partition, and offset of the message. See LoggerFromContext.
 type KafkaMessageHandler interface {
 	HandleMessage(ctx context.Context, msg *sarama.ConsumerMessage, unmarshaler KafkaMessageUnmarshaler) error
 }
 
+// KafkaTombstoneHandler may optionally be implemented by a KafkaMessageHandler
+// to handle tombstones separately from other messages. Tombstones are
+// messages with a nil value that mark the deletion of their key on compacted
+// topics. Tombstones for handlers that don't implement this interface are
+// passed to HandleMessage, where unmarshaling them returns ErrTombstone. The
+// unmarshaler can be used to unmarshal the key of the tombstone with
+// UnmarshalKafkaKey.
+type KafkaTombstoneHandler interface {
+	HandleTombstone(ctx context.Context, msg *sarama.ConsumerMessage, unmarshaler KafkaMessageUnmarshaler) error
+}
+
+// ErrTombstone is returned when unmarshaling a tombstone, a message with a
+// nil value
+var ErrTombstone = errors.New("kafka message is a tombstone")
+
+// IsTombstone returns whether a Kafka message is a tombstone
+func IsTombstone(msg *sarama.ConsumerMessage) bool {
+	return msg.Value == nil
+}
+
+// KafkaMessageFormat defines the encoding of messages consumed from Kafka
+type KafkaMessageFormat int
+
+const (
+	// AvroMessageFormat means messages are Avro encoded using the Confluent
+	// Schema Registry wire format
+	AvroMessageFormat KafkaMessageFormat = iota
+	// JSONMessageFormat means messages are JSON objects
+	JSONMessageFormat
+	// ProtobufMessageFormat means messages are Protobuf encoded, optionally
+	// using the Confluent Schema Registry wire format
+	ProtobufMessageFormat
+	// AutoDetectMessageFormat means each message is inspected to determine
+	// whether it is Avro or JSON, for topics that carry both
+	AutoDetectMessageFormat
+	// ConnectJSONMessageFormat means messages are produced by Kafka Connect's
+	// JsonConverter, optionally wrapped in a schema and payload envelope
+	ConnectJSONMessageFormat
+	// DebeziumMessageFormat means messages are Debezium change events
+	// produced with Kafka Connect's JsonConverter
+	DebeziumMessageFormat
+)
+
+var kafkaMessageFormatNames = map[KafkaMessageFormat]string{
+	AvroMessageFormat:        "avro",
+	JSONMessageFormat:        "json",
+	ProtobufMessageFormat:    "protobuf",
+	AutoDetectMessageFormat:  "auto",
+	ConnectJSONMessageFormat: "connect-json",
+	DebeziumMessageFormat:    "debezium",
+}
+
+// String returns the name of the message format
+func (kmf KafkaMessageFormat) String() string {
+	if name, ok := kafkaMessageFormatNames[kmf]; ok {
+		return name
+	}
+	return fmt.Sprintf("KafkaMessageFormat(%d)", int(kmf))
+}
+
+// Set parses a message format name, implementing the pflag.Value interface
+func (kmf *KafkaMessageFormat) Set(name string) error {
+	for format, formatName := range kafkaMessageFormatNames {
+		if strings.EqualFold(name, formatName) {
+			*kmf = format
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown Kafka message format %s", name)
+}
+
+// Type returns the type name used in CLI help, implementing the pflag.Value interface
+func (kmf *KafkaMessageFormat) Type() string {
+	return "format"
+}
+
+// kafkaJSONEnabledFlag is the deprecated --enable-json flag, which sets the
+// message format to JSON when true and Avro when false
+type kafkaJSONEnabledFlag struct {
+	format *KafkaMessageFormat
+}
+
+// String returns whether JSON is enabled, implementing the pflag.Value interface
+func (kjef *kafkaJSONEnabledFlag) String() string {
+	return strconv.FormatBool(kjef.format != nil && *kjef.format == JSONMessageFormat)
+}
+
+// Set sets the message format from a boolean, implementing the pflag.Value interface
+func (kjef *kafkaJSONEnabledFlag) Set(value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*kjef.format = AvroMessageFormat
+	if enabled {
+		*kjef.format = JSONMessageFormat
+	}
+	return nil
+}
+
+// Type returns the type name used in CLI help, implementing the pflag.Value interface
+func (kjef *kafkaJSONEnabledFlag) Type() string {
+	return "bool"
+}
+
 // KafkaConfig contains connection settings and configuration for communicating with a Kafka cluster
 type KafkaConfig struct {
-	Broker       string
-	ClientID     string
-	TLSCaCrtPath string
-	TLSCrtPath   string
-	TLSKeyPath   string
-	Handlers     map[string]KafkaMessageHandler
-	JSONEnabled  bool
-	Verbose      bool
+	Broker        string
+	ClientID      string
+	TLSCaCrtPath  string
+	TLSCrtPath    string
+	TLSKeyPath    string
+	Handlers      map[string]KafkaMessageHandler
+	MessageFormat KafkaMessageFormat
+	// Deprecated: JSONEnabled consumes messages as JSON if MessageFormat is
+	// left as AvroMessageFormat. Set MessageFormat to JSONMessageFormat
+	// instead.
+	JSONEnabled bool
+	// KeyFormat is the format used to unmarshal message keys with
+	// UnmarshalKafkaKey. Defaults to raw bytes.
+	KeyFormat KafkaKeyFormat
+	// ProtobufMessages maps a topic to the Protobuf message type published on
+	// it. It is required to unmarshal Protobuf messages into kafka-tagged
+	// structs; generated Protobuf targets are decoded directly.
+	ProtobufMessages map[string]proto.Message
+	Verbose          bool
 	kafkaMetrics
 }
 
@@ -59,6 +181,30 @@ type kafkaClient struct {
 	kafkaConfig *KafkaConfig
 }
 
+// HealthCheck returns a critical readiness check that fails when the Kafka
+// client is closed or can't reach any broker. Brokers are only contacted if
+// the client has no open broker connections.
+func (kc *kafkaClient) HealthCheck() HealthCheck {
+	return HealthCheck{
+		Name:     "kafka",
+		Critical: true,
+		Check: func(_ context.Context) error {
+			if kc.client.Closed() {
+				return fmt.Errorf("kafka client is closed")
+			}
+			for _, broker := range kc.client.Brokers() {
+				if connected, _ := broker.Connected(); connected {
+					return nil
+				}
+			}
+			if err := kc.client.RefreshMetadata(); err != nil {
+				return fmt.Errorf("kafka client can't reach any broker: %s", err.Error())
+			}
+			return nil
+		},
+	}
+}
+
 // KafkaConsumer contains a sarama client, consumer, and implementation of the KafkaMessageUnmarshaler interface
 type KafkaConsumer struct {
 	kafkaClient
@@ -80,6 +226,7 @@ type kafkaMetrics struct {
 	brokerMetrics         map[string]*prometheus.GaugeVec
 	messagesProduced      *prometheus.GaugeVec
 	errorsProduced        *prometheus.GaugeVec
+	messagesByFormat      *prometheus.GaugeVec
 }
 
 // KafkaConsumerIface is an interface for consuming messages from a Kafka topic
@@ -143,6 +290,15 @@ func (kc *KafkaConfig) NewKafkaClient(ctx context.Context) (sarama.Client, error
 	return sarama.NewClient([]string{kc.Broker}, kafkaConfig)
 }
 
+// messageFormat returns the format of consumed messages, taking the
+// deprecated JSONEnabled into account
+func (kc *KafkaConfig) messageFormat() KafkaMessageFormat {
+	if kc.JSONEnabled && kc.MessageFormat == AvroMessageFormat {
+		return JSONMessageFormat
+	}
+	return kc.MessageFormat
+}
+
 // NewKafkaConsumer sets up a Kafka consumer
 func (kc *KafkaConfig) NewKafkaConsumer(
 	client sarama.Client,
@@ -163,14 +319,54 @@ func (kc *KafkaConfig) NewKafkaConsumer(
 		},
 		consumer: consumer,
 	}
+	// close the consumer and client if the consumer can't be set up
+	closeOnError := func(err error) (*KafkaConsumer, error) {
+		if closeErr := consumer.Close(); closeErr != nil {
+			Logger.Error("Error closing Kafka consumer", zap.Error(closeErr))
+		}
+		if closeErr := client.Close(); closeErr != nil {
+			Logger.Error("Error closing Kafka client", zap.Error(closeErr))
+		}
+		return nil, err
+	}
 	messageUnmarshaler := &kafkaMessageDecoder{}
-	if kc.JSONEnabled {
+	switch kc.messageFormat() {
+	case JSONMessageFormat:
 		kafkaConsumer.messageUnmarshaler = &jsonMessageUnmarshaler{messageUnmarshaler: messageUnmarshaler}
-	} else {
-		schemaRegistryConfig.client = &schemaRegistryClient{}
-		schemaRegistryConfig.messageUnmarshaler = messageUnmarshaler
+	case ProtobufMessageFormat:
+		kafkaConsumer.messageUnmarshaler = &protobufMessageUnmarshaler{
+			messageTypes:       kc.ProtobufMessages,
+			messageUnmarshaler: messageUnmarshaler,
+		}
+	case ConnectJSONMessageFormat:
+		kafkaConsumer.messageUnmarshaler = &connectJSONMessageUnmarshaler{messageUnmarshaler: messageUnmarshaler}
+	case DebeziumMessageFormat:
+		kafkaConsumer.messageUnmarshaler = &debeziumMessageUnmarshaler{messageUnmarshaler: messageUnmarshaler}
+	case AutoDetectMessageFormat:
+		if err := schemaRegistryConfig.initialize(messageUnmarshaler); err != nil {
+			return closeOnError(err)
+		}
+		kafkaConsumer.messageUnmarshaler = &autoDetectMessageUnmarshaler{
+			avroUnmarshaler:  schemaRegistryConfig,
+			jsonUnmarshaler:  &jsonMessageUnmarshaler{messageUnmarshaler: messageUnmarshaler},
+			avroSchemas:      schemaRegistryConfig,
+			messagesByFormat: kc.messagesByFormat,
+			clientID:         kc.ClientID,
+		}
+	default:
+		if err := schemaRegistryConfig.initialize(messageUnmarshaler); err != nil {
+			return closeOnError(err)
+		}
 		kafkaConsumer.messageUnmarshaler = schemaRegistryConfig
 	}
+	keyUnmarshaler, err := NewKafkaKeyUnmarshaler(kc.KeyFormat, schemaRegistryConfig)
+	if err != nil {
+		return closeOnError(err)
+	}
+	kafkaConsumer.messageUnmarshaler = &kafkaUnmarshaler{
+		KafkaMessageUnmarshaler: kafkaConsumer.messageUnmarshaler,
+		KafkaKeyUnmarshaler:     keyUnmarshaler,
+	}
 	return kafkaConsumer, nil
 }
 
@@ -295,7 +491,16 @@ func (kc *KafkaConfig) initKafkaMetrics(registry prometheus.Registerer) {
 		},
 		promLabels,
 	)
-	registry.MustRegister(kc.messageProcessingTime, kc.messagesProcessed, kc.messageErrors, kc.errorsProcessed)
+	kc.messagesByFormat = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kafka_messages_by_format",
+			Help: "Number of Kafka messages unmarshaled by detected message format",
+		},
+		[]string{"topic", "format", "client"},
+	)
+	registry.MustRegister(
+		kc.messageProcessingTime, kc.messagesProcessed, kc.messageErrors, kc.errorsProcessed,
+		kc.messagesByFormat)
 }
 
 // Close Sarama consumer and client
@@ -306,6 +511,21 @@ func (kc *KafkaConsumer) Close() {
 	}
 }
 
+// LifecycleComponent returns a component that calls consume to start
+// consuming topics, for use with a Lifecycle, e.g. by calling
+// ConsumeTopicFromLatest with the given context. The consumer is closed when
+// the component is stopped.
+func (kc *KafkaConsumer) LifecycleComponent(consume func(ctx context.Context) error) LifecycleComponent {
+	return LifecycleComponent{
+		Name:  "kafka-consumer",
+		Start: consume,
+		Stop: func(context.Context) error {
+			kc.Close()
+			return nil
+		},
+	}
+}
+
 // PartitionOffsets is a mapping of partition ID to an offset to which a consumer read on that partition
 type PartitionOffsets map[int32]int64
 
@@ -503,14 +723,14 @@ func (kc *KafkaConsumer) consumePartition(
 				continue
 			}
 			timer := prometheus.NewTimer(kc.kafkaConfig.messageProcessingTime.With(promLabels))
-			if err := handler.HandleMessage(ctx, msg, kc.messageUnmarshaler); err != nil {
+			if err := kc.handleMessage(ctx, handler, msg); err != nil {
 				Logger.Error(
 					"Error handling message",
 					zap.String("topic", topic),
 					zap.Int32("partition", partition),
 					zap.Int64("offset", msg.Offset),
 					zap.ByteString("key", msg.Key),
-					zap.String("message", string(msg.Value)),
+					messageLogField(msg.Value),
 					zap.Error(err))
 			}
 			timer.ObserveDuration()
@@ -540,6 +760,26 @@ func (kc *KafkaConsumer) consumePartition(
 	}
 }
 
+// handleMessage passes a message to the handler with a message logger in the
+// context, dispatching tombstones to HandleTombstone if the handler
+// implements KafkaTombstoneHandler
+func (kc *KafkaConsumer) handleMessage(ctx context.Context, handler KafkaMessageHandler, msg *sarama.ConsumerMessage) error {
+	ctx = ContextWithLogger(ctx, kafkaMessageLogger(ctx, msg))
+	if tombstoneHandler, ok := handler.(KafkaTombstoneHandler); ok && IsTombstone(msg) {
+		return tombstoneHandler.HandleTombstone(ctx, msg, kc.messageUnmarshaler)
+	}
+	return handler.HandleMessage(ctx, msg, kc.messageUnmarshaler)
+}
+
+// kafkaMessageLogger returns a child of the context logger that identifies a
+// message by its topic, partition, and offset
+func kafkaMessageLogger(ctx context.Context, msg *sarama.ConsumerMessage) *zap.Logger {
+	return LoggerFromContext(ctx).With(
+		zap.String("topic", msg.Topic),
+		zap.Int32("partition", msg.Partition),
+		zap.Int64("offset", msg.Offset))
+}
+
 // close Kafka producer and client
 func (kp *KafkaProducer) close() {
 	err := kp.producer.Close()
@@ -591,3 +831,43 @@ func (kp *KafkaProducer) RunProducer(
 		}
 	}
 }
+
+// LifecycleComponent returns a component that runs the producer with the
+// given messages channel, for use with a Lifecycle. The producer and its
+// client are closed when the component is stopped.
+func (kp *KafkaProducer) LifecycleComponent(messages <-chan *sarama.ProducerMessage) LifecycleComponent {
+	return LifecycleComponent{
+		Name: "kafka-producer",
+		Run: func(ctx context.Context) error {
+			kp.RunProducer(ctx, messages)
+			return nil
+		},
+	}
+}
+
+// messageLogField logs text messages as is and binary messages, such as
+// Avro, as base64 so that they can be copied into the decode command
+func messageLogField(message []byte) zap.Field {
+	if isPrintableMessage(message) {
+		return zap.String("message", string(message))
+	}
+	return zap.Binary("message", message)
+}
+
+// isPrintableMessage returns whether a message is text, as opposed to a
+// message in the Schema Registry wire format, which starts with a zero
+// magic byte, or other binary data that happens to be valid UTF-8
+func isPrintableMessage(message []byte) bool {
+	if len(message) > 0 && message[0] == 0 {
+		return false
+	}
+	if !utf8.Valid(message) {
+		return false
+	}
+	for _, r := range string(message) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
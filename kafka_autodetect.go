@@ -0,0 +1,110 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// autoDetectMessageUnmarshaler inspects every message and delegates to either
+// an Avro or a JSON unmarshaler. This allows a single consumer to read topics
+// that carry both formats, for example while producers migrate from JSON to
+// Avro.
+type autoDetectMessageUnmarshaler struct {
+	avroUnmarshaler KafkaMessageUnmarshaler
+	jsonUnmarshaler KafkaMessageUnmarshaler
+	// avroSchemas resolves the schema ids of messages detected as Avro, if
+	// set
+	avroSchemas      avroSchemaResolver
+	messagesByFormat *prometheus.GaugeVec
+	clientID         string
+}
+
+// avroSchemaResolver is implemented by SchemaRegistryConfig
+type avroSchemaResolver interface {
+	getCodec(ctx context.Context, schemaID uint32) (*avroCodec, error)
+}
+
+// detectMessageFormat determines the format of a Kafka message. Avro messages
+// use the Confluent Schema Registry wire format which starts with a zero
+// magic byte followed by a 4 byte schema id. JSON messages are objects and
+// start with a `{`, possibly after leading whitespace.
+func detectMessageFormat(message []byte) (KafkaMessageFormat, error) {
+	if len(message) >= 5 && message[0] == 0 {
+		return AvroMessageFormat, nil
+	}
+	if trimmed := bytes.TrimLeft(message, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		return JSONMessageFormat, nil
+	}
+	return 0, fmt.Errorf("unable to detect Kafka message format")
+}
+
+// detectMessageFormat determines the format of a Kafka message, checking
+// that the schema id of messages in the Avro wire format is registered.
+// Other binary messages, e.g. Protobuf, can also start with a zero byte.
+func (adu *autoDetectMessageUnmarshaler) detectMessageFormat(
+	ctx context.Context,
+	message []byte,
+) (KafkaMessageFormat, error) {
+	format, err := detectMessageFormat(message)
+	if err != nil || format != AvroMessageFormat || adu.avroSchemas == nil {
+		return format, err
+	}
+	schemaID, _, err := parseAvroWireFormat(message)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := adu.avroSchemas.getCodec(ctx, schemaID); err != nil {
+		if IsSchemaRegistryErrorCode(err, SchemaNotFoundErrorCode) {
+			return 0, fmt.Errorf(
+				"unable to detect Kafka message format: message starts with unknown Avro schema id %d", schemaID)
+		}
+		return 0, err
+	}
+	return AvroMessageFormat, nil
+}
+
+// UnmarshalMessage implements the KafkaMessageUnmarshaler interface by
+// detecting the format of the message and delegating to the matching
+// unmarshaler
+func (adu *autoDetectMessageUnmarshaler) UnmarshalMessage(
+	ctx context.Context,
+	msg *sarama.ConsumerMessage,
+	target interface{},
+) error {
+	if IsTombstone(msg) {
+		return ErrTombstone
+	}
+	format, err := adu.detectMessageFormat(ctx, msg.Value)
+	if err != nil {
+		return err
+	}
+	if adu.messagesByFormat != nil {
+		adu.messagesByFormat.With(prometheus.Labels{
+			"topic":  msg.Topic,
+			"format": format.String(),
+			"client": adu.clientID,
+		}).Add(1)
+	}
+	if format == AvroMessageFormat {
+		return adu.avroUnmarshaler.UnmarshalMessage(ctx, msg, target)
+	}
+	return adu.jsonUnmarshaler.UnmarshalMessage(ctx, msg, target)
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type mockKafkaMessageUnmarshaler struct {
+	mock.Mock
+}
+
+func (m *mockKafkaMessageUnmarshaler) UnmarshalMessage(
+	ctx context.Context,
+	msg *sarama.ConsumerMessage,
+	target interface{},
+) error {
+	args := m.Called(msg, target)
+	return args.Error(0)
+}
+
+func TestDetectMessageFormat(t *testing.T) {
+	format, err := detectMessageFormat([]byte{0, 0, 0, 0, 77, 2})
+	require.NoError(t, err)
+	assert.Equal(t, AvroMessageFormat, format)
+
+	format, err = detectMessageFormat([]byte(" {\"where_to_go\": \"flavortown\"}"))
+	require.NoError(t, err)
+	assert.Equal(t, JSONMessageFormat, format)
+
+	_, err = detectMessageFormat([]byte{0, 0})
+	assert.Error(t, err)
+
+	_, err = detectMessageFormat(nil)
+	assert.Error(t, err)
+}
+
+func TestAutoDetectUnmarshalMessage(t *testing.T) {
+	avroUnmarshaler := &mockKafkaMessageUnmarshaler{}
+	jsonUnmarshaler := &mockKafkaMessageUnmarshaler{}
+	messagesByFormat := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "test_messages_by_format"},
+		[]string{"topic", "format", "client"},
+	)
+	adu := &autoDetectMessageUnmarshaler{
+		avroUnmarshaler:  avroUnmarshaler,
+		jsonUnmarshaler:  jsonUnmarshaler,
+		messagesByFormat: messagesByFormat,
+		clientID:         "test",
+	}
+	avroMessage := &sarama.ConsumerMessage{Topic: "flavortown", Value: []byte{0, 0, 0, 0, 77, 2}}
+	jsonMessage := &sarama.ConsumerMessage{Topic: "flavortown", Value: []byte("{}")}
+	avroUnmarshaler.On("UnmarshalMessage", avroMessage, nil).Return(nil)
+	jsonUnmarshaler.On("UnmarshalMessage", jsonMessage, nil).Return(nil)
+
+	assert.NoError(t, adu.UnmarshalMessage(context.Background(), avroMessage, nil))
+	assert.NoError(t, adu.UnmarshalMessage(context.Background(), jsonMessage, nil))
+	assert.NoError(t, adu.UnmarshalMessage(context.Background(), jsonMessage, nil))
+	assert.Error(t, adu.UnmarshalMessage(context.Background(), &sarama.ConsumerMessage{Value: []byte("?")}, nil))
+	avroUnmarshaler.AssertNumberOfCalls(t, "UnmarshalMessage", 1)
+	jsonUnmarshaler.AssertNumberOfCalls(t, "UnmarshalMessage", 2)
+
+	metric := &dto.Metric{}
+	gauge := messagesByFormat.With(prometheus.Labels{"topic": "flavortown", "format": "json", "client": "test"})
+	require.NoError(t, gauge.Write(metric))
+	assert.Equal(t, 2.0, metric.GetGauge().GetValue())
+}
+
+func TestAutoDetectUnmarshalMessage_UnknownSchemaID(t *testing.T) {
+	schemaRegistry, mockClient, schema, avroMessage, _ := setupMockSchemaRegistry(t)
+	mockClient.On("getSchema", 77, mock.Anything).Return(schema, nil)
+	mockClient.On("getSchema", 1, mock.Anything).Return("", &SchemaRegistryError{ErrorCode: SchemaNotFoundErrorCode})
+	avroUnmarshaler := &mockKafkaMessageUnmarshaler{}
+	adu := &autoDetectMessageUnmarshaler{
+		avroUnmarshaler: avroUnmarshaler,
+		jsonUnmarshaler: &mockKafkaMessageUnmarshaler{},
+		avroSchemas:     schemaRegistry,
+	}
+	msg := &sarama.ConsumerMessage{Value: avroMessage}
+	avroUnmarshaler.On("UnmarshalMessage", msg, nil).Return(nil)
+	assert.NoError(t, adu.UnmarshalMessage(context.Background(), msg, nil))
+
+	// binary messages that start with a zero byte aren't Avro unless their
+	// schema id is registered
+	assert.Error(t, adu.UnmarshalMessage(
+		context.Background(), &sarama.ConsumerMessage{Value: []byte{0, 0, 0, 0, 1, 8, 150, 1}}, nil))
+	avroUnmarshaler.AssertNumberOfCalls(t, "UnmarshalMessage", 1)
+}
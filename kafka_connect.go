@@ -0,0 +1,423 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+// connectSchema is a Kafka Connect schema as embedded in messages by the
+// JsonConverter when schemas are enabled
+type connectSchema struct {
+	Type       string            `json:"type"`
+	Optional   bool              `json:"optional"`
+	Name       string            `json:"name"`
+	Field      string            `json:"field"`
+	Fields     []connectSchema   `json:"fields"`
+	Items      *connectSchema    `json:"items"`
+	Keys       *connectSchema    `json:"keys"`
+	Values     *connectSchema    `json:"values"`
+	Parameters map[string]string `json:"parameters"`
+}
+
+// decodeConnectJSON decodes a message produced by Kafka Connect's
+// JsonConverter. If the message is a {"schema": ..., "payload": ...} envelope,
+// the payload is returned with the schema applied to it, otherwise the whole
+// message is treated as a schemaless payload.
+func decodeConnectJSON(message []byte) (interface{}, error) {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return nil, err
+	}
+	rawSchema, hasSchema := envelope["schema"]
+	rawPayload, hasPayload := envelope["payload"]
+	if !hasSchema || !hasPayload || len(envelope) != 2 {
+		rawPayload = message
+		rawSchema = nil
+	}
+	var schema *connectSchema
+	if len(rawSchema) > 0 {
+		if err := json.Unmarshal(rawSchema, &schema); err != nil {
+			return nil, err
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(rawPayload))
+	decoder.UseNumber()
+	var payload interface{}
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return applyConnectSchema(schema, payload)
+}
+
+// applyConnectSchema converts a JSON value into the Go types used by the Avro
+// decoder according to its Kafka Connect schema, so that the result can be
+// handled by the shared kafkaMessageUnmarshaler. Logical types are
+// interpreted as follows:
+// * Connect and Debezium timestamps are converted to int64 milliseconds
+// * Connect and Debezium dates are converted to int64 milliseconds at midnight UTC
+// * Connect decimals are converted to float64
+// Structs are returned as kafkaRecords and maps as kafkaMaps, since the
+// JsonConverter never wraps nullable values. Values without a schema are
+// returned as plain JSON with numbers as float64.
+func applyConnectSchema(schema *connectSchema, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if schema == nil {
+		return plainJSONValue(value), nil
+	}
+	switch schema.Name {
+	case "org.apache.kafka.connect.data.Timestamp", "io.debezium.time.Timestamp":
+		return jsonInt64(value)
+	case "io.debezium.time.MicroTimestamp":
+		micros, err := jsonInt64(value)
+		return micros / 1000, err
+	case "io.debezium.time.NanoTimestamp":
+		nanos, err := jsonInt64(value)
+		return nanos / 1000000, err
+	case "org.apache.kafka.connect.data.Date", "io.debezium.time.Date":
+		days, err := jsonInt64(value)
+		return days * int64(24*time.Hour/time.Millisecond), err
+	case "org.apache.kafka.connect.data.Decimal":
+		return connectDecimal(schema, value)
+	}
+	switch schema.Type {
+	case "int8", "int16", "int32":
+		i, err := jsonInt64(value)
+		return int32(i), err
+	case "int64":
+		return jsonInt64(value)
+	case "float32":
+		f, err := jsonFloat64(value)
+		return float32(f), err
+	case "float64":
+		return jsonFloat64(value)
+	case "bytes":
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected base64 string for bytes field %s", schema.Field)
+		}
+		return base64.StdEncoding.DecodeString(s)
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected array for field %s", schema.Field)
+		}
+		for i, item := range items {
+			converted, err := applyConnectSchema(schema.Items, item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = converted
+		}
+		return items, nil
+	case "map":
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected object for map field %s", schema.Field)
+		}
+		converted := make(kafkaMap, len(values))
+		for key, item := range values {
+			convertedItem, err := applyConnectSchema(schema.Values, item)
+			if err != nil {
+				return nil, err
+			}
+			converted[key] = convertedItem
+		}
+		return converted, nil
+	case "struct":
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected object for struct field %s", schema.Field)
+		}
+		for i := range schema.Fields {
+			fieldSchema := &schema.Fields[i]
+			converted, err := applyConnectSchema(fieldSchema, values[fieldSchema.Field])
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := values[fieldSchema.Field]; ok {
+				values[fieldSchema.Field] = converted
+			}
+		}
+		return kafkaRecord(values), nil
+	default:
+		return plainJSONValue(value), nil
+	}
+}
+
+// connectDecimal converts a Connect decimal, which is the base64 encoded
+// big-endian two's complement unscaled value, to a float64
+func connectDecimal(schema *connectSchema, value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected base64 string for decimal field %s", schema.Field)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	unscaled := new(big.Int).SetBytes(decoded)
+	if len(decoded) > 0 && decoded[0]&0x80 != 0 {
+		// negative number in two's complement
+		unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(len(decoded)*8)))
+	}
+	scale, err := strconv.Atoi(schema.Parameters["scale"])
+	if err != nil {
+		scale = 0
+	}
+	divisor := new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil))
+	result, _ := new(big.Float).Quo(new(big.Float).SetInt(unscaled), divisor).Float64()
+	return result, nil
+}
+
+// plainJSONValue converts json.Number values to float64 so that schemaless
+// values match the output of json.Unmarshal
+func plainJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i, item := range v {
+			v[i] = plainJSONValue(item)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = plainJSONValue(item)
+		}
+	}
+	return value
+}
+
+// connectRecord returns the fields of a Connect struct or of a schemaless
+// JSON object
+func connectRecord(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case kafkaRecord:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	}
+	return nil, false
+}
+
+func jsonInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := v.Float64()
+		return int64(f), err
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("expected integer, got %T", value)
+}
+
+func jsonFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("expected number, got %T", value)
+}
+
+type connectJSONMessageUnmarshaler struct {
+	messageUnmarshaler kafkaMessageUnmarshaler
+}
+
+// UnmarshalMessage implements the KafkaMessageUnmarshaler interface and
+// decodes Kafka messages produced by Kafka Connect's JsonConverter, unwrapping
+// the payload from the schema envelope if schemas are enabled
+func (cju *connectJSONMessageUnmarshaler) UnmarshalMessage(
+	ctx context.Context,
+	msg *sarama.ConsumerMessage,
+	target interface{},
+) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "unmarshal-kafka-connect-json")
+	defer span.Finish()
+	if IsTombstone(msg) {
+		return ErrTombstone
+	}
+	payload, err := decodeConnectJSON(msg.Value)
+	if err != nil {
+		return err
+	}
+	payloadMap, ok := connectRecord(payload)
+	if !ok {
+		return fmt.Errorf("kafka connect payload is not an object")
+	}
+	unmarshalErrs := cju.messageUnmarshaler.unmarshalKafkaMessageMap(payloadMap, target)
+	if len(unmarshalErrs) > 0 {
+		Logger.Error(
+			"Unable to unmarshal from Kafka Connect JSON", zap.Errors("errors", unmarshalErrs),
+			zap.String("type", reflect.TypeOf(target).String()))
+		return fmt.Errorf("unable to unmarshal from Kafka Connect JSON")
+	}
+	return nil
+}
+
+// DebeziumOperation is the type of change captured by a Debezium event
+type DebeziumOperation string
+
+const (
+	// DebeziumCreate means a row was inserted
+	DebeziumCreate DebeziumOperation = "c"
+	// DebeziumUpdate means a row was updated
+	DebeziumUpdate DebeziumOperation = "u"
+	// DebeziumDelete means a row was deleted
+	DebeziumDelete DebeziumOperation = "d"
+	// DebeziumRead means a row was read during a snapshot
+	DebeziumRead DebeziumOperation = "r"
+)
+
+// DebeziumSource is the source metadata of a Debezium change event
+type DebeziumSource struct {
+	Version   string
+	Connector string
+	Name      string
+	Database  string
+	Schema    string
+	Table     string
+	Snapshot  string
+	// LSN is the log sequence number of the change, if the source database has one
+	LSN       int64
+	Timestamp time.Time
+	// Fields contains all source fields, including connector specific ones
+	Fields map[string]interface{}
+}
+
+// DebeziumEvent is a Debezium change data capture event. When unmarshaling
+// into a DebeziumEvent, set Before and After to pointers to `kafka`-tagged
+// structs to have the before and after images of the row unmarshaled into
+// them. Either image is left untouched if it is not present on the event.
+type DebeziumEvent struct {
+	Operation DebeziumOperation
+	Before    interface{}
+	After     interface{}
+	Source    DebeziumSource
+	Timestamp time.Time
+}
+
+type debeziumMessageUnmarshaler struct {
+	messageUnmarshaler kafkaMessageUnmarshaler
+}
+
+// UnmarshalMessage implements the KafkaMessageUnmarshaler interface and
+// decodes Debezium change events produced with the JsonConverter. If the
+// target is a *DebeziumEvent, the change metadata and both row images are
+// unmarshaled. Otherwise the after image of the row, or the before image for
+// deletes, is unmarshaled into the target.
+func (dmu *debeziumMessageUnmarshaler) UnmarshalMessage(
+	ctx context.Context,
+	msg *sarama.ConsumerMessage,
+	target interface{},
+) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "unmarshal-kafka-debezium")
+	defer span.Finish()
+	if IsTombstone(msg) {
+		return ErrTombstone
+	}
+	payload, err := decodeConnectJSON(msg.Value)
+	if err != nil {
+		return err
+	}
+	payloadMap, ok := connectRecord(payload)
+	if !ok {
+		return fmt.Errorf("debezium payload is not an object")
+	}
+	operation, _ := payloadMap["op"].(string)
+	before, _ := connectRecord(payloadMap["before"])
+	after, _ := connectRecord(payloadMap["after"])
+
+	var unmarshalErrs []error
+	if event, ok := target.(*DebeziumEvent); ok {
+		event.Operation = DebeziumOperation(operation)
+		event.Source = newDebeziumSource(payloadMap["source"])
+		if ts, err := jsonInt64(payloadMap["ts_ms"]); err == nil {
+			event.Timestamp = time.Unix(0, ts*int64(time.Millisecond))
+		}
+		if event.Before != nil && before != nil {
+			unmarshalErrs = append(unmarshalErrs, dmu.messageUnmarshaler.unmarshalKafkaMessageMap(before, event.Before)...)
+		}
+		if event.After != nil && after != nil {
+			unmarshalErrs = append(unmarshalErrs, dmu.messageUnmarshaler.unmarshalKafkaMessageMap(after, event.After)...)
+		}
+	} else {
+		image := after
+		if DebeziumOperation(operation) == DebeziumDelete {
+			image = before
+		}
+		if image == nil {
+			return fmt.Errorf("debezium event has no row image to unmarshal")
+		}
+		unmarshalErrs = dmu.messageUnmarshaler.unmarshalKafkaMessageMap(image, target)
+	}
+	if len(unmarshalErrs) > 0 {
+		Logger.Error(
+			"Unable to unmarshal from Debezium", zap.Errors("errors", unmarshalErrs),
+			zap.String("type", reflect.TypeOf(target).String()))
+		return fmt.Errorf("unable to unmarshal from Debezium")
+	}
+	return nil
+}
+
+func newDebeziumSource(value interface{}) DebeziumSource {
+	var fields map[string]interface{}
+	if record, ok := connectRecord(value); ok {
+		fields = plainKafkaMap(record)
+	}
+	source := DebeziumSource{Fields: fields}
+	source.Version, _ = fields["version"].(string)
+	source.Connector, _ = fields["connector"].(string)
+	source.Name, _ = fields["name"].(string)
+	source.Database, _ = fields["db"].(string)
+	source.Schema, _ = fields["schema"].(string)
+	source.Table, _ = fields["table"].(string)
+	switch snapshot := fields["snapshot"].(type) {
+	case string:
+		source.Snapshot = snapshot
+	case bool:
+		source.Snapshot = strconv.FormatBool(snapshot)
+	}
+	if lsn, err := jsonInt64(fields["lsn"]); err == nil {
+		source.LSN = lsn
+	}
+	if ts, err := jsonInt64(fields["ts_ms"]); err == nil {
+		source.Timestamp = time.Unix(0, ts*int64(time.Millisecond))
+	}
+	return source
+}
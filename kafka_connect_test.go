@@ -0,0 +1,183 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const connectEnvelopeMessage = `{
+	"schema": {
+		"type": "struct",
+		"fields": [
+			{"field": "id", "type": "int64"},
+			{"field": "name", "type": "string", "optional": true},
+			{"field": "created", "type": "int64", "name": "org.apache.kafka.connect.data.Timestamp"},
+			{"field": "birthday", "type": "int32", "name": "org.apache.kafka.connect.data.Date"},
+			{"field": "price", "type": "bytes", "name": "org.apache.kafka.connect.data.Decimal", "parameters": {"scale": "2"}}
+		]
+	},
+	"payload": {"id": 9007199254740993, "name": "Guy Fieri", "created": 1522083600000, "birthday": 1, "price": "BNI="}
+}`
+
+type connectTarget struct {
+	ID       int64     `kafka:"id"`
+	Name     string    `kafka:"name"`
+	Created  time.Time `kafka:"created"`
+	Birthday time.Time `kafka:"birthday"`
+	Price    float64   `kafka:"price"`
+}
+
+func TestDecodeConnectJSON(t *testing.T) {
+	payload, err := decodeConnectJSON([]byte(connectEnvelopeMessage))
+	require.NoError(t, err)
+	payloadMap := payload.(kafkaRecord)
+	assert.Equal(t, int64(9007199254740993), payloadMap["id"])
+	assert.Equal(t, int64(1522083600000), payloadMap["created"])
+	assert.Equal(t, int64(86400000), payloadMap["birthday"])
+	assert.Equal(t, 12.34, payloadMap["price"])
+}
+
+func TestDecodeConnectJSON_Schemaless(t *testing.T) {
+	payload, err := decodeConnectJSON([]byte(`{"id": 1, "name": "Guy Fieri"}`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"id": float64(1), "name": "Guy Fieri"}, payload)
+}
+
+func TestConnectJSONUnmarshalMessage(t *testing.T) {
+	cju := &connectJSONMessageUnmarshaler{messageUnmarshaler: &kafkaMessageDecoder{}}
+	target := &connectTarget{}
+	err := cju.UnmarshalMessage(
+		context.Background(), &sarama.ConsumerMessage{Value: []byte(connectEnvelopeMessage)}, target)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9007199254740993), target.ID)
+	assert.Equal(t, "Guy Fieri", target.Name)
+	assert.Equal(t, time.Unix(1522083600, 0), target.Created)
+	assert.Equal(t, time.Unix(86400, 0), target.Birthday)
+	assert.Equal(t, 12.34, target.Price)
+}
+
+func TestConnectJSONUnmarshalMessage_NestedValues(t *testing.T) {
+	type address struct {
+		City  string `kafka:"city"`
+		State string `kafka:"state"`
+	}
+	type nestedTarget struct {
+		Address address           `kafka:"address"`
+		Menu    map[string]string `kafka:"menu"`
+	}
+	message := `{
+		"schema": {
+			"type": "struct",
+			"fields": [
+				{"field": "address", "type": "struct", "fields": [
+					{"field": "city", "type": "string"},
+					{"field": "state", "type": "string"}
+				]},
+				{"field": "menu", "type": "map", "keys": {"type": "string"}, "values": {"type": "string"}}
+			]
+		},
+		"payload": {
+			"address": {"city": "Flavortown", "state": "CA"},
+			"menu": {"string": "Trash Can Nachos"}
+		}
+	}`
+	cju := &connectJSONMessageUnmarshaler{messageUnmarshaler: &kafkaMessageDecoder{}}
+	target := &nestedTarget{}
+	err := cju.UnmarshalMessage(context.Background(), &sarama.ConsumerMessage{Value: []byte(message)}, target)
+	require.NoError(t, err)
+	assert.Equal(t, &nestedTarget{
+		Address: address{City: "Flavortown", State: "CA"},
+		// map keys that look like nullable wrappers aren't unwrapped
+		Menu: map[string]string{"string": "Trash Can Nachos"},
+	}, target)
+}
+
+const debeziumMessage = `{
+	"schema": {
+		"type": "struct",
+		"fields": [
+			{"field": "before", "type": "struct", "optional": true, "fields": [
+				{"field": "id", "type": "int32"},
+				{"field": "name", "type": "string"},
+				{"field": "updated", "type": "int64", "name": "io.debezium.time.MicroTimestamp"}
+			]},
+			{"field": "after", "type": "struct", "optional": true, "fields": [
+				{"field": "id", "type": "int32"},
+				{"field": "name", "type": "string"},
+				{"field": "updated", "type": "int64", "name": "io.debezium.time.MicroTimestamp"}
+			]},
+			{"field": "source", "type": "struct", "fields": [
+				{"field": "connector", "type": "string"},
+				{"field": "db", "type": "string"},
+				{"field": "table", "type": "string"},
+				{"field": "lsn", "type": "int64", "optional": true},
+				{"field": "ts_ms", "type": "int64"}
+			]},
+			{"field": "op", "type": "string"},
+			{"field": "ts_ms", "type": "int64", "optional": true}
+		]
+	},
+	"payload": {
+		"before": {"id": 1, "name": "Guy", "updated": 1522083600000000},
+		"after": {"id": 1, "name": "Guy Fieri", "updated": 1522083660000000},
+		"source": {"connector": "postgresql", "db": "flavortown", "table": "chefs", "lsn": 24023128, "ts_ms": 1522083660000},
+		"op": "u",
+		"ts_ms": 1522083661000
+	}
+}`
+
+type debeziumTarget struct {
+	ID      int       `kafka:"id"`
+	Name    string    `kafka:"name"`
+	Updated time.Time `kafka:"updated"`
+}
+
+func TestDebeziumUnmarshalMessage_Event(t *testing.T) {
+	dmu := &debeziumMessageUnmarshaler{messageUnmarshaler: &kafkaMessageDecoder{}}
+	event := &DebeziumEvent{Before: &debeziumTarget{}, After: &debeziumTarget{}}
+	err := dmu.UnmarshalMessage(context.Background(), &sarama.ConsumerMessage{Value: []byte(debeziumMessage)}, event)
+	require.NoError(t, err)
+	assert.Equal(t, DebeziumUpdate, event.Operation)
+	assert.Equal(t, &debeziumTarget{ID: 1, Name: "Guy", Updated: time.Unix(1522083600, 0)}, event.Before)
+	assert.Equal(t, &debeziumTarget{ID: 1, Name: "Guy Fieri", Updated: time.Unix(1522083660, 0)}, event.After)
+	assert.Equal(t, "postgresql", event.Source.Connector)
+	assert.Equal(t, "flavortown", event.Source.Database)
+	assert.Equal(t, "chefs", event.Source.Table)
+	assert.Equal(t, int64(24023128), event.Source.LSN)
+	assert.Equal(t, time.Unix(1522083660, 0), event.Source.Timestamp)
+	assert.Equal(t, time.Unix(1522083661, 0), event.Timestamp)
+}
+
+func TestDebeziumUnmarshalMessage_Struct(t *testing.T) {
+	dmu := &debeziumMessageUnmarshaler{messageUnmarshaler: &kafkaMessageDecoder{}}
+	target := &debeziumTarget{}
+	err := dmu.UnmarshalMessage(context.Background(), &sarama.ConsumerMessage{Value: []byte(debeziumMessage)}, target)
+	require.NoError(t, err)
+	assert.Equal(t, "Guy Fieri", target.Name)
+
+	// Deletes only have a before image
+	deleteMessage := []byte(`{"before": {"id": 2, "name": "Guy"}, "after": null, "op": "d"}`)
+	target = &debeziumTarget{}
+	err = dmu.UnmarshalMessage(context.Background(), &sarama.ConsumerMessage{Value: deleteMessage}, target)
+	require.NoError(t, err)
+	assert.Equal(t, 2, target.ID)
+}
@@ -38,6 +38,9 @@ func (jmu *jsonMessageUnmarshaler) UnmarshalMessage(
 ) error {
 	span, _ := opentracing.StartSpanFromContext(ctx, "unmarshal-kafka-json")
 	defer span.Finish()
+	if IsTombstone(msg) {
+		return ErrTombstone
+	}
 	message := make(map[string]interface{})
 	if err := json.Unmarshal(msg.Value, &message); err != nil {
 		return err
@@ -66,3 +66,11 @@ func TestUnmarshalJsonMessage_ErrorUnmarshaling(t *testing.T) {
 	err := jmu.UnmarshalMessage(context.Background(), kafkaMessage, mju)
 	assert.NotNil(t, err)
 }
+
+func TestUnmarshalJsonMessage_Tombstone(t *testing.T) {
+	mju := &mockJSONUnmarshaler{}
+	jmu := jsonMessageUnmarshaler{messageUnmarshaler: mju}
+	err := jmu.UnmarshalMessage(context.Background(), &sarama.ConsumerMessage{Key: []byte("guy")}, nil)
+	assert.Equal(t, ErrTombstone, err)
+	mju.AssertNotCalled(t, "unmarshalKafkaMessageMap", mock.Anything)
+}
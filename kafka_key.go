@@ -0,0 +1,243 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/opentracing/opentracing-go"
+)
+
+// KafkaKeyUnmarshaler defines an interface for unmarshaling the keys of
+// messages received from Kafka to Go types
+type KafkaKeyUnmarshaler interface {
+	UnmarshalKey(ctx context.Context, msg *sarama.ConsumerMessage, target interface{}) error
+}
+
+// ErrNoKey is returned when unmarshaling the key of a message without a key
+var ErrNoKey = errors.New("kafka message has no key")
+
+// KafkaKeyFormat defines the encoding of the keys of messages consumed from Kafka
+type KafkaKeyFormat int
+
+const (
+	// RawKeyFormat means keys are copied into a []byte as is
+	RawKeyFormat KafkaKeyFormat = iota
+	// StringKeyFormat means keys are UTF-8 strings
+	StringKeyFormat
+	// JSONKeyFormat means keys are JSON values
+	JSONKeyFormat
+	// AvroKeyFormat means keys are Avro encoded using the Confluent Schema
+	// Registry wire format, usually registered under the <topic>-key subject
+	AvroKeyFormat
+)
+
+var kafkaKeyFormatNames = map[KafkaKeyFormat]string{
+	RawKeyFormat:    "raw",
+	StringKeyFormat: "string",
+	JSONKeyFormat:   "json",
+	AvroKeyFormat:   "avro",
+}
+
+// String returns the name of the key format
+func (kkf KafkaKeyFormat) String() string {
+	if name, ok := kafkaKeyFormatNames[kkf]; ok {
+		return name
+	}
+	return fmt.Sprintf("KafkaKeyFormat(%d)", int(kkf))
+}
+
+// Set parses a key format name, implementing the pflag.Value interface
+func (kkf *KafkaKeyFormat) Set(name string) error {
+	for format, formatName := range kafkaKeyFormatNames {
+		if strings.EqualFold(name, formatName) {
+			*kkf = format
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown Kafka key format %s", name)
+}
+
+// Type returns the type name used in CLI help, implementing the pflag.Value interface
+func (kkf *KafkaKeyFormat) Type() string {
+	return "format"
+}
+
+// NewKafkaKeyUnmarshaler creates an unmarshaler for keys in the given
+// format. Avro keys are decoded with the Schema Registry config, which is
+// only required for the Avro format.
+func NewKafkaKeyUnmarshaler(
+	format KafkaKeyFormat,
+	schemaRegistryConfig *SchemaRegistryConfig,
+) (KafkaKeyUnmarshaler, error) {
+	messageUnmarshaler := &kafkaMessageDecoder{}
+	switch format {
+	case RawKeyFormat:
+		return rawKeyUnmarshaler{}, nil
+	case StringKeyFormat:
+		return stringKeyUnmarshaler{}, nil
+	case JSONKeyFormat:
+		return &jsonKeyUnmarshaler{messageUnmarshaler: messageUnmarshaler}, nil
+	case AvroKeyFormat:
+		if schemaRegistryConfig == nil {
+			return nil, fmt.Errorf("a Schema Registry config is required to unmarshal Avro keys")
+		}
+		if err := schemaRegistryConfig.initialize(messageUnmarshaler); err != nil {
+			return nil, err
+		}
+		return schemaRegistryConfig, nil
+	default:
+		return nil, fmt.Errorf("unknown Kafka key format %s", format)
+	}
+}
+
+// UnmarshalKafkaKey unmarshals the key of a message using the unmarshaler
+// passed to a KafkaMessageHandler by a KafkaConsumer. The key is decoded in
+// the KeyFormat of the consumer's KafkaConfig.
+func UnmarshalKafkaKey(
+	ctx context.Context,
+	unmarshaler KafkaMessageUnmarshaler,
+	msg *sarama.ConsumerMessage,
+	target interface{},
+) error {
+	keyUnmarshaler, ok := unmarshaler.(KafkaKeyUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%T cannot unmarshal Kafka keys", unmarshaler)
+	}
+	return keyUnmarshaler.UnmarshalKey(ctx, msg, target)
+}
+
+// kafkaUnmarshaler combines the value and key unmarshalers of a consumer so
+// that handlers can unmarshal both
+type kafkaUnmarshaler struct {
+	KafkaMessageUnmarshaler
+	KafkaKeyUnmarshaler
+}
+
+// rawKeyUnmarshaler copies keys into a *[]byte
+type rawKeyUnmarshaler struct{}
+
+// UnmarshalKey implements the KafkaKeyUnmarshaler interface
+func (rawKeyUnmarshaler) UnmarshalKey(_ context.Context, msg *sarama.ConsumerMessage, target interface{}) error {
+	keyTarget, ok := target.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw Kafka keys can only be unmarshaled into *[]byte, not %T", target)
+	}
+	if msg.Key == nil {
+		*keyTarget = nil
+		return nil
+	}
+	*keyTarget = append([]byte{}, msg.Key...)
+	return nil
+}
+
+// stringKeyUnmarshaler unmarshals keys into a *string
+type stringKeyUnmarshaler struct{}
+
+// UnmarshalKey implements the KafkaKeyUnmarshaler interface
+func (stringKeyUnmarshaler) UnmarshalKey(_ context.Context, msg *sarama.ConsumerMessage, target interface{}) error {
+	if msg.Key == nil {
+		return ErrNoKey
+	}
+	return setKafkaKey(nil, string(msg.Key), target)
+}
+
+// jsonKeyUnmarshaler unmarshals JSON keys. Object keys are unmarshaled into
+// structs using `kafka` tags like JSON values; all other keys are
+// unmarshaled with encoding/json.
+type jsonKeyUnmarshaler struct {
+	messageUnmarshaler kafkaMessageUnmarshaler
+}
+
+// UnmarshalKey implements the KafkaKeyUnmarshaler interface
+func (jku *jsonKeyUnmarshaler) UnmarshalKey(ctx context.Context, msg *sarama.ConsumerMessage, target interface{}) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "unmarshal-kafka-json-key")
+	defer span.Finish()
+	if msg.Key == nil {
+		return ErrNoKey
+	}
+	if trimmed := bytes.TrimLeft(msg.Key, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		if targetType := reflect.TypeOf(target); targetType != nil &&
+			targetType.Kind() == reflect.Ptr && targetType.Elem().Kind() == reflect.Struct {
+			key := make(map[string]interface{})
+			if err := json.Unmarshal(msg.Key, &key); err != nil {
+				return err
+			}
+			return setKafkaKey(jku.messageUnmarshaler, key, target)
+		}
+	}
+	return json.Unmarshal(msg.Key, target)
+}
+
+// setKafkaKey sets a decoded key on the target. Record keys are unmarshaled
+// into structs with the message unmarshaler, and primitive keys are
+// converted to the type the target points to.
+func setKafkaKey(messageUnmarshaler kafkaMessageUnmarshaler, key interface{}, target interface{}) error {
+	targetValue := reflect.ValueOf(target)
+	if targetValue.Kind() != reflect.Ptr || targetValue.IsNil() {
+		return fmt.Errorf("kafka keys must be unmarshaled into a non-nil pointer, not %T", target)
+	}
+	if record, ok := key.(kafkaRecord); ok {
+		key = map[string]interface{}(record)
+	}
+	if keyMap, ok := key.(map[string]interface{}); ok {
+		if targetValue.Elem().Kind() == reflect.Struct {
+			if errs := messageUnmarshaler.unmarshalKafkaMessageMap(keyMap, target); len(errs) > 0 {
+				return fmt.Errorf("unable to unmarshal Kafka key: %v", errs)
+			}
+			return nil
+		}
+		if len(keyMap) == 1 {
+			// a primitive key in an Avro union
+			for _, nested := range keyMap {
+				key = nested
+			}
+		}
+	}
+	elem := targetValue.Elem()
+	if key == nil {
+		elem.Set(reflect.Zero(elem.Type()))
+		return nil
+	}
+	keyValue := reflect.ValueOf(key)
+	switch {
+	case keyValue.Type().AssignableTo(elem.Type()):
+		elem.Set(keyValue)
+	case isNumericKind(keyValue.Kind()) && isNumericKind(elem.Kind()):
+		elem.Set(keyValue.Convert(elem.Type()))
+	case keyValue.Kind() == reflect.String && keyValue.Type().ConvertibleTo(elem.Type()):
+		elem.Set(keyValue.Convert(elem.Type()))
+	default:
+		return fmt.Errorf("cannot unmarshal Kafka key of type %T into %T", key, target)
+	}
+	return nil
+}
+
+func isNumericKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/linkedin/goavro"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type testKey struct {
+	ID   int    `kafka:"id"`
+	Kind string `kafka:"kind"`
+}
+
+func TestUnmarshalKey_Raw(t *testing.T) {
+	unmarshaler, err := NewKafkaKeyUnmarshaler(RawKeyFormat, nil)
+	require.NoError(t, err)
+	msg := &sarama.ConsumerMessage{Key: []byte{1, 2, 3}}
+	var key []byte
+	require.NoError(t, unmarshaler.UnmarshalKey(context.Background(), msg, &key))
+	assert.Equal(t, []byte{1, 2, 3}, key)
+	// the key is copied so that it can be retained after the message
+	msg.Key[0] = 0
+	assert.Equal(t, []byte{1, 2, 3}, key)
+
+	var wrongType string
+	assert.Error(t, unmarshaler.UnmarshalKey(context.Background(), msg, &wrongType))
+}
+
+func TestUnmarshalKey_String(t *testing.T) {
+	unmarshaler, err := NewKafkaKeyUnmarshaler(StringKeyFormat, nil)
+	require.NoError(t, err)
+	var key string
+	require.NoError(t, unmarshaler.UnmarshalKey(context.Background(), &sarama.ConsumerMessage{Key: []byte("guy")}, &key))
+	assert.Equal(t, "guy", key)
+	assert.Equal(t, ErrNoKey, unmarshaler.UnmarshalKey(context.Background(), &sarama.ConsumerMessage{}, &key))
+}
+
+func TestUnmarshalKey_JSON(t *testing.T) {
+	unmarshaler, err := NewKafkaKeyUnmarshaler(JSONKeyFormat, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	structKey := &testKey{}
+	msg := &sarama.ConsumerMessage{Key: []byte(`{"id": 7, "kind": "chef"}`)}
+	require.NoError(t, unmarshaler.UnmarshalKey(ctx, msg, structKey))
+	assert.Equal(t, &testKey{ID: 7, Kind: "chef"}, structKey)
+
+	var intKey int64
+	require.NoError(t, unmarshaler.UnmarshalKey(ctx, &sarama.ConsumerMessage{Key: []byte("42")}, &intKey))
+	assert.Equal(t, int64(42), intKey)
+
+	assert.Error(t, unmarshaler.UnmarshalKey(ctx, &sarama.ConsumerMessage{Key: []byte("{")}, structKey))
+}
+
+func TestUnmarshalKey_Avro(t *testing.T) {
+	recordSchema := `{"type": "record", "name": "key", "fields": [
+		{"name": "id", "type": "int"}, {"name": "kind", "type": "string"}]}`
+	recordCodec, err := goavro.NewCodec(recordSchema)
+	require.NoError(t, err)
+	recordKey, err := recordCodec.BinaryFromNative(
+		[]byte{0, 0, 0, 0, 1}, map[string]interface{}{"id": int32(7), "kind": "chef"})
+	require.NoError(t, err)
+	longCodec, err := goavro.NewCodec(`"long"`)
+	require.NoError(t, err)
+	longKey, err := longCodec.BinaryFromNative([]byte{0, 0, 0, 0, 2}, int64(42))
+	require.NoError(t, err)
+
+	mockClient := &SchemaRegistryClientMock{}
+	mockClient.On("getSchema", 1, mock.Anything).Return(recordSchema, nil)
+	mockClient.On("getSchema", 2, mock.Anything).Return(`"long"`, nil)
+	config := &SchemaRegistryConfig{client: mockClient}
+	unmarshaler, err := NewKafkaKeyUnmarshaler(AvroKeyFormat, config)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	structKey := &testKey{}
+	require.NoError(t, unmarshaler.UnmarshalKey(ctx, &sarama.ConsumerMessage{Key: recordKey}, structKey))
+	assert.Equal(t, &testKey{ID: 7, Kind: "chef"}, structKey)
+
+	var intKey int
+	require.NoError(t, unmarshaler.UnmarshalKey(ctx, &sarama.ConsumerMessage{Key: longKey}, &intKey))
+	assert.Equal(t, 42, intKey)
+
+	// keys share the codec cache with values
+	_, codecInCache := config.codecs.Load(uint32(2))
+	assert.True(t, codecInCache)
+	require.NoError(t, unmarshaler.UnmarshalKey(ctx, &sarama.ConsumerMessage{Key: longKey}, &intKey))
+	mockClient.AssertNumberOfCalls(t, "getSchema", 2)
+
+	assert.Equal(t, ErrNoKey, unmarshaler.UnmarshalKey(ctx, &sarama.ConsumerMessage{}, &intKey))
+	assert.Equal(t, ErrNotAvroWireFormat, unmarshaler.UnmarshalKey(ctx, &sarama.ConsumerMessage{Key: []byte("guy")}, &intKey))
+	var stringKey string
+	assert.Error(t, unmarshaler.UnmarshalKey(ctx, &sarama.ConsumerMessage{Key: longKey}, &stringKey))
+
+	_, err = NewKafkaKeyUnmarshaler(AvroKeyFormat, nil)
+	assert.Error(t, err)
+}
+
+func TestUnmarshalKafkaKey(t *testing.T) {
+	keyUnmarshaler, err := NewKafkaKeyUnmarshaler(StringKeyFormat, nil)
+	require.NoError(t, err)
+	unmarshaler := &kafkaUnmarshaler{KafkaMessageUnmarshaler: &jsonMessageUnmarshaler{}, KafkaKeyUnmarshaler: keyUnmarshaler}
+	var key string
+	require.NoError(t, UnmarshalKafkaKey(context.Background(), unmarshaler, &sarama.ConsumerMessage{Key: []byte("guy")}, &key))
+	assert.Equal(t, "guy", key)
+
+	assert.Error(t, UnmarshalKafkaKey(context.Background(), &jsonMessageUnmarshaler{}, &sarama.ConsumerMessage{}, &key))
+}
+
+func TestKafkaKeyFormat(t *testing.T) {
+	var format KafkaKeyFormat
+	assert.Equal(t, RawKeyFormat, format)
+	require.NoError(t, format.Set("Avro"))
+	assert.Equal(t, AvroKeyFormat, format)
+	assert.Equal(t, "avro", format.String())
+	assert.Error(t, format.Set("xml"))
+}
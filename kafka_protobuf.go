@@ -0,0 +1,252 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+type protobufMessageUnmarshaler struct {
+	messageTypes       map[string]proto.Message
+	messageUnmarshaler kafkaMessageUnmarshaler
+}
+
+// protobufWireFormat is the Confluent Schema Registry framing of a Protobuf message
+type protobufWireFormat struct {
+	schemaID uint32
+	payload  []byte
+}
+
+// parseProtobufWireFormat strips the Confluent Schema Registry framing from
+// a Protobuf message if it is present. Framed messages begin with a zero
+// magic byte, followed by the schema id (4 bytes, big endian), followed by
+// the zig-zag varint encoded count of message indexes and the indexes
+// themselves, which locate the message type within the schema. A count of 0
+// is shorthand for the first message in the schema. The indexes are skipped,
+// since messages are decoded into the type registered for their topic rather
+// than a type looked up in the schema. Unframed Protobuf can
+// never begin with a zero byte because field number 0 is reserved, so any
+// message not starting with the magic byte is treated as a bare payload.
+// see: https://docs.confluent.io/current/schema-registry/serdes-develop/index.html#wire-format
+func parseProtobufWireFormat(message []byte) (protobufWireFormat, error) {
+	if len(message) == 0 || message[0] != 0 {
+		return protobufWireFormat{payload: message}, nil
+	}
+	if len(message) < 6 {
+		return protobufWireFormat{}, fmt.Errorf("protobuf message too short for wire format, length %d", len(message))
+	}
+	wireFormat := protobufWireFormat{schemaID: binary.BigEndian.Uint32(message[1:5])}
+	rest := message[5:]
+	count, n := binary.Varint(rest)
+	if n <= 0 || count < 0 {
+		return protobufWireFormat{}, fmt.Errorf("invalid protobuf message index count")
+	}
+	rest = rest[n:]
+	for i := int64(0); i < count; i++ {
+		_, n := binary.Varint(rest)
+		if n <= 0 {
+			return protobufWireFormat{}, fmt.Errorf("invalid protobuf message index")
+		}
+		rest = rest[n:]
+	}
+	wireFormat.payload = rest
+	return wireFormat, nil
+}
+
+// UnmarshalMessage implements the KafkaMessageUnmarshaler interface and
+// decodes Kafka messages from Protobuf. If the target is a generated Protobuf
+// message, the message is decoded into it directly. Otherwise the message is
+// decoded into the Protobuf type registered for the message's topic and then
+// unmarshaled into the target using its `kafka` struct tags, which should
+// match the Protobuf field names.
+func (pmu *protobufMessageUnmarshaler) UnmarshalMessage(
+	ctx context.Context,
+	msg *sarama.ConsumerMessage,
+	target interface{},
+) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "unmarshal-kafka-protobuf")
+	defer span.Finish()
+	if IsTombstone(msg) {
+		return ErrTombstone
+	}
+	wireFormat, err := parseProtobufWireFormat(msg.Value)
+	if err != nil {
+		return err
+	}
+	if protoTarget, ok := target.(proto.Message); ok {
+		return proto.Unmarshal(wireFormat.payload, protoTarget)
+	}
+	messageType, ok := pmu.messageTypes[msg.Topic]
+	if !ok {
+		return fmt.Errorf("no protobuf message type registered for topic %s", msg.Topic)
+	}
+	protoMessage := reflect.New(reflect.TypeOf(messageType).Elem()).Interface().(proto.Message)
+	if err := proto.Unmarshal(wireFormat.payload, protoMessage); err != nil {
+		return err
+	}
+	unmarshalErrs := pmu.messageUnmarshaler.unmarshalKafkaMessageMap(protobufMessageMap(protoMessage), target)
+	if len(unmarshalErrs) > 0 {
+		Logger.Error(
+			"Unable to unmarshal from Protobuf", zap.Errors("errors", unmarshalErrs),
+			zap.String("type", reflect.TypeOf(target).String()))
+		return fmt.Errorf("unable to unmarshal from Protobuf")
+	}
+	return nil
+}
+
+// protobufField maps a field of a generated Protobuf struct to its Protobuf field name
+type protobufField struct {
+	index int
+	name  string
+	oneof bool
+}
+
+// protobufFields caches the Protobuf fields of each generated message type
+var protobufFields sync.Map
+
+// getProtobufFields returns the Protobuf fields of a generated message struct type
+func getProtobufFields(structType reflect.Type) []protobufField {
+	if fields, ok := protobufFields.Load(structType); ok {
+		return fields.([]protobufField)
+	}
+	fields := make([]protobufField, 0, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		if structField.PkgPath != "" {
+			continue
+		}
+		if _, ok := structField.Tag.Lookup("protobuf_oneof"); ok {
+			fields = append(fields, protobufField{index: i, oneof: true})
+			continue
+		}
+		if name := protobufFieldName(structField.Tag.Get("protobuf")); name != "" {
+			fields = append(fields, protobufField{index: i, name: name})
+		}
+	}
+	cached, _ := protobufFields.LoadOrStore(structType, fields)
+	return cached.([]protobufField)
+}
+
+// protobufFieldName extracts the field name from a generated `protobuf` struct tag
+// ex: `protobuf:"varint,1,opt,name=user_id,json=userId,proto3"` -> user_id
+func protobufFieldName(tag string) string {
+	for _, part := range strings.Split(tag, ",") {
+		if strings.HasPrefix(part, "name=") {
+			return strings.TrimPrefix(part, "name=")
+		}
+	}
+	return ""
+}
+
+// protobufMessageMap converts a decoded Protobuf message into the same
+// map[string]interface{} representation that is produced by the Avro and JSON
+// decoders so that it can be unmarshaled by the shared kafkaMessageUnmarshaler.
+// Numeric types are converted to the int32, int64, and float types the
+// decoder expects, google.protobuf.Timestamp fields are converted to
+// milliseconds since the epoch, nested messages are converted to kafkaRecords
+// that unmarshal into struct fields, repeated fields are converted to slices
+// of these values, and map fields with string keys are converted to
+// kafkaMaps. Map fields with other keys are left as Go maps, and only
+// unmarshal into fields of the same type.
+func protobufMessageMap(message proto.Message) map[string]interface{} {
+	return protobufStructMap(reflect.ValueOf(message).Elem())
+}
+
+func protobufStructMap(value reflect.Value) map[string]interface{} {
+	fields := getProtobufFields(value.Type())
+	messageMap := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		fieldValue := value.Field(field.index)
+		if !field.oneof {
+			messageMap[field.name] = protobufValue(fieldValue)
+			continue
+		}
+		// oneof fields hold a pointer to a wrapper struct with a single field
+		// containing the value that is set
+		if fieldValue.IsNil() {
+			continue
+		}
+		wrapper := fieldValue.Elem().Elem()
+		for _, wrapped := range getProtobufFields(wrapper.Type()) {
+			messageMap[wrapped.name] = protobufValue(wrapper.Field(wrapped.index))
+		}
+	}
+	return messageMap
+}
+
+var protobufTimestampType = reflect.TypeOf(&timestamp.Timestamp{})
+
+func protobufValue(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return nil
+		}
+		if value.Type() == protobufTimestampType {
+			ts := value.Interface().(*timestamp.Timestamp)
+			return ts.Seconds*1000 + int64(ts.Nanos)/1000000
+		}
+		if value.Elem().Kind() == reflect.Struct {
+			return kafkaRecord(protobufStructMap(value.Elem()))
+		}
+		return protobufValue(value.Elem())
+	case reflect.Int32:
+		// enums are generated as named int32 types
+		return int32(value.Int())
+	case reflect.Int64:
+		return value.Int()
+	case reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint())
+	case reflect.Float32:
+		return float32(value.Float())
+	case reflect.Float64:
+		return value.Float()
+	case reflect.Bool:
+		return value.Bool()
+	case reflect.String:
+		return value.String()
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return value.Bytes()
+		}
+		values := make([]interface{}, value.Len())
+		for i := 0; i < value.Len(); i++ {
+			values[i] = protobufValue(value.Index(i))
+		}
+		return values
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return value.Interface()
+		}
+		values := make(kafkaMap, value.Len())
+		for _, key := range value.MapKeys() {
+			values[key.String()] = protobufValue(value.MapIndex(key))
+		}
+		return values
+	default:
+		return value.Interface()
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testProtoMessage mirrors the code generated by protoc-gen-go for a message
+// with a string name, int64 count, and google.protobuf.Timestamp created_at
+type testProtoMessage struct {
+	Name      string               `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Count     int64                `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+	CreatedAt *timestamp.Timestamp `protobuf:"bytes,3,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+}
+
+func (m *testProtoMessage) Reset()         { *m = testProtoMessage{} }
+func (m *testProtoMessage) String() string { return proto.CompactTextString(m) }
+func (*testProtoMessage) ProtoMessage()    {}
+
+func newTestProtoBytes(t *testing.T) []byte {
+	message := &testProtoMessage{
+		Name:      "Guy Fieri",
+		Count:     3,
+		CreatedAt: &timestamp.Timestamp{Seconds: 1522083600},
+	}
+	protoBytes, err := proto.Marshal(message)
+	require.NoError(t, err)
+	return protoBytes
+}
+
+func TestParseProtobufWireFormat(t *testing.T) {
+	payload := []byte{0x0a, 0x01, 'a'}
+
+	t.Run("bare payload", func(t *testing.T) {
+		wireFormat, err := parseProtobufWireFormat(payload)
+		require.NoError(t, err)
+		assert.Equal(t, payload, wireFormat.payload)
+		assert.Equal(t, uint32(0), wireFormat.schemaID)
+	})
+
+	t.Run("first message shorthand", func(t *testing.T) {
+		message := append([]byte{0, 0, 0, 0, 77, 0}, payload...)
+		wireFormat, err := parseProtobufWireFormat(message)
+		require.NoError(t, err)
+		assert.Equal(t, payload, wireFormat.payload)
+		assert.Equal(t, uint32(77), wireFormat.schemaID)
+	})
+
+	t.Run("explicit message indexes", func(t *testing.T) {
+		// two indexes, [1, 2], zig-zag encoded
+		message := append([]byte{0, 0, 0, 0, 77, 4, 2, 4}, payload...)
+		wireFormat, err := parseProtobufWireFormat(message)
+		require.NoError(t, err)
+		assert.Equal(t, payload, wireFormat.payload)
+	})
+
+	t.Run("truncated message", func(t *testing.T) {
+		_, err := parseProtobufWireFormat([]byte{0, 0, 0})
+		assert.Error(t, err)
+	})
+}
+
+func TestUnmarshalProtobufMessage_ProtoTarget(t *testing.T) {
+	pmu := &protobufMessageUnmarshaler{}
+	message := append([]byte{0, 0, 0, 0, 77, 0}, newTestProtoBytes(t)...)
+	target := &testProtoMessage{}
+	err := pmu.UnmarshalMessage(context.Background(), &sarama.ConsumerMessage{Value: message}, target)
+	require.NoError(t, err)
+	assert.Equal(t, "Guy Fieri", target.Name)
+	assert.Equal(t, int64(3), target.Count)
+}
+
+func TestUnmarshalProtobufMessage_StructTarget(t *testing.T) {
+	type unmarshalTarget struct {
+		Name      string    `kafka:"name"`
+		Count     int       `kafka:"count"`
+		CreatedAt time.Time `kafka:"created_at"`
+	}
+	pmu := &protobufMessageUnmarshaler{
+		messageTypes:       map[string]proto.Message{"flavortown": &testProtoMessage{}},
+		messageUnmarshaler: &kafkaMessageDecoder{},
+	}
+	kafkaMessage := &sarama.ConsumerMessage{Topic: "flavortown", Value: newTestProtoBytes(t)}
+	target := &unmarshalTarget{}
+	err := pmu.UnmarshalMessage(context.Background(), kafkaMessage, target)
+	require.NoError(t, err)
+	assert.Equal(t, "Guy Fieri", target.Name)
+	assert.Equal(t, 3, target.Count)
+	assert.Equal(t, time.Unix(1522083600, 0), target.CreatedAt)
+}
+
+// testProtoOrder mirrors the code generated by protoc-gen-go for a message
+// with nested message, map, and repeated fields
+type testProtoOrder struct {
+	Chef       *testProtoMessage            `protobuf:"bytes,1,opt,name=chef,proto3" json:"chef,omitempty"`
+	Sauces     map[string]int64             `protobuf:"bytes,2,rep,name=sauces,proto3" json:"sauces,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"varint,2,opt,name=value,proto3"`
+	Sides      []string                     `protobuf:"bytes,3,rep,name=sides,proto3" json:"sides,omitempty"`
+	Line       []*testProtoMessage          `protobuf:"bytes,4,rep,name=line,proto3" json:"line,omitempty"`
+	Stations   map[string]*testProtoMessage `protobuf:"bytes,5,rep,name=stations,proto3" json:"stations,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	TableSeats map[int32]string             `protobuf:"bytes,6,rep,name=table_seats,json=tableSeats,proto3" json:"table_seats,omitempty" protobuf_key:"varint,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *testProtoOrder) Reset()         { *m = testProtoOrder{} }
+func (m *testProtoOrder) String() string { return proto.CompactTextString(m) }
+func (*testProtoOrder) ProtoMessage()    {}
+
+func TestUnmarshalProtobufMessage_NestedMessage(t *testing.T) {
+	type chef struct {
+		Name  string `kafka:"name"`
+		Count int    `kafka:"count"`
+	}
+	type unmarshalTarget struct {
+		Chef       chef             `kafka:"chef"`
+		Sauces     map[string]int   `kafka:"sauces"`
+		Sides      []string         `kafka:"sides"`
+		Line       []chef           `kafka:"line"`
+		Stations   map[string]*chef `kafka:"stations"`
+		TableSeats map[int32]string `kafka:"table_seats"`
+	}
+	protoBytes, err := proto.Marshal(&testProtoOrder{
+		Chef:       &testProtoMessage{Name: "Guy Fieri", Count: 3},
+		Sauces:     map[string]int64{"donkey": 1},
+		Sides:      []string{"fries", "onion rings"},
+		Line:       []*testProtoMessage{{Name: "Hunter"}, {Name: "Ryder"}},
+		Stations:   map[string]*testProtoMessage{"grill": {Name: "Guy Fieri"}},
+		TableSeats: map[int32]string{1: "Guy Fieri"},
+	})
+	require.NoError(t, err)
+	pmu := &protobufMessageUnmarshaler{
+		messageTypes:       map[string]proto.Message{"orders": &testProtoOrder{}},
+		messageUnmarshaler: &kafkaMessageDecoder{},
+	}
+	target := &unmarshalTarget{}
+	err = pmu.UnmarshalMessage(
+		context.Background(), &sarama.ConsumerMessage{Topic: "orders", Value: protoBytes}, target)
+	require.NoError(t, err)
+	assert.Equal(t, &unmarshalTarget{
+		Chef:       chef{Name: "Guy Fieri", Count: 3},
+		Sauces:     map[string]int{"donkey": 1},
+		Sides:      []string{"fries", "onion rings"},
+		Line:       []chef{{Name: "Hunter"}, {Name: "Ryder"}},
+		Stations:   map[string]*chef{"grill": {Name: "Guy Fieri"}},
+		TableSeats: map[int32]string{1: "Guy Fieri"},
+	}, target)
+}
+
+func TestUnmarshalProtobufMessage_UnknownTopic(t *testing.T) {
+	type unmarshalTarget struct {
+		Name string `kafka:"name"`
+	}
+	pmu := &protobufMessageUnmarshaler{messageUnmarshaler: &kafkaMessageDecoder{}}
+	kafkaMessage := &sarama.ConsumerMessage{Topic: "flavortown", Value: newTestProtoBytes(t)}
+	err := pmu.UnmarshalMessage(context.Background(), kafkaMessage, &unmarshalTarget{})
+	assert.Error(t, err)
+}
+
+func TestKafkaMessageFormat(t *testing.T) {
+	var format KafkaMessageFormat
+	assert.Equal(t, AvroMessageFormat, format)
+	require.NoError(t, format.Set("Protobuf"))
+	assert.Equal(t, ProtobufMessageFormat, format)
+	assert.Equal(t, "protobuf", format.String())
+	assert.Error(t, format.Set("xml"))
+}
@@ -24,9 +24,11 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/Shopify/sarama/mocks"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
 )
 
 // Create a mock message handler
@@ -242,6 +244,25 @@ func TestConsumePartition(t *testing.T) {
 	partitionConsumer.ExpectMessagesDrainedOnClose()
 }
 
+func TestHandleMessage_Logger(t *testing.T) {
+	logs, restore := observeLogs()
+	defer restore()
+	consumer := &KafkaConsumer{}
+	handler := &testHandler{}
+	handler.On("HandleMessage", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		LoggerFromContext(args.Get(0).(context.Context)).Info("Flavortown")
+	})
+	msg := &sarama.ConsumerMessage{Topic: "test-topic", Partition: 2, Offset: 42, Value: []byte("{}")}
+	require.NoError(t, consumer.handleMessage(context.Background(), handler, msg))
+	entries := logs.FilterMessage("Flavortown").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, map[string]interface{}{
+		"topic":     "test-topic",
+		"partition": int32(2),
+		"offset":    int64(42),
+	}, entries[0].ContextMap())
+}
+
 // Test that we're "caught up" if there aren't any messages to process
 func TestConsumePartition_caughtUp(t *testing.T) {
 	handler, consumer, mockSaramaConsumer, ctx, cancel := setupTestConsumer(t)
@@ -303,3 +324,124 @@ func TestConsumePartition_handleError(t *testing.T) {
 	handler.AssertNotCalled(t, "HandleMessage")
 	partitionConsumer.ExpectErrorsDrainedOnClose()
 }
+
+// Create a mock message handler that handles tombstones separately
+type testTombstoneHandler struct {
+	testHandler
+}
+
+func (tth *testTombstoneHandler) HandleTombstone(
+	ctx context.Context,
+	msg *sarama.ConsumerMessage,
+	unmarshaler KafkaMessageUnmarshaler,
+) error {
+	tth.Called(ctx, msg, unmarshaler)
+	return nil
+}
+
+// Test that tombstones are passed to HandleTombstone if the handler implements it
+func TestConsumePartition_tombstone(t *testing.T) {
+	_, consumer, mockSaramaConsumer, ctx, _ := setupTestConsumer(t)
+	defer mockSaramaConsumer.Close()
+	partitionConsumer := *mockSaramaConsumer.ExpectConsumePartition("test-topic", 0, 0)
+	message := &sarama.ConsumerMessage{Value: []byte{0, 1, 2, 3, 4}, Offset: 1}
+	tombstone := &sarama.ConsumerMessage{Key: []byte("guy"), Offset: 2}
+	handler := &testTombstoneHandler{}
+	handler.On("HandleMessage", mock.Anything, message, mock.Anything)
+	handler.On("HandleTombstone", mock.Anything, tombstone, mock.Anything)
+	readStatus := make(chan consumerLastStatus)
+	var catchupWg sync.WaitGroup
+	catchupWg.Add(1)
+	go consumer.consumePartition(ctx, handler, "test-topic", 0, 0, 2, readStatus, &catchupWg, true)
+	partitionConsumer.YieldMessage(message)
+	partitionConsumer.YieldMessage(tombstone)
+	<-readStatus
+	handler.AssertNumberOfCalls(t, "HandleMessage", 1)
+	handler.AssertNumberOfCalls(t, "HandleTombstone", 1)
+
+	// handlers that don't implement HandleTombstone receive tombstones as messages
+	plainHandler := &testHandler{}
+	plainHandler.On("HandleMessage", mock.Anything, tombstone, mock.Anything)
+	assert.NoError(t, consumer.handleMessage(ctx, plainHandler, tombstone))
+	plainHandler.AssertNumberOfCalls(t, "HandleMessage", 1)
+}
+
+func TestKafkaClientHealthCheck(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+	config := sarama.NewConfig()
+	config.Metadata.Retry.Max = 0
+	client, err := sarama.NewClient([]string{broker.Addr()}, config)
+	require.NoError(t, err)
+	kc := &kafkaClient{client: client}
+	check := kc.HealthCheck()
+	assert.True(t, check.Critical)
+	assert.NoError(t, check.Check(context.Background()))
+
+	broker.Close()
+	assert.Error(t, check.Check(context.Background()))
+	require.NoError(t, client.Close())
+	assert.Error(t, check.Check(context.Background()))
+}
+
+func TestNewKafkaConsumer_ClosesOnError(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	kc := &KafkaConfig{}
+	_, err = kc.NewKafkaConsumer(client, &SchemaRegistryConfig{TLSCaCrtPath: "/does/not/exist"})
+	assert.Error(t, err)
+	assert.True(t, client.Closed())
+}
+
+func TestKafkaConfig_JSONEnabled(t *testing.T) {
+	tests := []struct {
+		args   []string
+		format KafkaMessageFormat
+	}{
+		{nil, JSONMessageFormat},
+		{[]string{"--enable-json"}, JSONMessageFormat},
+		{[]string{"--enable-json=false"}, AvroMessageFormat},
+		{[]string{"--kafka-message-format=protobuf"}, ProtobufMessageFormat},
+	}
+	for _, test := range tests {
+		kc := &KafkaConfig{}
+		flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		kc.RegisterViperFlags(flags)
+		require.NoError(t, flags.Parse(test.args))
+		assert.Equal(t, test.format, kc.messageFormat(), test.args)
+	}
+
+	// the deprecated field only applies if the format is left as Avro
+	assert.Equal(t, JSONMessageFormat, (&KafkaConfig{JSONEnabled: true}).messageFormat())
+	assert.Equal(t, DebeziumMessageFormat,
+		(&KafkaConfig{JSONEnabled: true, MessageFormat: DebeziumMessageFormat}).messageFormat())
+}
+
+func TestMessageLogField(t *testing.T) {
+	tests := []struct {
+		message []byte
+		binary  bool
+	}{
+		{[]byte(`{"name": "Guy"}`), false},
+		{[]byte("Flavortown\tUSA\n"), false},
+		// Avro in the Schema Registry wire format is valid UTF-8
+		{[]byte{0, 0, 0, 0, 77, 2, 6, 'G', 'u', 'y'}, true},
+		{[]byte{'G', 'u', 'y', 1, 2}, true},
+		{[]byte{0xff, 0xfe}, true},
+	}
+	for _, test := range tests {
+		field := messageLogField(test.message)
+		if test.binary {
+			assert.Equal(t, zapcore.BinaryType, field.Type, "%q", test.message)
+		} else {
+			assert.Equal(t, zapcore.StringType, field.Type, "%q", test.message)
+		}
+	}
+}
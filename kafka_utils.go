@@ -17,6 +17,8 @@ package tools
 import (
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -27,125 +29,348 @@ type kafkaMessageUnmarshaler interface {
 }
 type kafkaMessageDecoder struct{}
 
+// decoderPlans caches a compiled decoderPlan for every struct type that
+// messages have been unmarshaled into, keyed by reflect.Type. Struct tags and
+// field types are only inspected the first time a type is seen; afterwards
+// decoding just runs the cached setters.
+var decoderPlans sync.Map
+
+// kafkaRecord holds the fields of a nested record, such as a nested Protobuf
+// message. Unlike a map[string]interface{}, it is never mistaken for a Kafka
+// Connect nullable value.
+type kafkaRecord map[string]interface{}
+
+// kafkaMap holds the entries of a map value, such as an Avro map. Like
+// kafkaRecord, it is never mistaken for a Kafka Connect nullable value.
+type kafkaMap map[string]interface{}
+
+// fieldSetter sets a single struct field from a decoded Kafka value
+type fieldSetter func(field reflect.Value, kafkaValue interface{}) error
+
+// fieldPlan describes how to populate one field of a struct
+type fieldPlan struct {
+	index  int
+	tag    string
+	setter fieldSetter
+}
+
+// decoderPlan is the list of field plans for a struct type
+type decoderPlan []fieldPlan
+
+// getDecoderPlan returns the cached decoderPlan for the given struct type,
+// compiling and caching it if this is the first time the type has been seen
+func getDecoderPlan(structType reflect.Type) decoderPlan {
+	if plan, ok := decoderPlans.Load(structType); ok {
+		return plan.(decoderPlan)
+	}
+	plan, _ := decoderPlans.LoadOrStore(structType, compileDecoderPlan(structType))
+	return plan.(decoderPlan)
+}
+
+// compileDecoderPlan walks a struct type once and builds a setter for each
+// of its fields based on the field's type and kafka tag
+func compileDecoderPlan(structType reflect.Type) decoderPlan {
+	plan := make(decoderPlan, 0, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		tag := structField.Tag.Get("kafka")
+		var setter fieldSetter
+		if structField.PkgPath != "" {
+			// unexported fields can never be set through reflection
+			setter = invalidFieldSetter(tag)
+		} else {
+			setter = newFieldSetter(structField.Type, tag)
+		}
+		plan = append(plan, fieldPlan{index: i, tag: tag, setter: setter})
+	}
+	return plan
+}
+
 // Unmarshal Avro or JSON into a struct type taking into account Kafka Connect's
 // quirks. If a field from the source DBMS is nullable, Kafka connect seems
 // to place the value of that field in a nested map, so we have to look for
 // these maps when unmarshaling. If Kafka Connect is producing JSON, it seems to
 // make every number a float64.
 // Note: This function can currently handle all types of ints, bools, strings,
-// and time.Time types.
+// and time.Time types, as well as nested structs, pointers, slices, and maps
+// of these types.
 func (kmd *kafkaMessageDecoder) unmarshalKafkaMessageMap(kafkaMessageMap map[string]interface{}, target interface{}) []error {
 	valueOfStructure := reflect.ValueOf(target).Elem()
-	typeOfStructure := valueOfStructure.Type()
+	plan := getDecoderPlan(valueOfStructure.Type())
 	errs := make([]error, 0)
-	for i := 0; i < valueOfStructure.NumField(); i++ {
-		tag := typeOfStructure.Field(i).Tag.Get("kafka")
-		kafkaValue, valueInMap := kafkaMessageMap[tag]
+	for _, fp := range plan {
+		kafkaValue, valueInMap := kafkaMessageMap[fp.tag]
 		if !valueInMap {
 			continue
 		}
-		field := valueOfStructure.Field(i)
 
 		// handle Kafka Connect placing nullable values as nested
 		// map[string]interface{} where the (single) key of the map is the type
 		// by moving the actual value out of the nested map
 		// ex: {"nullable_int": {"int": 0}, "nullable_string": {"string: "abc"}}
 		//  -> {"nullable_int": 0, "nullable_string": "abc"}
-		if v, ok := kafkaValue.(map[string]interface{}); ok {
-			kafkaValue = v[reflect.ValueOf(v).MapKeys()[0].String()]
+		if v, ok := kafkaValue.(map[string]interface{}); ok && len(v) == 1 {
+			for key, nested := range v {
+				if isAvroBranchName(key) {
+					kafkaValue = nested
+				}
+			}
 		}
 
 		if kafkaValue == nil {
 			continue
 		}
-		var err error
-		if field.CanSet() && field.IsValid() {
-			fieldType := field.Type().String()
-			switch fieldType {
-			case "bool":
-				// Booleans come through from Kafka Connect as int32, int64, or actual bools
-				if b, ok := kafkaValue.(int32); ok {
-					field.SetBool(b > 0)
-				} else if b, ok := kafkaValue.(int64); ok {
-					field.SetBool(b > 0)
-				} else if b, ok := kafkaValue.(float64); ok {
-					field.SetBool(b > 0)
-				} else if b, ok := kafkaValue.(bool); ok {
-					field.SetBool(b)
-				} else {
-					err = fmt.Errorf("error unmarshaling Kafka message, couldn't set bool field with tag %s", tag)
-				}
-			case "int", "int8", "int16", "int32", "int64":
-				// Avro only has int32 and int64 values so we just need to check those
-				if i, ok := kafkaValue.(int32); ok {
-					field.SetInt(int64(i))
-				} else if i, ok := kafkaValue.(int64); ok {
-					field.SetInt(i)
-				} else if i, ok := kafkaValue.(float64); ok {
-					field.SetInt(int64(i))
-				} else {
-					err = fmt.Errorf("error unmarshaling Kafka message, couldn't set int field with tag %s", tag)
+		if err := fp.setter(valueOfStructure.Field(fp.index), kafkaValue); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// isAvroBranchName returns whether a key names the branch of an Avro union
+// holding a primitive, array, or map value, e.g. "int" or
+// "long.timestamp-millis"
+func isAvroBranchName(key string) bool {
+	typeName := strings.SplitN(key, ".", 2)[0]
+	return avroPrimitiveTypes[typeName] || typeName == "array" || typeName == "map"
+}
+
+// plainKafkaValue converts the kafkaRecords and kafkaMaps in a decoded value
+// to map[string]interface{}, for fields that hold decoded values as is
+func plainKafkaValue(kafkaValue interface{}) interface{} {
+	switch v := kafkaValue.(type) {
+	case kafkaRecord:
+		return plainKafkaMap(v)
+	case kafkaMap:
+		return plainKafkaMap(v)
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = plainKafkaValue(item)
+		}
+		return items
+	}
+	return kafkaValue
+}
+
+func plainKafkaMap(entries map[string]interface{}) map[string]interface{} {
+	plain := make(map[string]interface{}, len(entries))
+	for key, entry := range entries {
+		plain[key] = plainKafkaValue(entry)
+	}
+	return plain
+}
+
+// invalidFieldSetter returns a setter for fields that cannot be set
+func invalidFieldSetter(tag string) fieldSetter {
+	return func(field reflect.Value, _ interface{}) error {
+		Logger.Error(
+			"Cannot set invalid field", zap.String("field_tag", tag),
+			zap.Bool("field_can_set", field.CanSet()),
+			zap.Bool("field_is_valid", field.IsValid()))
+		return fmt.Errorf("cannot set invalid field with tag %s", tag)
+	}
+}
+
+// newFieldSetter returns a setter that converts values decoded from Kafka
+// into the given field type
+func newFieldSetter(fieldType reflect.Type, tag string) fieldSetter {
+	if fieldType.Kind() == reflect.Ptr {
+		// pointer fields hold nullable values, and are left nil for nulls
+		setElem := newFieldSetter(fieldType.Elem(), tag)
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			elem := reflect.New(fieldType.Elem())
+			if err := setElem(elem.Elem(), kafkaValue); err != nil {
+				return err
+			}
+			field.Set(elem)
+			return nil
+		}
+	}
+	switch fieldType.String() {
+	case "bool":
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			// Booleans come through from Kafka Connect as int32, int64, or actual bools
+			if b, ok := kafkaValue.(int32); ok {
+				field.SetBool(b > 0)
+			} else if b, ok := kafkaValue.(int64); ok {
+				field.SetBool(b > 0)
+			} else if b, ok := kafkaValue.(float64); ok {
+				field.SetBool(b > 0)
+			} else if b, ok := kafkaValue.(bool); ok {
+				field.SetBool(b)
+			} else {
+				return fmt.Errorf("error unmarshaling Kafka message, couldn't set bool field with tag %s", tag)
+			}
+			return nil
+		}
+	case "int", "int8", "int16", "int32", "int64":
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			// Avro only has int32 and int64 values so we just need to check those
+			if i, ok := kafkaValue.(int32); ok {
+				field.SetInt(int64(i))
+			} else if i, ok := kafkaValue.(int64); ok {
+				field.SetInt(i)
+			} else if i, ok := kafkaValue.(float64); ok {
+				field.SetInt(int64(i))
+			} else {
+				return fmt.Errorf("error unmarshaling Kafka message, couldn't set int field with tag %s", tag)
+			}
+			return nil
+		}
+	case "uint", "uint8", "uint16", "uint32", "uint64":
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			if i, ok := kafkaValue.(int32); ok {
+				field.SetUint(uint64(i))
+			} else if i, ok := kafkaValue.(int64); ok {
+				field.SetUint(uint64(i))
+			} else if i, ok := kafkaValue.(float64); ok {
+				field.SetUint(uint64(i))
+			} else {
+				return fmt.Errorf("error unmarshaling Kafka message, couldn't set uint field with tag %s", tag)
+			}
+			return nil
+		}
+	case "float32", "float64":
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			if i, ok := kafkaValue.(float32); ok {
+				field.SetFloat(float64(i))
+			} else if i, ok := kafkaValue.(float64); ok {
+				field.SetFloat(float64(i))
+			} else {
+				return fmt.Errorf("error unmarshaling Kafka message, couldn't set float field with tag %s", tag)
+			}
+			return nil
+		}
+	case "string":
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			if s, ok := kafkaValue.(string); ok {
+				field.SetString(s)
+			} else {
+				return fmt.Errorf("error unmarshaling Kafka message, couldn't set string field with tag %s", tag)
+			}
+			return nil
+		}
+	case "time.Time":
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			// times are encoded as int64 milliseconds in Avro
+			if t, ok := kafkaValue.(time.Time); ok {
+				field.Set(reflect.ValueOf(t))
+			} else if t, ok := kafkaValue.(int64); ok {
+				timeVal := time.Unix(0, t*1000000)
+				field.Set(reflect.ValueOf(timeVal))
+			} else if t, ok := kafkaValue.(float64); ok {
+				timeVal := time.Unix(0, int64(t)*1000000)
+				field.Set(reflect.ValueOf(timeVal))
+			} else if t, ok := kafkaValue.(string); ok {
+				// try decoding as RFC3339 time string
+				timeVal, parseErr := time.Parse(time.RFC3339, t)
+				if parseErr != nil {
+					return fmt.Errorf("error unmarshaling Kafka message, failed to parse time field with tag %s, reason: %s", tag, parseErr.Error())
 				}
-			case "uint", "uint8", "uint16", "uint32", "uint64":
-				if i, ok := kafkaValue.(int32); ok {
-					field.SetUint(uint64(i))
-				} else if i, ok := kafkaValue.(int64); ok {
-					field.SetUint(uint64(i))
-				} else if i, ok := kafkaValue.(float64); ok {
-					field.SetUint(uint64(i))
-				} else {
-					err = fmt.Errorf("error unmarshaling Kafka message, couldn't set uint field with tag %s", tag)
+				field.Set(reflect.ValueOf(timeVal))
+			} else {
+				return fmt.Errorf("error unmarshaling Kafka message, couldn't set time field with tag %s", tag)
+			}
+			return nil
+		}
+	}
+	switch fieldType.Kind() {
+	case reflect.Struct:
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			var record map[string]interface{}
+			switch v := kafkaValue.(type) {
+			case kafkaRecord:
+				record = v
+			case map[string]interface{}:
+				record = v
+			default:
+				return fmt.Errorf("error unmarshaling Kafka message, couldn't set struct field with tag %s", tag)
+			}
+			decoder := &kafkaMessageDecoder{}
+			if errs := decoder.unmarshalKafkaMessageMap(record, field.Addr().Interface()); len(errs) > 0 {
+				return fmt.Errorf(
+					"error unmarshaling Kafka message, couldn't set struct field with tag %s: %v", tag, errs)
+			}
+			return nil
+		}
+	case reflect.Map:
+		setEntry := newFieldSetter(fieldType.Elem(), tag)
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			var entries map[string]interface{}
+			switch v := kafkaValue.(type) {
+			case kafkaMap:
+				entries = v
+			case map[string]interface{}:
+				entries = v
+			default:
+				value := reflect.ValueOf(kafkaValue)
+				if !value.Type().AssignableTo(fieldType) {
+					return fmt.Errorf("error unmarshaling Kafka message, couldn't set map field with tag %s", tag)
 				}
-			case "float32", "float64":
-				if i, ok := kafkaValue.(float32); ok {
-					field.SetFloat(float64(i))
-				} else if i, ok := kafkaValue.(float64); ok {
-					field.SetFloat(float64(i))
-				} else {
-					err = fmt.Errorf("error unmarshaling Kafka message, couldn't set float field with tag %s", tag)
+				field.Set(value)
+				return nil
+			}
+			if fieldType.Key().Kind() != reflect.String {
+				return fmt.Errorf("error unmarshaling Kafka message, map field with tag %s must have string keys", tag)
+			}
+			values := reflect.MakeMapWithSize(fieldType, len(entries))
+			for key, entry := range entries {
+				value := reflect.New(fieldType.Elem()).Elem()
+				if entry != nil {
+					if err := setEntry(value, entry); err != nil {
+						return err
+					}
 				}
-			case "string":
-				if s, ok := kafkaValue.(string); ok {
-					field.SetString(s)
-				} else {
-					err = fmt.Errorf("error unmarshaling Kafka message, couldn't set string field with tag %s", tag)
+				values.SetMapIndex(reflect.ValueOf(key).Convert(fieldType.Key()), value)
+			}
+			field.Set(values)
+			return nil
+		}
+	case reflect.Slice, reflect.Array:
+		setItem := newFieldSetter(fieldType.Elem(), tag)
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			value := reflect.ValueOf(kafkaValue)
+			if value.Type().AssignableTo(fieldType) {
+				// e.g. Avro bytes into a []byte
+				field.Set(value)
+				return nil
+			}
+			items, ok := kafkaValue.([]interface{})
+			if !ok || (fieldType.Kind() == reflect.Array && len(items) > fieldType.Len()) {
+				return fmt.Errorf("error unmarshaling Kafka message, couldn't set %s field with tag %s", fieldType.Kind(), tag)
+			}
+			values := reflect.New(fieldType).Elem()
+			if fieldType.Kind() == reflect.Slice {
+				values = reflect.MakeSlice(fieldType, len(items), len(items))
+			}
+			for i, item := range items {
+				if item == nil {
+					continue
 				}
-			case "time.Time":
-				// times are encoded as int64 milliseconds in Avro
-				if t, ok := kafkaValue.(int64); ok {
-					timeVal := time.Unix(0, t*1000000)
-					field.Set(reflect.ValueOf(timeVal))
-				} else if t, ok := kafkaValue.(float64); ok {
-					timeVal := time.Unix(0, int64(t)*1000000)
-					field.Set(reflect.ValueOf(timeVal))
-				} else if t, ok := kafkaValue.(string); ok {
-					// try decoding as RFC3339 time string
-					timeVal, parseErr := time.Parse(time.RFC3339, t)
-					if parseErr == nil {
-						field.Set(reflect.ValueOf(timeVal))
-					} else {
-						err = fmt.Errorf("error unmarshaling Kafka message, failed to parse time field with tag %s, reason: %s", tag, parseErr.Error())
-					}
-				} else {
-					err = fmt.Errorf("error unmarshaling Kafka message, couldn't set time field with tag %s", tag)
+				if err := setItem(values.Index(i), item); err != nil {
+					return err
 				}
-			default:
-				err = fmt.Errorf(
-					"unhandled Avro type %s, field with tag %s will not be set", field.Type().String(), tag)
-				Logger.Error(
-					"Unhandled Avro type! This field will not be set!",
-					zap.String("field_type", field.Type().String()), zap.String("field_tag", tag))
 			}
-		} else {
-			err = fmt.Errorf("cannot set invalid field with tag %s", tag)
-			Logger.Error(
-				"Cannot set invalid field", zap.String("field_tag", tag),
-				zap.Bool("field_can_set", field.CanSet()),
-				zap.Bool("field_is_valid", field.IsValid()))
+			field.Set(values)
+			return nil
 		}
-		if err != nil {
-			errs = append(errs, err)
+	case reflect.Interface:
+		return func(field reflect.Value, kafkaValue interface{}) error {
+			value := reflect.ValueOf(plainKafkaValue(kafkaValue))
+			if !value.Type().AssignableTo(fieldType) {
+				return fmt.Errorf("error unmarshaling Kafka message, couldn't set %s field with tag %s", fieldType, tag)
+			}
+			field.Set(value)
+			return nil
+		}
+	default:
+		return func(field reflect.Value, _ interface{}) error {
+			Logger.Error(
+				"Unhandled Avro type! This field will not be set!",
+				zap.String("field_type", field.Type().String()), zap.String("field_tag", tag))
+			return fmt.Errorf(
+				"unhandled Avro type %s, field with tag %s will not be set", field.Type().String(), tag)
 		}
 	}
-	return errs
 }
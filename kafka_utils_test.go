@@ -16,6 +16,7 @@ package tools
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -108,6 +109,52 @@ func TestUnmarshalMap_NullableFields(t *testing.T) {
 	assert.Equal(t, 123, target.A)
 }
 
+// Test that nested records, maps, and slices are set, and that only
+// single-key maps naming a union branch are treated as nullable values
+func TestUnmarshalMap_NestedValues(t *testing.T) {
+	type place struct {
+		City string `kafka:"city"`
+	}
+	type unmarshalTarget struct {
+		Place     place             `kafka:"place"`
+		Visited   *place            `kafka:"visited"`
+		Tags      []string          `kafka:"tags"`
+		Places    []place           `kafka:"places"`
+		Ratings   map[string]int    `kafka:"ratings"`
+		Nicknames map[string]string `kafka:"nicknames"`
+		Menu      map[string]string `kafka:"menu"`
+		Photo     []byte            `kafka:"photo"`
+		Extra     interface{}       `kafka:"extra"`
+	}
+	target := &unmarshalTarget{}
+	message := map[string]interface{}{
+		"place":     kafkaRecord{"city": "Flavortown"},
+		"visited":   map[string]interface{}{"city": "Flavortown"},
+		"tags":      []interface{}{"diners", "drive-ins", "dives"},
+		"places":    []interface{}{kafkaRecord{"city": "Flavortown"}},
+		"ratings":   kafkaMap{"burgers": int32(5), "fries": int64(4)},
+		"nicknames": kafkaMap{"string": "Guy"},
+		"menu":      map[string]interface{}{"burger": "double", "fries": "curly"},
+		"photo":     []byte("guy"),
+		"extra":     kafkaRecord{"hair": "spiky"},
+	}
+
+	messageDecoder := kafkaMessageDecoder{}
+	errs := messageDecoder.unmarshalKafkaMessageMap(message, target)
+	assert.Empty(t, errs)
+	assert.Equal(t, unmarshalTarget{
+		Place:     place{City: "Flavortown"},
+		Visited:   &place{City: "Flavortown"},
+		Tags:      []string{"diners", "drive-ins", "dives"},
+		Places:    []place{{City: "Flavortown"}},
+		Ratings:   map[string]int{"burgers": 5, "fries": 4},
+		Nicknames: map[string]string{"string": "Guy"},
+		Menu:      map[string]string{"burger": "double", "fries": "curly"},
+		Photo:     []byte("guy"),
+		Extra:     map[string]interface{}{"hair": "spiky"},
+	}, *target)
+}
+
 // Test that nil fields work
 func TestUnmarshalMap_NilFields(t *testing.T) {
 	type unmarshalTarget struct {
@@ -124,17 +171,17 @@ func TestUnmarshalMap_NilFields(t *testing.T) {
 // Test that unsupported field types return errors
 func TestUnmarshalMap_UnsupportedType(t *testing.T) {
 	type unmarshalTarget struct {
-		A []byte `kafka:"a"`
+		A complex64 `kafka:"a"`
 	}
 	target := &unmarshalTarget{}
 
 	message := make(map[string]interface{})
-	message["a"] = []byte{'T', 'H', 'A', 'N', 'K'}
+	message["a"] = complex64(1)
 
 	messageDecoder := kafkaMessageDecoder{}
 	errs := messageDecoder.unmarshalKafkaMessageMap(message, target)
 	require.Len(t, errs, 1)
-	expectedErr := fmt.Errorf("unhandled Avro type []uint8, field with tag a will not be set")
+	expectedErr := fmt.Errorf("unhandled Avro type complex64, field with tag a will not be set")
 	assert.Equal(t, expectedErr, errs[0])
 }
 
@@ -154,3 +201,71 @@ func TestUnmarshalMap_UnexportedField(t *testing.T) {
 	expectedErr := fmt.Errorf("cannot set invalid field with tag a")
 	assert.Equal(t, expectedErr, errs[0])
 }
+
+// Test that decoder plans are compiled once per type and reused
+func TestGetDecoderPlan_Cached(t *testing.T) {
+	type unmarshalTarget struct {
+		A int    `kafka:"a"`
+		B string `kafka:"b"`
+	}
+	targetType := reflect.TypeOf(unmarshalTarget{})
+	plan := getDecoderPlan(targetType)
+	require.Len(t, plan, 2)
+	assert.Equal(t, "a", plan[0].tag)
+	assert.Equal(t, "b", plan[1].tag)
+	cachedPlan, ok := decoderPlans.Load(targetType)
+	require.True(t, ok, "plan should be in cache")
+	assert.Len(t, cachedPlan.(decoderPlan), 2)
+}
+
+type benchmarkTarget struct {
+	A int       `kafka:"a"`
+	B int64     `kafka:"b"`
+	C uint32    `kafka:"c"`
+	D bool      `kafka:"d"`
+	E string    `kafka:"e"`
+	F float64   `kafka:"f"`
+	G time.Time `kafka:"g"`
+	H string    `kafka:"h"`
+}
+
+func benchmarkMessage() map[string]interface{} {
+	return map[string]interface{}{
+		"a": int32(1),
+		"b": int64(2),
+		"c": int32(3),
+		"d": true,
+		"e": "abc",
+		"f": float64(1.5),
+		"g": int64(1522083600000),
+		"h": map[string]interface{}{"string": "nullable"},
+	}
+}
+
+// Benchmark unmarshaling with the decoder plan cache warm, which is the
+// steady state of a running consumer
+func BenchmarkUnmarshalMap(b *testing.B) {
+	message := benchmarkMessage()
+	messageDecoder := kafkaMessageDecoder{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target := &benchmarkTarget{}
+		messageDecoder.unmarshalKafkaMessageMap(message, target)
+	}
+}
+
+// Benchmark unmarshaling while compiling the decoder plan for every message,
+// which is equivalent to walking the struct with reflection on each call
+func BenchmarkUnmarshalMap_Uncached(b *testing.B) {
+	message := benchmarkMessage()
+	messageDecoder := kafkaMessageDecoder{}
+	targetType := reflect.TypeOf(benchmarkTarget{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decoderPlans.Delete(targetType)
+		target := &benchmarkTarget{}
+		messageDecoder.unmarshalKafkaMessageMap(message, target)
+	}
+}
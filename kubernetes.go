@@ -107,6 +107,19 @@ func (kc *KubernetesConfig) Init() error {
 	return nil
 }
 
+// HealthCheck returns a critical readiness check that fails when the
+// Kubernetes API server can't be reached. Init must be called first.
+func (kc *KubernetesConfig) HealthCheck() HealthCheck {
+	return HealthCheck{
+		Name:     "kubernetes",
+		Critical: true,
+		Check: func(_ context.Context) error {
+			_, err := kc.clientset.Discovery().ServerVersion()
+			return err
+		},
+	}
+}
+
 // WatchPods creates a Pod event handler channel and returns the changes to the caller. Callers
 // may subscribe to the Pods channel to watch for changes within Kubernetes.
 func (kc *KubernetesConfig) WatchPods(ctx context.Context, cancel context.CancelFunc) chan PodEvent {
@@ -82,3 +82,10 @@ func TestWatchServicesAdd(t *testing.T) {
 		assert.Fail(t, "Informer did not receive the added service in 50ms")
 	}
 }
+
+func TestKubernetesHealthCheck(t *testing.T) {
+	kc := newKubernetesConfig()
+	check := kc.HealthCheck()
+	assert.Equal(t, "kubernetes", check.Name)
+	assert.NoError(t, check.Check(context.Background()))
+}
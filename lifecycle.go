@@ -0,0 +1,271 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultLifecycleStopTimeout = 5 * time.Second
+
+// LifecycleComponent is a part of a service that is started and stopped by
+// a Lifecycle, such as an HTTP server, a Kafka consumer or producer, or a
+// custom goroutine. All functions are optional.
+type LifecycleComponent struct {
+	Name string
+	// DependsOn names the components that are started before this component
+	// and stopped after it
+	DependsOn []string
+	// Start is called once the components this component depends on have
+	// started, and must return once the component has started. The context
+	// is cancelled when the component is stopped, or if the lifecycle is
+	// shut down while the component is starting. Errors are fatal unless
+	// the lifecycle is shutting down.
+	Start func(ctx context.Context) error
+	// Run is called in its own goroutine once the component has started,
+	// and should return once the context is cancelled. Returning an error
+	// before the context is cancelled is fatal.
+	Run func(ctx context.Context) error
+	// Stop is called when the component is stopped, after its context is
+	// cancelled and Run has returned
+	Stop func(ctx context.Context) error
+	// StopTimeout is how long Run and Stop are each given to return when the
+	// component is stopped. Defaults to 5 seconds.
+	StopTimeout time.Duration
+}
+
+// Lifecycle starts the components of a service in dependency order and stops
+// them in reverse order, either when the service receives SIGINT or SIGTERM,
+// when the context of Run is done, or when any component fails fatally. The
+// zero value is ready to use.
+type Lifecycle struct {
+	components []LifecycleComponent
+}
+
+// runningComponent is a component that has been started by a Lifecycle
+type runningComponent struct {
+	LifecycleComponent
+	cancel context.CancelFunc
+	// done is closed when Run returns
+	done chan struct{}
+}
+
+// Add registers a component. Component names must be unique.
+func (l *Lifecycle) Add(component LifecycleComponent) error {
+	if component.Name == "" {
+		return fmt.Errorf("lifecycle components require a name")
+	}
+	for _, added := range l.components {
+		if added.Name == component.Name {
+			return fmt.Errorf("lifecycle component %s is already added", component.Name)
+		}
+	}
+	if component.StopTimeout == 0 {
+		component.StopTimeout = defaultLifecycleStopTimeout
+	}
+	l.components = append(l.components, component)
+	return nil
+}
+
+// order returns the components sorted so that each component comes after
+// the components it depends on. Otherwise, components are kept in the order
+// they were added.
+func (l *Lifecycle) order() ([]LifecycleComponent, error) {
+	byName := make(map[string]LifecycleComponent, len(l.components))
+	for _, component := range l.components {
+		byName[component.Name] = component
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(l.components))
+	ordered := make([]LifecycleComponent, 0, len(l.components))
+	var visit func(component LifecycleComponent) error
+	visit = func(component LifecycleComponent) error {
+		switch state[component.Name] {
+		case visiting:
+			return fmt.Errorf("lifecycle component %s has a circular dependency", component.Name)
+		case visited:
+			return nil
+		}
+		state[component.Name] = visiting
+		for _, name := range component.DependsOn {
+			dependency, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("lifecycle component %s depends on unknown component %s", component.Name, name)
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		state[component.Name] = visited
+		ordered = append(ordered, component)
+		return nil
+	}
+	for _, component := range l.components {
+		if err := visit(component); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// Run starts all components and blocks until they have been stopped. Run
+// returns the error of the component that failed fatally, or nil if the
+// components were stopped because of a signal or the context being done.
+func (l *Lifecycle) Run(ctx context.Context) error {
+	ordered, err := l.order()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Kubernetes sends SIGTERM to stop pods
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case received := <-signals:
+			Logger.Info("Received signal, shutting down", zap.String("signal", received.String()))
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	fatal := make(chan error, len(ordered))
+	running := make([]*runningComponent, 0, len(ordered))
+	var runErr error
+	for _, component := range ordered {
+		if ctx.Err() != nil {
+			break
+		}
+		rc, err := startComponent(ctx, component, fatal)
+		if err != nil {
+			// starts interrupted by shutting down aren't failures
+			if ctx.Err() == nil {
+				runErr = err
+			}
+			break
+		}
+		running = append(running, rc)
+	}
+	if runErr == nil {
+		select {
+		case <-ctx.Done():
+		case runErr = <-fatal:
+		}
+	}
+	if runErr != nil {
+		Logger.Error("Lifecycle component failed, shutting down", zap.Error(runErr))
+	}
+
+	// stop components in reverse order so that components are stopped
+	// before the components they depend on
+	for i := len(running) - 1; i >= 0; i-- {
+		running[i].stop()
+	}
+	return runErr
+}
+
+// startComponent starts a component and runs it in a goroutine, sending to
+// fatal if Run fails before the component is stopped. Start is cancelled if
+// the lifecycle context is done before it returns.
+func startComponent(
+	lifecycleCtx context.Context,
+	component LifecycleComponent,
+	fatal chan<- error,
+) (*runningComponent, error) {
+	// components are given their own context so that they can be stopped
+	// one at a time
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &runningComponent{LifecycleComponent: component, cancel: cancel}
+	Logger.Info("Starting lifecycle component", zap.String("component", component.Name))
+	if component.Start != nil {
+		started := make(chan struct{})
+		go func() {
+			select {
+			case <-lifecycleCtx.Done():
+				cancel()
+			case <-started:
+			}
+		}()
+		err := component.Start(ctx)
+		close(started)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("unable to start %s: %s", component.Name, err.Error())
+		}
+	}
+	if component.Run != nil {
+		rc.done = make(chan struct{})
+		go func() {
+			defer close(rc.done)
+			defer func() {
+				if r := recover(); r != nil {
+					fatal <- fmt.Errorf("%s panicked: %v", component.Name, r)
+				}
+			}()
+			err := component.Run(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				fatal <- fmt.Errorf("%s failed: %s", component.Name, err.Error())
+				return
+			}
+			Logger.Info("Lifecycle component finished", zap.String("component", component.Name))
+		}()
+	}
+	return rc, nil
+}
+
+// stop cancels the context of the component, waits for Run to return, and
+// calls Stop, logging failures
+func (rc *runningComponent) stop() {
+	start := time.Now()
+	Logger.Info("Stopping lifecycle component", zap.String("component", rc.Name))
+	rc.cancel()
+	if rc.done != nil {
+		select {
+		case <-rc.done:
+		case <-time.After(rc.StopTimeout):
+			Logger.Error(
+				"Lifecycle component did not stop in time", zap.String("component", rc.Name),
+				zap.Duration("timeout", rc.StopTimeout))
+		}
+	}
+	if rc.Stop != nil {
+		hook := ShutdownHook{Name: rc.Name, Hook: rc.Stop, Timeout: rc.StopTimeout}
+		if err := hook.run(); err != nil {
+			Logger.Error(
+				"Unable to stop lifecycle component", zap.String("component", rc.Name),
+				zap.Duration("duration", time.Since(start)), zap.Error(err))
+			return
+		}
+	}
+	Logger.Info(
+		"Lifecycle component stopped", zap.String("component", rc.Name),
+		zap.Duration("duration", time.Since(start)))
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventLog records lifecycle events from multiple goroutines
+type eventLog struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (el *eventLog) add(event string) {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	el.events = append(el.events, event)
+}
+
+func (el *eventLog) get() []string {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	return append([]string{}, el.events...)
+}
+
+// recordingComponent returns a component that records when it starts and
+// stops, and runs until its context is cancelled
+func recordingComponent(name string, log *eventLog, dependsOn ...string) LifecycleComponent {
+	return LifecycleComponent{
+		Name:      name,
+		DependsOn: dependsOn,
+		Start: func(context.Context) error {
+			log.add("start " + name)
+			return nil
+		},
+		Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		},
+		Stop: func(context.Context) error {
+			log.add("stop " + name)
+			return nil
+		},
+	}
+}
+
+func TestLifecycle_Add(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	require.NoError(t, lifecycle.Add(LifecycleComponent{Name: "kafka-consumer"}))
+	assert.Error(t, lifecycle.Add(LifecycleComponent{Name: "kafka-consumer"}))
+	assert.Error(t, lifecycle.Add(LifecycleComponent{}))
+	assert.Equal(t, defaultLifecycleStopTimeout, lifecycle.components[0].StopTimeout)
+}
+
+func TestLifecycle_Order(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	log := &eventLog{}
+	require.NoError(t, lifecycle.Add(recordingComponent("http-server", log, "kafka-consumer")))
+	require.NoError(t, lifecycle.Add(recordingComponent("kafka-consumer", log, "kafka-producer")))
+	require.NoError(t, lifecycle.Add(recordingComponent("kafka-producer", log)))
+	require.NoError(t, lifecycle.Add(recordingComponent("watcher", log)))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	require.NoError(t, lifecycle.Run(ctx))
+	assert.Equal(t, []string{
+		"start kafka-producer", "start kafka-consumer", "start http-server", "start watcher",
+		"stop watcher", "stop http-server", "stop kafka-consumer", "stop kafka-producer",
+	}, log.get())
+}
+
+func TestLifecycle_InvalidDependencies(t *testing.T) {
+	unknown := &Lifecycle{}
+	require.NoError(t, unknown.Add(LifecycleComponent{Name: "http-server", DependsOn: []string{"postgres"}}))
+	assert.Error(t, unknown.Run(context.Background()))
+
+	circular := &Lifecycle{}
+	require.NoError(t, circular.Add(LifecycleComponent{Name: "a", DependsOn: []string{"b"}}))
+	require.NoError(t, circular.Add(LifecycleComponent{Name: "b", DependsOn: []string{"a"}}))
+	assert.Error(t, circular.Run(context.Background()))
+}
+
+func TestLifecycle_FatalError(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	log := &eventLog{}
+	require.NoError(t, lifecycle.Add(recordingComponent("kafka-consumer", log)))
+	require.NoError(t, lifecycle.Add(LifecycleComponent{
+		Name: "worker",
+		Run: func(context.Context) error {
+			return fmt.Errorf("flavortown")
+		},
+	}))
+	err := lifecycle.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "flavortown")
+	assert.Equal(t, []string{"start kafka-consumer", "stop kafka-consumer"}, log.get())
+}
+
+func TestLifecycle_StartError(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	log := &eventLog{}
+	require.NoError(t, lifecycle.Add(recordingComponent("kafka-producer", log)))
+	require.NoError(t, lifecycle.Add(LifecycleComponent{
+		Name:  "kafka-consumer",
+		Start: func(context.Context) error { return fmt.Errorf("no brokers") },
+		Stop: func(context.Context) error {
+			log.add("stop kafka-consumer")
+			return nil
+		},
+	}))
+	require.NoError(t, lifecycle.Add(recordingComponent("http-server", log)))
+	err := lifecycle.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no brokers")
+	// components that didn't start aren't started or stopped
+	assert.Equal(t, []string{"start kafka-producer", "stop kafka-producer"}, log.get())
+}
+
+func TestLifecycle_CancelStart(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	log := &eventLog{}
+	require.NoError(t, lifecycle.Add(recordingComponent("kafka-producer", log)))
+	require.NoError(t, lifecycle.Add(LifecycleComponent{
+		Name: "kafka-consumer",
+		// e.g. waiting for brokers to become available
+		Start: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}))
+	require.NoError(t, lifecycle.Add(recordingComponent("http-server", log)))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	// a start interrupted by shutting down isn't a failure
+	assert.NoError(t, lifecycle.Run(ctx))
+	assert.Equal(t, []string{"start kafka-producer", "stop kafka-producer"}, log.get())
+}
+
+func TestLifecycle_Panic(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	require.NoError(t, lifecycle.Add(LifecycleComponent{
+		Name: "worker",
+		Run:  func(context.Context) error { panic("flavortown") },
+	}))
+	err := lifecycle.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "panicked")
+}
+
+func TestLifecycle_StopTimeout(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	blocked := make(chan struct{})
+	defer close(blocked)
+	require.NoError(t, lifecycle.Add(LifecycleComponent{
+		Name: "stuck",
+		// a component that ignores its context doesn't block shutdown
+		Run: func(context.Context) error {
+			<-blocked
+			return nil
+		},
+		Stop: func(context.Context) error {
+			<-blocked
+			return nil
+		},
+		StopTimeout: 10 * time.Millisecond,
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	assert.NoError(t, lifecycle.Run(ctx))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestHTTPServerConfig_LifecycleComponent(t *testing.T) {
+	config := &HTTPServerConfig{Address: "localhost", Port: freePort(t), Name: "test"}
+	stopped := make(chan struct{})
+	config.AddShutdownHook(ShutdownHook{Name: "test", Hook: func(context.Context) error {
+		close(stopped)
+		return nil
+	}})
+	lifecycle := &Lifecycle{}
+	require.NoError(t, lifecycle.Add(config.LifecycleComponent(nil, nil, nil)))
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- lifecycle.Run(ctx) }()
+	waitForHTTP(t, fmt.Sprintf("http://localhost:%d/health", config.Port))
+	cancel()
+	require.NoError(t, <-errs)
+	<-stopped
+
+	// a server that can't listen fails the lifecycle
+	listening := &HTTPServerConfig{Address: "localhost", Port: freePort(t), Name: "test"}
+	conflicting := &HTTPServerConfig{Address: "localhost", Port: listening.Port, Name: "test"}
+	lifecycle = &Lifecycle{}
+	require.NoError(t, lifecycle.Add(listening.LifecycleComponent(nil, nil, nil)))
+	component := conflicting.LifecycleComponent(nil, nil, nil)
+	component.Name = "conflicting"
+	component.DependsOn = []string{"http-server"}
+	component.Start = func(context.Context) error {
+		// wait for the first server to listen
+		waitForHTTP(t, fmt.Sprintf("http://localhost:%d/health", listening.Port))
+		return nil
+	}
+	require.NoError(t, lifecycle.Add(component))
+	err := lifecycle.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "conflicting")
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/health", listening.Port))
+	if err == nil {
+		resp.Body.Close()
+	}
+	assert.Error(t, err, "servers are shut down after a failure")
+}
@@ -15,6 +15,7 @@
 package tools
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -93,6 +94,23 @@ func (lc *LoggingConfig) InitializeLogger() {
 	SugaredLogger = Logger.Sugar()
 }
 
+type loggerContextKey struct{}
+
+// ContextWithLogger returns a copy of the context holding the logger, e.g. a
+// child of Logger with fields identifying a request
+func ContextWithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// LoggerFromContext returns the logger held by the context, or Logger if the
+// context doesn't hold a logger
+func LoggerFromContext(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return Logger
+}
+
 // CreateStdLogger returns a standard-library compatible logger
 func CreateStdLogger(zapLogger *zap.Logger, logLevel string) (*log.Logger, error) {
 	switch {
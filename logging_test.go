@@ -0,0 +1,37 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLoggerFromContext(t *testing.T) {
+	logs, restore := observeLogs()
+	defer restore()
+	ctx := context.Background()
+	assert.True(t, LoggerFromContext(ctx) == Logger)
+
+	ctx = ContextWithLogger(ctx, Logger.With(zap.String("request_id", "flavortown")))
+	LoggerFromContext(ctx).Info("Flavortown")
+	entries := logs.All()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "flavortown", entries[0].ContextMap()["request_id"])
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/newrelic/go-agent"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// NewRelicConfig defines the necessary configuration for reporting HTTP
+// transactions to New Relic. New Relic is disabled if LicenseKey is empty.
+type NewRelicConfig struct {
+	LicenseKey string
+	AppName    string
+}
+
+// NewApplication starts a New Relic application that reports to New Relic
+// in the background, or returns nil if New Relic is disabled
+func (nrc *NewRelicConfig) NewApplication() (newrelic.Application, error) {
+	if nrc.LicenseKey == "" {
+		Logger.Info("New Relic disabled")
+		return nil, nil
+	}
+	config := newrelic.NewConfig(nrc.AppName, nrc.LicenseKey)
+	config.Logger = newRelicLogger{Logger.Named("newrelic")}
+	application, err := newrelic.NewApplication(config)
+	if err != nil {
+		return nil, err
+	}
+	Logger.Info("Started New Relic application", zap.String("app_name", nrc.AppName))
+	return application, nil
+}
+
+// newRelicLogger logs New Relic agent logs with zap
+type newRelicLogger struct {
+	logger *zap.Logger
+}
+
+func (nrl newRelicLogger) Error(msg string, context map[string]interface{}) {
+	nrl.logger.Error(msg, zap.Any("context", context))
+}
+
+func (nrl newRelicLogger) Warn(msg string, context map[string]interface{}) {
+	nrl.logger.Warn(msg, zap.Any("context", context))
+}
+
+func (nrl newRelicLogger) Info(msg string, context map[string]interface{}) {
+	nrl.logger.Info(msg, zap.Any("context", context))
+}
+
+func (nrl newRelicLogger) Debug(msg string, context map[string]interface{}) {
+	nrl.logger.Debug(msg, zap.Any("context", context))
+}
+
+func (nrl newRelicLogger) DebugEnabled() bool {
+	return nrl.logger.Core().Enabled(zapcore.DebugLevel)
+}
+
+// NewRelicMiddleware reports requests as transactions of the New Relic
+// application, placing the transaction in the request context. Transactions
+// are named by the method and route template of the request and record the
+// response status. Requests are passed through if application is nil.
+func NewRelicMiddleware(application newrelic.Application) HTTPMiddleware {
+	return func(next http.Handler) http.Handler {
+		if application == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w, r, state := httpRequestStateFor(w, r)
+			// the transaction records the response status as it is written
+			transaction := application.StartTransaction(r.URL.Path, w, r)
+			defer func() {
+				transaction.SetName(fmt.Sprintf("%s %s", r.Method, state.pathLabel(r)))
+				if err := transaction.End(); err != nil {
+					Logger.Debug("Unable to end New Relic transaction", zap.Error(err))
+				}
+			}()
+			r = r.WithContext(context.WithValue(r.Context(), newRelicTransactionContextKey{}, transaction))
+			next.ServeHTTP(&newRelicResponseWriter{Transaction: transaction, writer: w}, r)
+		})
+	}
+}
+
+// newRelicResponseWriter writes responses through a New Relic transaction,
+// and flushes, hijacks, and pushes through the writer the transaction
+// wraps, since transactions don't support all of these
+type newRelicResponseWriter struct {
+	newrelic.Transaction
+	writer http.ResponseWriter
+}
+
+func (nrrw *newRelicResponseWriter) Flush() {
+	flushHTTPResponse(nrrw.writer)
+}
+
+func (nrrw *newRelicResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijackHTTPResponse(nrrw.writer)
+}
+
+func (nrrw *newRelicResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return pushHTTPResponse(nrrw.writer, target, opts)
+}
+
+type newRelicTransactionContextKey struct{}
+
+// NewRelicTransactionFromContext returns the New Relic transaction of the
+// request the context belongs to, or nil if New Relic is disabled
+func NewRelicTransactionFromContext(ctx context.Context) newrelic.Transaction {
+	transaction, _ := ctx.Value(newRelicTransactionContextKey{}).(newrelic.Transaction)
+	return transaction
+}
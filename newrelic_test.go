@@ -0,0 +1,110 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/newrelic/go-agent"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubNewRelicApplication records the transactions it starts
+type stubNewRelicApplication struct {
+	newrelic.Application
+	transactions []*stubNewRelicTransaction
+}
+
+func (app *stubNewRelicApplication) StartTransaction(
+	name string, w http.ResponseWriter, r *http.Request,
+) newrelic.Transaction {
+	transaction := &stubNewRelicTransaction{name: name, w: w}
+	app.transactions = append(app.transactions, transaction)
+	return transaction
+}
+
+// stubNewRelicTransaction records the status written through it
+type stubNewRelicTransaction struct {
+	newrelic.Transaction
+	w      http.ResponseWriter
+	name   string
+	status int
+	ended  bool
+}
+
+func (txn *stubNewRelicTransaction) Header() http.Header {
+	return txn.w.Header()
+}
+
+func (txn *stubNewRelicTransaction) Write(b []byte) (int, error) {
+	if txn.status == 0 {
+		txn.status = http.StatusOK
+	}
+	return txn.w.Write(b)
+}
+
+func (txn *stubNewRelicTransaction) WriteHeader(code int) {
+	txn.status = code
+	txn.w.WriteHeader(code)
+}
+
+func (txn *stubNewRelicTransaction) SetName(name string) error {
+	txn.name = name
+	return nil
+}
+
+func (txn *stubNewRelicTransaction) End() error {
+	txn.ended = true
+	return nil
+}
+
+func TestNewRelicConfig_NewApplication(t *testing.T) {
+	application, err := (&NewRelicConfig{AppName: "test"}).NewApplication()
+	assert.NoError(t, err)
+	assert.Nil(t, application)
+
+	_, err = (&NewRelicConfig{AppName: "test", LicenseKey: "flavortown"}).NewApplication()
+	assert.Error(t, err)
+}
+
+func TestHTTPMonitoringHandler_NewRelic(t *testing.T) {
+	application := &stubNewRelicApplication{}
+	var transaction newrelic.Transaction
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
+		transaction = NewRelicTransactionFromContext(r.Context())
+		w.WriteHeader(http.StatusCreated)
+	})
+	handler := newHTTPMonitoringHandler(mux, nil, initHTTPMetrics("test", prometheus.NewRegistry()), application, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/users/123", nil))
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	require.Len(t, application.transactions, 1)
+	started := application.transactions[0]
+	assert.True(t, transaction == started)
+	assert.Equal(t, "POST /users/", started.name)
+	assert.Equal(t, http.StatusCreated, started.status)
+	assert.True(t, started.ended)
+
+	// without an application, there is no transaction
+	handler = newHTTPMonitoringHandler(mux, nil, initHTTPMetrics("test", prometheus.NewRegistry()), nil, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/users/123", nil))
+	assert.Nil(t, transaction)
+}
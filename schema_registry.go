@@ -16,95 +16,516 @@ package tools
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/linkedin/goavro"
 	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
+var (
+	// ErrNotAvroWireFormat is returned when unmarshaling a message that is too
+	// short to be in the Schema Registry wire format or that doesn't start
+	// with the magic byte
+	ErrNotAvroWireFormat = errors.New("kafka message is not in the Avro wire format")
+	// ErrUnknownSchemaID is returned when unmarshaling a message whose schema
+	// id is not registered in Schema Registry
+	ErrUnknownSchemaID = errors.New("unknown Avro schema id")
+)
+
+// avroWireFormatHeaderLength is the length of the magic byte and schema id
+// that precede every Avro message in the Schema Registry wire format
+const avroWireFormatHeaderLength = 5
+
 type kafkaSchemaRegistryClient interface {
-	getSchema(ctx context.Context, schemaID int, schemaRegistryURL string) (string, error)
+	getSchema(ctx context.Context, schemaID int) (string, error)
+	registerSchema(ctx context.Context, subject, schema string) (int, error)
+	lookupSchema(ctx context.Context, subject, schema string) (int, error)
 }
 
-type schemaRegistryClient struct{}
-
 // SchemaRegistryConfig defines the necessary configuration for interacting with Schema Registry
 type SchemaRegistryConfig struct {
-	SchemaRegistryURL  string
-	schemas            sync.Map
-	client             kafkaSchemaRegistryClient
-	messageUnmarshaler kafkaMessageUnmarshaler
+	SchemaRegistryURL string
+	Username          string
+	Password          string
+	BearerToken       string
+	TLSCaCrtPath      string
+	TLSCrtPath        string
+	TLSKeyPath        string
+	// Timeout is the total time allowed for each request to Schema
+	// Registry. Defaults to 10 seconds if not set.
+	Timeout      time.Duration
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// SchemaCacheDir is an optional directory in which fetched schemas are
+	// persisted. Cached schemas are loaded at startup so that messages can
+	// be decoded while Schema Registry is unavailable.
+	SchemaCacheDir string
+	// SchemaCacheMaxBytes is the maximum total size of the schemas in
+	// SchemaCacheDir. If 0, the cache size is unlimited.
+	SchemaCacheMaxBytes int64
+	// ReaderSchema is an optional Avro schema that messages are resolved
+	// into before they are unmarshaled, using the Avro schema resolution
+	// rules. This lets consumers read messages written with older or newer
+	// versions of a schema, filling in defaults for fields the writer did
+	// not know about.
+	ReaderSchema string
+	// ReaderSchemaFromTarget derives the reader schema from the type of the
+	// unmarshal target with GenerateAvroSchema when ReaderSchema is not set.
+	// Fields that are neither pointers nor have an avro_default tag must be
+	// present in every message.
+	ReaderSchemaFromTarget bool
+	// SubjectNameStrategy determines the subjects under which schemas are
+	// registered when marshaling messages. Defaults to TopicNameStrategy.
+	SubjectNameStrategy SubjectNameStrategy
+	// TopicSubjectNameStrategies overrides SubjectNameStrategy for topics
+	TopicSubjectNameStrategies map[string]SubjectNameStrategy
+	// AutoRegisterSchemas registers schemas under their subject when
+	// marshaling messages. If false, schemas must already be registered.
+	AutoRegisterSchemas bool
+	schemaIDs           sync.Map
+	recordNames         sync.Map
+	readerSchemas       sync.Map
+	diskCache           *schemaDiskCache
+	codecs              sync.Map
+	fetchesMutex        sync.Mutex
+	fetches             map[uint32]*codecFetch
+	client              kafkaSchemaRegistryClient
+	messageUnmarshaler  kafkaMessageUnmarshaler
+	marshalInit         sync.Once
+	marshalInitErr      error
+	schemaRegistryMetrics
 }
 
-func (src *schemaRegistryClient) getSchema(ctx context.Context, schemaID int, schemaRegistryURL string) (string, error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "get-avro-schema")
-	defer span.Finish()
-	endpoint := fmt.Sprintf("%s/schemas/ids/%d", schemaRegistryURL, schemaID)
-	response, err := http.Get(endpoint)
+type schemaRegistryMetrics struct {
+	cacheHits     prometheus.Counter
+	cacheMisses   prometheus.Counter
+	fetchDuration prometheus.Histogram
+}
+
+// codecFetch is an in-flight request for a schema from Schema Registry that
+// concurrent lookups for the same schema id wait on
+type codecFetch struct {
+	wg    sync.WaitGroup
+	codec *avroCodec
+	err   error
+}
+
+// avroCodec is a compiled Avro codec along with the schema it was compiled
+// from, which is parsed on first use for schema resolution and for
+// converting decoded values
+type avroCodec struct {
+	*goavro.Codec
+	schema       string
+	parseOnce    sync.Once
+	parsedSchema *avroSchema
+	parseErr     error
+}
+
+func newAvroCodec(schema string) (*avroCodec, error) {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &avroCodec{Codec: codec, schema: schema}, nil
+}
+
+// writerSchema returns the parsed schema of the codec
+func (ac *avroCodec) writerSchema() (*avroSchema, error) {
+	ac.parseOnce.Do(func() {
+		ac.parsedSchema, ac.parseErr = parseAvroSchema(ac.schema)
+	})
+	return ac.parsedSchema, ac.parseErr
+}
+
+func (src *SchemaRegistryConfig) initSchemaRegistryMetrics(registry prometheus.Registerer) {
+	src.cacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_schema_registry_cache_hits_total",
+			Help: "Number of Avro codec lookups served from cache",
+		},
+	)
+	src.cacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_schema_registry_cache_misses_total",
+			Help: "Number of Avro codec lookups that were not in cache",
+		},
+	)
+	src.fetchDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "kafka_schema_registry_fetch_duration_seconds",
+			Help:    "Duration of schema requests to Schema Registry",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2.0, 16),
+		},
+	)
+	src.cacheHits = registerSchemaRegistryCollector(registry, src.cacheHits).(prometheus.Counter)
+	src.cacheMisses = registerSchemaRegistryCollector(registry, src.cacheMisses).(prometheus.Counter)
+	src.fetchDuration = registerSchemaRegistryCollector(registry, src.fetchDuration).(prometheus.Histogram)
+}
+
+// registerSchemaRegistryCollector registers a collector, returning the
+// collector already registered by another config in the same process, such
+// as the config for keys, if there is one
+func registerSchemaRegistryCollector(
+	registry prometheus.Registerer,
+	collector prometheus.Collector,
+) prometheus.Collector {
+	if err := registry.Register(collector); err != nil {
+		if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return registered.ExistingCollector
+		}
+		panic(err)
+	}
+	return collector
+}
+
+// defaultSchemaRegistryTimeout is used when no timeout is configured
+const defaultSchemaRegistryTimeout = 10 * time.Second
+
+// NewClient creates a Schema Registry client using the authentication, TLS,
+// timeout, and retry settings in the config
+func (src *SchemaRegistryConfig) NewClient() (*SchemaRegistryClient, error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if (src.TLSCrtPath == "") != (src.TLSKeyPath == "") {
+		return nil, fmt.Errorf("both a Schema Registry client TLS certificate and key are required")
+	}
+	if src.TLSCaCrtPath != "" || src.TLSCrtPath != "" {
+		tlsConfig := &tls.Config{}
+		if src.TLSCrtPath != "" {
+			cer, err := tls.LoadX509KeyPair(src.TLSCrtPath, src.TLSKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load Schema Registry client TLS certificates: %s", err.Error())
+			}
+			tlsConfig.Certificates = []tls.Certificate{cer}
+		}
+		if src.TLSCaCrtPath != "" {
+			caCert, err := ioutil.ReadFile(src.TLSCaCrtPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load Schema Registry CA certificate: %s", err.Error())
+			}
+			caCertPool := x509.NewCertPool()
+			if !caCertPool.AppendCertsFromPEM(caCert) {
+				return nil, fmt.Errorf("no certificates found in Schema Registry CA certificate %s", src.TLSCaCrtPath)
+			}
+			tlsConfig.RootCAs = caCertPool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	timeout := src.Timeout
+	if timeout == 0 {
+		timeout = defaultSchemaRegistryTimeout
+	}
+	client := NewSchemaRegistryClient(src.SchemaRegistryURL)
+	client.HTTPClient = &http.Client{Transport: transport, Timeout: timeout}
+	client.Username = src.Username
+	client.Password = src.Password
+	client.BearerToken = src.BearerToken
+	client.MaxRetries = src.MaxRetries
+	client.RetryBackoff = src.RetryBackoff
+	return client, nil
+}
+
+// Init prepares the config for decoding and encoding Avro messages outside
+// of a KafkaConsumer. If SchemaRegistryURL is empty and SchemaCacheDir is
+// set, schemas are read from the cache directory instead of Schema Registry,
+// as <schema id>.avsc files.
+func (src *SchemaRegistryConfig) Init() error {
+	return src.initialize(&kafkaMessageDecoder{})
+}
+
+// initialize prepares the config for unmarshaling Avro messages
+func (src *SchemaRegistryConfig) initialize(messageUnmarshaler kafkaMessageUnmarshaler) error {
+	if src.messageUnmarshaler == nil {
+		src.messageUnmarshaler = messageUnmarshaler
+	}
+	if src.client != nil {
+		// already initialized for another consumer or for keys
+		return nil
+	}
+	offline := src.SchemaRegistryURL == "" && src.SchemaCacheDir != ""
+	if offline {
+		// the cache directory stands in for Schema Registry, and schemas are
+		// read from it on demand rather than preloaded and evicted
+		src.client = &localSchemaRegistryClient{dir: src.SchemaCacheDir}
+	} else {
+		client, err := src.NewClient()
+		if err != nil {
+			return err
+		}
+		src.client = client
+	}
+	if src.cacheHits == nil {
+		src.initSchemaRegistryMetrics(prometheus.DefaultRegisterer)
+	}
+	if src.ReaderSchema != "" {
+		if _, err := src.readerSchema(nil); err != nil {
+			return err
+		}
+	}
+	if src.SchemaCacheDir != "" && !offline {
+		return src.loadDiskCache()
+	}
+	return nil
+}
+
+// readerSchema returns the parsed schema that messages unmarshaled into the
+// target should be resolved into, or nil if messages should be unmarshaled
+// as they were written
+func (src *SchemaRegistryConfig) readerSchema(target interface{}) (*avroSchema, error) {
+	var key interface{}
+	switch {
+	case src.ReaderSchema != "":
+		key = src.ReaderSchema
+	case src.ReaderSchemaFromTarget && target != nil:
+		key = reflect.TypeOf(target)
+	default:
+		return nil, nil
+	}
+	if schema, ok := src.readerSchemas.Load(key); ok {
+		return schema.(*avroSchema), nil
+	}
+	var schema *avroSchema
+	var err error
+	if src.ReaderSchema != "" {
+		schema, err = parseAvroSchema(src.ReaderSchema)
+	} else {
+		var generated string
+		if generated, err = generateAvroSchema(reflect.TypeOf(target).Elem(), ""); err == nil {
+			schema, err = parseAvroSchema(generated)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro reader schema: %s", err.Error())
+	}
+	src.readerSchemas.Store(key, schema)
+	return schema, nil
+}
+
+// loadDiskCache opens the schema cache directory and compiles all cached
+// schemas into the in-memory codec cache
+func (src *SchemaRegistryConfig) loadDiskCache() error {
+	diskCache, err := newSchemaDiskCache(src.SchemaCacheDir, src.SchemaCacheMaxBytes)
+	if err != nil {
+		return err
+	}
+	schemas, err := diskCache.load()
+	if err != nil {
+		return fmt.Errorf("failed to load schema cache directory %s: %s", src.SchemaCacheDir, err.Error())
+	}
+	for schemaID, schema := range schemas {
+		codec, err := newAvroCodec(schema)
+		if err != nil {
+			Logger.Warn(
+				"Unable to compile cached schema, ignoring",
+				zap.Uint32("schema_id", schemaID), zap.Error(err))
+			continue
+		}
+		src.codecs.Store(schemaID, codec)
+	}
+	Logger.Info(
+		"Loaded cached schemas",
+		zap.String("dir", src.SchemaCacheDir), zap.Int("schemas", len(schemas)))
+	src.diskCache = diskCache
+	return nil
+}
+
+// getCodec returns the compiled Avro codec for a schema id. Codecs are
+// cached after the first lookup; concurrent lookups of a schema that is not
+// yet cached share a single request to Schema Registry.
+func (src *SchemaRegistryConfig) getCodec(ctx context.Context, schemaID uint32) (*avroCodec, error) {
+	if codec, ok := src.codecs.Load(schemaID); ok {
+		if src.cacheHits != nil {
+			src.cacheHits.Inc()
+		}
+		return codec.(*avroCodec), nil
+	}
+	if src.cacheMisses != nil {
+		src.cacheMisses.Inc()
+	}
+
+	src.fetchesMutex.Lock()
+	// the codec may have been cached while waiting for the lock
+	if codec, ok := src.codecs.Load(schemaID); ok {
+		src.fetchesMutex.Unlock()
+		return codec.(*avroCodec), nil
+	}
+	if fetch, ok := src.fetches[schemaID]; ok {
+		src.fetchesMutex.Unlock()
+		fetch.wg.Wait()
+		return fetch.codec, fetch.err
+	}
+	if src.fetches == nil {
+		src.fetches = make(map[uint32]*codecFetch)
+	}
+	fetch := &codecFetch{}
+	fetch.wg.Add(1)
+	src.fetches[schemaID] = fetch
+	src.fetchesMutex.Unlock()
+
+	fetch.codec, fetch.err = src.fetchCodec(ctx, schemaID)
+	if fetch.err == nil {
+		src.codecs.Store(schemaID, fetch.codec)
+	}
+	fetch.wg.Done()
+
+	src.fetchesMutex.Lock()
+	delete(src.fetches, schemaID)
+	src.fetchesMutex.Unlock()
+	return fetch.codec, fetch.err
+}
+
+// fetchCodec requests a schema from Schema Registry and compiles it
+func (src *SchemaRegistryConfig) fetchCodec(ctx context.Context, schemaID uint32) (*avroCodec, error) {
+	Logger.Info(
+		"Schema not in cache, requesting from schema schema registry and caching",
+		zap.Uint32("schema_id", schemaID))
+	var timer *prometheus.Timer
+	if src.fetchDuration != nil {
+		timer = prometheus.NewTimer(src.fetchDuration)
+	}
+	schema, err := src.client.getSchema(ctx, int(schemaID))
+	if timer != nil {
+		timer.ObserveDuration()
+	}
 	if err != nil {
 		Logger.Error(
-			"Error getting schema from schema registry",
-			zap.Int("schema_id", schemaID), zap.Error(err))
-		return "", err
+			"Error getting schema from schema schemaRegistry",
+			zap.Error(err), zap.Uint32("schema_id", schemaID))
+		return nil, err
 	}
-	var schemaResponse struct {
-		Schema *string `json:"schema"`
+	codec, err := newAvroCodec(schema)
+	if err != nil {
+		return nil, err
 	}
-	if err := json.NewDecoder(response.Body).Decode(&schemaResponse); err != nil {
-		return "", err
+	if src.diskCache != nil {
+		if err := src.diskCache.store(schemaID, schema); err != nil {
+			Logger.Warn(
+				"Unable to write schema to cache directory",
+				zap.Uint32("schema_id", schemaID), zap.Error(err))
+		}
 	}
-	return *schemaResponse.Schema, nil
+	return codec, nil
 }
 
-func (src *SchemaRegistryConfig) unmarshalMessage(ctx context.Context, message []byte, target interface{}) []error {
-	// bytes 1-4 are the schema id (big endian), bytes 5... is the message
-	// see: https://docs.confluent.io/current/schema-registry/docs/serializer-formatter.html#wire-format
+// parseAvroWireFormat returns the schema id and Avro payload of a message.
+// Byte 0 is the magic byte, which is always 0, bytes 1-4 are the schema id
+// (big endian), and bytes 5... are the message.
+// see: https://docs.confluent.io/current/schema-registry/docs/serializer-formatter.html#wire-format
+func parseAvroWireFormat(message []byte) (uint32, []byte, error) {
+	if message == nil {
+		return 0, nil, ErrTombstone
+	}
+	if len(message) < avroWireFormatHeaderLength || message[0] != 0 {
+		return 0, nil, ErrNotAvroWireFormat
+	}
+	return binary.BigEndian.Uint32(message[1:avroWireFormatHeaderLength]), message[avroWireFormatHeaderLength:], nil
+}
+
+// avroWireFormatHeader returns the magic byte and schema id that precede an
+// Avro message in the Schema Registry wire format
+func avroWireFormatHeader(schemaID uint32) []byte {
+	header := make([]byte, avroWireFormatHeaderLength)
+	binary.BigEndian.PutUint32(header[1:], schemaID)
+	return header
+}
+
+// decode decodes an Avro message in the Schema Registry wire format using
+// the writer's schema
+func (src *SchemaRegistryConfig) decode(ctx context.Context, message []byte) (interface{}, *avroCodec, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "get-avro-schema")
 	defer span.Finish()
-	schemaIDBytes := message[1:5]
-	messageBytes := message[5:]
-	schemaID := binary.BigEndian.Uint32(schemaIDBytes)
-
-	// Check if the schema is in cache, if not, get it from schema registry and
-	// cache it
-	schemaInterface, schemaInCache := src.schemas.Load(schemaID)
-	var schema string
-	if !schemaInCache {
-		Logger.Info(
-			"Schema not in cache, requesting from schema schema registry and caching",
-			zap.Uint32("schema_id", schemaID))
-		var getSchemaErr error
-		schema, getSchemaErr = src.client.getSchema(ctx, int(schemaID), src.SchemaRegistryURL)
-		if getSchemaErr != nil {
-			Logger.Error(
-				"Error getting schema from schema schemaRegistry",
-				zap.Error(getSchemaErr), zap.Uint32("schema_id", schemaID))
-			return []error{getSchemaErr}
-		}
-		src.schemas.Store(schemaID, schema)
-	} else {
-		schema = schemaInterface.(string)
+	schemaID, messageBytes, err := parseAvroWireFormat(message)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Decode Avro from binary
-	codec, codecErr := goavro.NewCodec(schema)
+	codec, codecErr := src.getCodec(ctx, schemaID)
 	if codecErr != nil {
-		return []error{codecErr}
+		if IsSchemaRegistryErrorCode(codecErr, SchemaNotFoundErrorCode) {
+			return nil, nil, ErrUnknownSchemaID
+		}
+		return nil, nil, codecErr
 	}
+
+	// Decode Avro from binary
 	decoded, _, decodeErr := codec.NativeFromBinary(messageBytes)
 	if decodeErr != nil {
-		return []error{decodeErr}
+		return nil, nil, decodeErr
+	}
+	return decoded, codec, nil
+}
+
+// DecodeMessage decodes an Avro message in the Schema Registry wire format
+// into the native form used by goavro, e.g. a map[string]interface{} for
+// records
+func (src *SchemaRegistryConfig) DecodeMessage(ctx context.Context, message []byte) (interface{}, error) {
+	decoded, _, err := src.decode(ctx, message)
+	return decoded, err
+}
+
+// EncodeJSON encodes a message from its Avro JSON representation into the
+// Schema Registry wire format using the schema with the given id
+func (src *SchemaRegistryConfig) EncodeJSON(ctx context.Context, schemaID int, message []byte) ([]byte, error) {
+	codec, err := src.getCodec(ctx, uint32(schemaID))
+	if err != nil {
+		if IsSchemaRegistryErrorCode(err, SchemaNotFoundErrorCode) {
+			return nil, ErrUnknownSchemaID
+		}
+		return nil, err
+	}
+	native, _, err := codec.NativeFromTextual(message)
+	if err != nil {
+		return nil, err
+	}
+	return codec.BinaryFromNative(avroWireFormatHeader(uint32(schemaID)), native)
+}
+
+func (src *SchemaRegistryConfig) unmarshalMessage(ctx context.Context, message []byte, target interface{}) []error {
+	decoded, codec, err := src.decode(ctx, message)
+	if err != nil {
+		return []error{err}
+	}
+
+	writerSchema, err := codec.writerSchema()
+	if err != nil {
+		return []error{err}
+	}
+
+	// Resolve the message into the reader schema, if there is one
+	schema := writerSchema
+	readerSchema, err := src.readerSchema(target)
+	if err != nil {
+		return []error{err}
+	}
+	if readerSchema != nil {
+		if decoded, err = resolveAvro(writerSchema, readerSchema, decoded); err != nil {
+			return []error{fmt.Errorf("unable to resolve Avro message into reader schema: %s", err.Error())}
+		}
+		schema = readerSchema
 	}
 
 	// Unmarshal avro to Go type
-	return src.messageUnmarshaler.unmarshalKafkaMessageMap(decoded.(map[string]interface{}), target)
+	record, ok := kafkaValueFromAvro(schema, decoded).(kafkaRecord)
+	if !ok {
+		return []error{fmt.Errorf("avro message is a %T, not a record", decoded)}
+	}
+	return src.messageUnmarshaler.unmarshalKafkaMessageMap(map[string]interface{}(record), target)
 }
 
 // UnmarshalMessage Implements the KafkaMessageUnmarshaler interface.
@@ -119,6 +540,18 @@ func (src *SchemaRegistryConfig) UnmarshalMessage(
 	target interface{},
 ) error {
 	unmarshalErrs := src.unmarshalMessage(ctx, msg.Value, target)
+	if len(unmarshalErrs) == 1 {
+		switch unmarshalErrs[0] {
+		case ErrTombstone:
+			return ErrTombstone
+		case ErrNotAvroWireFormat, ErrUnknownSchemaID:
+			Logger.Error(
+				"Unable to unmarshal from Avro", zap.Error(unmarshalErrs[0]),
+				zap.String("topic", msg.Topic), zap.Int32("partition", msg.Partition),
+				zap.Int64("offset", msg.Offset))
+			return unmarshalErrs[0]
+		}
+	}
 	if len(unmarshalErrs) > 0 {
 		Logger.Error(
 			"Unable to unmarshal from Avro", zap.Errors("errors", unmarshalErrs),
@@ -127,3 +560,35 @@ func (src *SchemaRegistryConfig) UnmarshalMessage(
 	}
 	return nil
 }
+
+// UnmarshalKey implements the KafkaKeyUnmarshaler interface. Decodes an Avro
+// key into a Go type. Record keys are unmarshaled into structs with `kafka`
+// tags, and primitive keys into a pointer to a matching Go type. Keys share
+// the schema cache with values, since schema ids are unique across subjects.
+func (src *SchemaRegistryConfig) UnmarshalKey(
+	ctx context.Context,
+	msg *sarama.ConsumerMessage,
+	target interface{},
+) error {
+	if msg.Key == nil {
+		return ErrNoKey
+	}
+	decoded, codec, err := src.decode(ctx, msg.Key)
+	if err == nil {
+		var schema *avroSchema
+		if schema, err = codec.writerSchema(); err == nil {
+			decoded = kafkaValueFromAvro(schema, decoded)
+		}
+	}
+	if err != nil {
+		Logger.Error(
+			"Unable to unmarshal key from Avro", zap.Error(err),
+			zap.String("topic", msg.Topic), zap.Int32("partition", msg.Partition),
+			zap.Int64("offset", msg.Offset))
+		if err == ErrNotAvroWireFormat || err == ErrUnknownSchemaID {
+			return err
+		}
+		return fmt.Errorf("unable to unmarshal key from Avro")
+	}
+	return setKafkaKey(src.messageUnmarshaler, decoded, target)
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const schemaCacheFileExtension = ".avsc"
+
+// schemaDiskCache persists schemas fetched from Schema Registry to a
+// directory so that they survive restarts. Schema ids are immutable, so a
+// cached schema never needs to be invalidated. When the total size of the
+// cached schemas exceeds maxBytes, the least recently written schemas are
+// removed from disk.
+type schemaDiskCache struct {
+	dir      string
+	maxBytes int64
+	mutex    sync.Mutex
+}
+
+// schemaCacheFile is a schema stored in the cache directory
+type schemaCacheFile struct {
+	schemaID uint32
+	info     os.FileInfo
+}
+
+func newSchemaDiskCache(dir string, maxBytes int64) (*schemaDiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create schema cache directory %s: %s", dir, err.Error())
+	}
+	return &schemaDiskCache{dir: dir, maxBytes: maxBytes}, nil
+}
+
+func (sdc *schemaDiskCache) path(schemaID uint32) string {
+	return filepath.Join(sdc.dir, strconv.FormatUint(uint64(schemaID), 10)+schemaCacheFileExtension)
+}
+
+// files returns all schemas in the cache directory, newest first
+func (sdc *schemaDiskCache) files() ([]schemaCacheFile, error) {
+	infos, err := ioutil.ReadDir(sdc.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]schemaCacheFile, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, schemaCacheFileExtension) {
+			continue
+		}
+		schemaID, err := strconv.ParseUint(strings.TrimSuffix(name, schemaCacheFileExtension), 10, 32)
+		if err != nil {
+			continue
+		}
+		files = append(files, schemaCacheFile{schemaID: uint32(schemaID), info: info})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].info.ModTime().After(files[j].info.ModTime())
+	})
+	return files, nil
+}
+
+// load returns all schemas in the cache directory, keyed by schema id
+func (sdc *schemaDiskCache) load() (map[uint32]string, error) {
+	sdc.mutex.Lock()
+	defer sdc.mutex.Unlock()
+	files, err := sdc.files()
+	if err != nil {
+		return nil, err
+	}
+	schemas := make(map[uint32]string, len(files))
+	for _, file := range files {
+		schema, err := ioutil.ReadFile(sdc.path(file.schemaID))
+		if err != nil {
+			Logger.Warn(
+				"Unable to read cached schema",
+				zap.Uint32("schema_id", file.schemaID), zap.Error(err))
+			continue
+		}
+		schemas[file.schemaID] = string(schema)
+	}
+	return schemas, nil
+}
+
+// store writes a schema to the cache directory and evicts old schemas if the
+// cache has grown beyond its maximum size
+func (sdc *schemaDiskCache) store(schemaID uint32, schema string) error {
+	sdc.mutex.Lock()
+	defer sdc.mutex.Unlock()
+	// write to a temporary file first so that readers never see a partial schema
+	tmpFile, err := ioutil.TempFile(sdc.dir, "schema-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.WriteString(schema); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), sdc.path(schemaID)); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return sdc.evict(schemaID)
+}
+
+// evict removes the oldest schemas until the cache fits within maxBytes. The
+// schema with the given id was just written and is always kept, even if
+// modification times are too coarse to tell it apart from older schemas. A
+// maxBytes of 0 or less means the cache size is unlimited.
+func (sdc *schemaDiskCache) evict(newestSchemaID uint32) error {
+	if sdc.maxBytes <= 0 {
+		return nil
+	}
+	files, err := sdc.files()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].schemaID == newestSchemaID && files[j].schemaID != newestSchemaID
+	})
+	var size int64
+	for _, file := range files {
+		size += file.info.Size()
+		if size > sdc.maxBytes {
+			if err := os.Remove(sdc.path(file.schemaID)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// localSchemaRegistryClient reads schemas from a schema cache directory
+// instead of Schema Registry, for decoding messages offline
+type localSchemaRegistryClient struct {
+	dir string
+}
+
+// getSchema implements the kafkaSchemaRegistryClient interface
+func (lsrc *localSchemaRegistryClient) getSchema(_ context.Context, schemaID int) (string, error) {
+	schema, err := ioutil.ReadFile(filepath.Join(lsrc.dir, strconv.Itoa(schemaID)+schemaCacheFileExtension))
+	if os.IsNotExist(err) {
+		return "", &SchemaRegistryError{
+			StatusCode: http.StatusNotFound,
+			ErrorCode:  SchemaNotFoundErrorCode,
+			Message:    fmt.Sprintf("schema %d not found in %s", schemaID, lsrc.dir),
+		}
+	}
+	return string(schema), err
+}
+
+// registerSchema implements the kafkaSchemaRegistryClient interface
+func (lsrc *localSchemaRegistryClient) registerSchema(_ context.Context, subject, _ string) (int, error) {
+	return 0, fmt.Errorf("cannot register schemas for subject %s without Schema Registry", subject)
+}
+
+// lookupSchema implements the kafkaSchemaRegistryClient interface
+func (lsrc *localSchemaRegistryClient) lookupSchema(_ context.Context, subject, _ string) (int, error) {
+	return 0, fmt.Errorf("cannot look up schemas for subject %s without Schema Registry", subject)
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupSchemaDiskCache(t *testing.T, maxBytes int64) (*schemaDiskCache, func()) {
+	dir, err := ioutil.TempDir("", "schema-cache")
+	require.NoError(t, err)
+	cache, err := newSchemaDiskCache(filepath.Join(dir, "schemas"), maxBytes)
+	require.NoError(t, err)
+	return cache, func() { os.RemoveAll(dir) }
+}
+
+func TestSchemaDiskCache_StoreLoad(t *testing.T) {
+	cache, cleanup := setupSchemaDiskCache(t, 0)
+	defer cleanup()
+	require.NoError(t, cache.store(1, `"string"`))
+	require.NoError(t, cache.store(2, `"long"`))
+	// files that aren't schemas are ignored
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cache.dir, "README"), []byte("hi"), 0644))
+
+	schemas, err := cache.load()
+	require.NoError(t, err)
+	assert.Equal(t, map[uint32]string{1: `"string"`, 2: `"long"`}, schemas)
+}
+
+func TestSchemaDiskCache_Evict(t *testing.T) {
+	cache, cleanup := setupSchemaDiskCache(t, 20)
+	defer cleanup()
+	// each schema is 8 bytes, so only two fit in the cache
+	now := time.Now()
+	for i := uint32(1); i <= 3; i++ {
+		require.NoError(t, cache.store(i, fmt.Sprintf(`"schem%d"`, i)))
+		modTime := now.Add(time.Duration(i) * time.Second)
+		require.NoError(t, os.Chtimes(cache.path(i), modTime, modTime))
+	}
+	schemas, err := cache.load()
+	require.NoError(t, err)
+	assert.Equal(t, map[uint32]string{2: `"schem2"`, 3: `"schem3"`}, schemas)
+
+	// the schema just written is kept even if it looks older than the others
+	past := now.Add(-time.Hour)
+	require.NoError(t, cache.store(4, `"schem4"`))
+	require.NoError(t, os.Chtimes(cache.path(4), past, past))
+	require.NoError(t, cache.evict(4))
+	schemas, err = cache.load()
+	require.NoError(t, err)
+	assert.Equal(t, map[uint32]string{3: `"schem3"`, 4: `"schem4"`}, schemas)
+}
+
+func TestSchemaRegistryConfig_DiskCache(t *testing.T) {
+	cache, cleanup := setupSchemaDiskCache(t, 0)
+	defer cleanup()
+	config, mockClient, schema, message, _ := setupMockSchemaRegistry(t)
+	config.SchemaCacheDir = cache.dir
+	require.NoError(t, config.loadDiskCache())
+
+	// schemas fetched from the registry are written through to disk
+	mockClient.On("getSchema", 77, mock.Anything).Return(schema, nil)
+	_, err := config.getCodec(context.Background(), 77)
+	require.NoError(t, err)
+	cachedSchema, err := ioutil.ReadFile(cache.path(77))
+	require.NoError(t, err)
+	assert.Equal(t, schema, string(cachedSchema))
+
+	// a new consumer preloads the cached schemas and decodes without the registry
+	restarted, restartedClient, _, _, messageMap := setupMockSchemaRegistry(t)
+	restarted.SchemaCacheDir = cache.dir
+	require.NoError(t, restarted.loadDiskCache())
+	restartedClient.On("unmarshalKafkaMessageMap", messageMap).Return([]error{})
+	errs := restarted.unmarshalMessage(context.Background(), message, nil)
+	assert.Empty(t, errs)
+	restartedClient.AssertNotCalled(t, "getSchema", mock.Anything, mock.Anything)
+}
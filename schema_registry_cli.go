@@ -0,0 +1,188 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// KafkaDecodeCobraCommand returns a cobra command that decodes a Kafka
+// message payload, read from a file or stdin, and prints it as indented
+// JSON. Payloads may be Avro in the Schema Registry wire format or JSON, and
+// may be hex or base64 encoded, as when copied from the logs of a consumer.
+// Avro schemas are fetched with the Schema Registry config, which can read
+// schemas from a local directory instead; see SchemaRegistryConfig.Init.
+func KafkaDecodeCobraCommand(src *SchemaRegistryConfig) *cobra.Command {
+	var inputEncoding string
+	format := AutoDetectMessageFormat
+	cmd := &cobra.Command{
+		Use:   "decode [file]",
+		Short: "Decode a Kafka message payload into JSON",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			input, err := readPayload(args, os.Stdin)
+			if err != nil {
+				return err
+			}
+			message, err := decodePayload(input, inputEncoding)
+			if err != nil {
+				return err
+			}
+			if format == AutoDetectMessageFormat {
+				if format, err = detectMessageFormat(message); err != nil {
+					return err
+				}
+			}
+			out := &bytes.Buffer{}
+			switch format {
+			case AvroMessageFormat:
+				if err := src.Init(); err != nil {
+					return err
+				}
+				decoded, err := src.DecodeMessage(context.Background(), message)
+				if err != nil {
+					return err
+				}
+				encoded, err := json.MarshalIndent(decoded, "", "  ")
+				if err != nil {
+					return err
+				}
+				out.Write(encoded)
+			case JSONMessageFormat:
+				if err := json.Indent(out, message, "", "  "); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("cannot decode %s messages", format)
+			}
+			out.WriteByte('\n')
+			_, err = out.WriteTo(cmd.OutOrStdout())
+			return err
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&inputEncoding, "input-encoding", "auto", "Encoding of the payload, one of auto, raw, hex, or base64")
+	flags.Var(&format, "format", "Format of the message, one of auto, avro, or json")
+	return cmd
+}
+
+// KafkaEncodeCobraCommand returns a cobra command that encodes a message
+// from its Avro JSON representation, read from a file or stdin, into the
+// Schema Registry wire format. The schema is either the latest schema
+// registered under --subject or the schema given by --schema-id, which
+// also works with a local schema directory. The encoded message is printed
+// as base64 by default.
+func KafkaEncodeCobraCommand(src *SchemaRegistryConfig) *cobra.Command {
+	var subject, outputEncoding string
+	var schemaID int
+	cmd := &cobra.Command{
+		Use:   "encode [file]",
+		Short: "Encode a JSON message into the Avro Schema Registry wire format",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (subject == "") == (schemaID == 0) {
+				return fmt.Errorf("exactly one of --subject or --schema-id is required")
+			}
+			input, err := readPayload(args, os.Stdin)
+			if err != nil {
+				return err
+			}
+			if err := src.Init(); err != nil {
+				return err
+			}
+			ctx := context.Background()
+			if subject != "" {
+				client, ok := src.client.(*SchemaRegistryClient)
+				if !ok {
+					return fmt.Errorf("--subject requires Schema Registry, use --schema-id with a local schema directory")
+				}
+				metadata, err := client.GetLatestSchema(ctx, subject)
+				if err != nil {
+					return err
+				}
+				schemaID = metadata.ID
+			}
+			message, err := src.EncodeJSON(ctx, schemaID, input)
+			if err != nil {
+				return err
+			}
+			var output string
+			switch outputEncoding {
+			case "base64":
+				output = base64.StdEncoding.EncodeToString(message) + "\n"
+			case "hex":
+				output = hex.EncodeToString(message) + "\n"
+			case "raw":
+				output = string(message)
+			default:
+				return fmt.Errorf("unknown output encoding %s", outputEncoding)
+			}
+			_, err = io.WriteString(cmd.OutOrStdout(), output)
+			return err
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&subject, "subject", "", "Schema Registry subject whose latest schema is used to encode the message")
+	flags.IntVar(&schemaID, "schema-id", 0, "Id of the schema used to encode the message")
+	flags.StringVar(&outputEncoding, "output-encoding", "base64", "Encoding of the output, one of base64, hex, or raw")
+	return cmd
+}
+
+// readPayload reads the file given as the only argument, or stdin if there
+// are no arguments or the argument is -
+func readPayload(args []string, stdin io.Reader) ([]byte, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(args[0])
+}
+
+// decodePayload decodes hex or base64 payloads. With the auto encoding, text
+// payloads that are valid hex or base64 are decoded and everything else,
+// including JSON, is returned as is.
+func decodePayload(input []byte, encoding string) ([]byte, error) {
+	trimmed := string(bytes.TrimSpace(input))
+	switch encoding {
+	case "raw":
+		return input, nil
+	case "hex":
+		return hex.DecodeString(trimmed)
+	case "base64":
+		return base64.StdEncoding.DecodeString(trimmed)
+	case "auto":
+		if trimmed == "" {
+			return input, nil
+		}
+		if decoded, err := hex.DecodeString(trimmed); err == nil {
+			return decoded, nil
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(trimmed); err == nil {
+			return decoded, nil
+		}
+		return input, nil
+	default:
+		return nil, fmt.Errorf("unknown input encoding %s", encoding)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupSchemaDir writes the test schema with id 77 to a schema directory and
+// returns an offline config reading from it
+func setupSchemaDir(t *testing.T) (*SchemaRegistryConfig, string, func()) {
+	dir, err := ioutil.TempDir("", "schema-dir")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "77.avsc"), []byte(testRegistrySchema), 0644))
+	src := &SchemaRegistryConfig{SchemaCacheDir: dir}
+	src.initSchemaRegistryMetrics(prometheus.NewRegistry())
+	return src, dir, func() { os.RemoveAll(dir) }
+}
+
+func TestSchemaRegistryConfig_Offline(t *testing.T) {
+	src, dir, cleanup := setupSchemaDir(t)
+	defer cleanup()
+	require.NoError(t, src.Init())
+	ctx := context.Background()
+
+	message, err := src.EncodeJSON(ctx, 77, []byte(`{"name": "Guy Fieri"}`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 77}, message[:5])
+	decoded, err := src.DecodeMessage(ctx, message)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "Guy Fieri"}, decoded)
+
+	_, err = src.DecodeMessage(ctx, []byte{0, 0, 0, 0, 78, 2})
+	assert.Equal(t, ErrUnknownSchemaID, err)
+	_, err = src.client.registerSchema(ctx, "flavortown-value", testRegistrySchema)
+	assert.Error(t, err)
+
+	// the schema directory is never written to or evicted from
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestKafkaDecodeCobraCommand(t *testing.T) {
+	src, dir, cleanup := setupSchemaDir(t)
+	defer cleanup()
+	require.NoError(t, src.Init())
+	message, err := src.EncodeJSON(context.Background(), 77, []byte(`{"name": "Guy Fieri"}`))
+	require.NoError(t, err)
+	expected := "{\n  \"name\": \"Guy Fieri\"\n}\n"
+
+	tests := []struct {
+		name    string
+		payload []byte
+		args    []string
+	}{
+		{"raw avro", message, nil},
+		{"base64 avro", []byte(base64.StdEncoding.EncodeToString(message) + "\n"), nil},
+		{"hex avro", []byte(hex.EncodeToString(message)), []string{"--input-encoding", "hex"}},
+		{"json", []byte(`{"name":"Guy Fieri"}`), []string{"--format", "json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "payload")
+			require.NoError(t, ioutil.WriteFile(path, test.payload, 0644))
+			cmd := KafkaDecodeCobraCommand(src)
+			out := &bytes.Buffer{}
+			cmd.SetOutput(out)
+			cmd.SetArgs(append([]string{path}, test.args...))
+			require.NoError(t, cmd.Execute())
+			assert.Equal(t, expected, out.String())
+		})
+	}
+
+	t.Run("unknown format", func(t *testing.T) {
+		path := filepath.Join(dir, "payload")
+		require.NoError(t, ioutil.WriteFile(path, []byte("Flavortown"), 0644))
+		cmd := KafkaDecodeCobraCommand(src)
+		cmd.SetOutput(ioutil.Discard)
+		cmd.SetArgs([]string{path, "--input-encoding", "raw"})
+		assert.Error(t, cmd.Execute())
+	})
+}
+
+func TestKafkaEncodeCobraCommand(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "encode-payload.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"name": "Guy Fieri"}`), 0644))
+	defer os.Remove(path)
+
+	t.Run("schema id from a schema directory", func(t *testing.T) {
+		src, _, cleanup := setupSchemaDir(t)
+		defer cleanup()
+		cmd := KafkaEncodeCobraCommand(src)
+		out := &bytes.Buffer{}
+		cmd.SetOutput(out)
+		cmd.SetArgs([]string{path, "--schema-id", "77", "--output-encoding", "hex"})
+		require.NoError(t, cmd.Execute())
+		message, err := hex.DecodeString(strings.TrimSpace(out.String()))
+		require.NoError(t, err)
+		decoded, err := src.DecodeMessage(context.Background(), message)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"name": "Guy Fieri"}, decoded)
+
+		// subjects can't be resolved without Schema Registry
+		cmd = KafkaEncodeCobraCommand(src)
+		cmd.SetOutput(ioutil.Discard)
+		cmd.SetArgs([]string{path, "--subject", "flavortown-value"})
+		assert.Error(t, cmd.Execute())
+	})
+
+	t.Run("latest schema of a subject", func(t *testing.T) {
+		client, _, closer := setupSchemaRegistryClient(t)
+		defer closer()
+		id, err := client.RegisterSchema(context.Background(), "flavortown-value", testRegistrySchema)
+		require.NoError(t, err)
+		src := &SchemaRegistryConfig{client: client}
+		src.initSchemaRegistryMetrics(prometheus.NewRegistry())
+		cmd := KafkaEncodeCobraCommand(src)
+		out := &bytes.Buffer{}
+		cmd.SetOutput(out)
+		cmd.SetArgs([]string{path, "--subject", "flavortown-value"})
+		require.NoError(t, cmd.Execute())
+		message, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out.String()))
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 0, byte(id)}, message[:5])
+	})
+
+	t.Run("subject or schema id is required", func(t *testing.T) {
+		cmd := KafkaEncodeCobraCommand(&SchemaRegistryConfig{})
+		cmd.SetOutput(ioutil.Discard)
+		cmd.SetArgs([]string{path})
+		assert.Error(t, cmd.Execute())
+	})
+}
+
+func TestDecodePayload(t *testing.T) {
+	tests := []struct {
+		input    string
+		encoding string
+		expected []byte
+	}{
+		{"00000000", "auto", []byte{0, 0, 0, 0}},
+		{"AAAAAE0=\n", "auto", []byte{0, 0, 0, 0, 77}},
+		{`{"name": "Guy"}`, "auto", []byte(`{"name": "Guy"}`)},
+		{"00000000", "raw", []byte("00000000")},
+		{"AAAAAE0=", "base64", []byte{0, 0, 0, 0, 77}},
+	}
+	for _, test := range tests {
+		decoded, err := decodePayload([]byte(test.input), test.encoding)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, decoded)
+	}
+	_, err := decodePayload([]byte("zz"), "hex")
+	assert.Error(t, err)
+	_, err = decodePayload(nil, "rot13")
+	assert.Error(t, err)
+}
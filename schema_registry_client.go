@@ -0,0 +1,365 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+// Schema Registry error codes
+// see: https://docs.confluent.io/current/schema-registry/develop/api.html#errors
+const (
+	// SubjectNotFoundErrorCode is returned when a subject does not exist
+	SubjectNotFoundErrorCode = 40401
+	// VersionNotFoundErrorCode is returned when a version of a subject does not exist
+	VersionNotFoundErrorCode = 40402
+	// SchemaNotFoundErrorCode is returned when a schema does not exist
+	SchemaNotFoundErrorCode = 40403
+	// IncompatibleSchemaErrorCode is returned when registering a schema that
+	// is incompatible with the subject's previous versions
+	IncompatibleSchemaErrorCode = 409
+	// InvalidSchemaErrorCode is returned when a schema cannot be parsed
+	InvalidSchemaErrorCode = 42201
+	// InvalidVersionErrorCode is returned when a version is not valid
+	InvalidVersionErrorCode = 42202
+	// InvalidCompatibilityLevelErrorCode is returned when a compatibility level is not valid
+	InvalidCompatibilityLevelErrorCode = 42203
+	// BackendStoreErrorCode is returned when Schema Registry fails to read from or write to Kafka
+	BackendStoreErrorCode = 50001
+	// OperationTimeoutErrorCode is returned when an operation times out
+	OperationTimeoutErrorCode = 50002
+	// ForwardingErrorCode is returned when a request could not be forwarded to the leader
+	ForwardingErrorCode = 50003
+)
+
+// SchemaRegistryError is an error returned by the Schema Registry API
+type SchemaRegistryError struct {
+	StatusCode int    `json:"-"`
+	ErrorCode  int    `json:"error_code"`
+	Message    string `json:"message"`
+}
+
+// Error implements the error interface
+func (sre *SchemaRegistryError) Error() string {
+	return fmt.Sprintf("schema registry error %d (HTTP %d): %s", sre.ErrorCode, sre.StatusCode, sre.Message)
+}
+
+// IsSchemaRegistryErrorCode returns true if err is a SchemaRegistryError with the given error code
+func IsSchemaRegistryErrorCode(err error, errorCode int) bool {
+	sre, ok := err.(*SchemaRegistryError)
+	return ok && sre.ErrorCode == errorCode
+}
+
+// CompatibilityLevel is a Schema Registry compatibility level
+type CompatibilityLevel string
+
+const (
+	// CompatibilityNone disables compatibility checks
+	CompatibilityNone CompatibilityLevel = "NONE"
+	// CompatibilityBackward checks compatibility against the last version
+	CompatibilityBackward CompatibilityLevel = "BACKWARD"
+	// CompatibilityBackwardTransitive checks compatibility against all previous versions
+	CompatibilityBackwardTransitive CompatibilityLevel = "BACKWARD_TRANSITIVE"
+	// CompatibilityForward checks forward compatibility against the last version
+	CompatibilityForward CompatibilityLevel = "FORWARD"
+	// CompatibilityForwardTransitive checks forward compatibility against all previous versions
+	CompatibilityForwardTransitive CompatibilityLevel = "FORWARD_TRANSITIVE"
+	// CompatibilityFull checks backward and forward compatibility against the last version
+	CompatibilityFull CompatibilityLevel = "FULL"
+	// CompatibilityFullTransitive checks backward and forward compatibility against all previous versions
+	CompatibilityFullTransitive CompatibilityLevel = "FULL_TRANSITIVE"
+)
+
+// SchemaMetadata is a schema registered under a subject in Schema Registry
+type SchemaMetadata struct {
+	Subject    string `json:"subject"`
+	Version    int    `json:"version"`
+	ID         int    `json:"id"`
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+// SchemaRegistryClient is a client for the Confluent Schema Registry REST API
+type SchemaRegistryClient struct {
+	URL        string
+	HTTPClient *http.Client
+	// Username and Password are used for HTTP basic authentication if set
+	Username string
+	Password string
+	// BearerToken is sent in the Authorization header if set and takes
+	// precedence over basic authentication
+	BearerToken string
+	// MaxRetries is the number of times a request is retried after a
+	// network error or a 429 or 5XX response
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, which doubles with
+	// every subsequent retry
+	RetryBackoff time.Duration
+}
+
+// NewSchemaRegistryClient creates a new Schema Registry client for the registry at the given URL
+func NewSchemaRegistryClient(schemaRegistryURL string) *SchemaRegistryClient {
+	return &SchemaRegistryClient{URL: strings.TrimSuffix(schemaRegistryURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+const schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+
+// do performs a request against the Schema Registry API and decodes the JSON
+// response into result. Non-2XX responses are returned as a
+// *SchemaRegistryError. Network errors and 429 or 5XX responses are retried
+// with exponential backoff up to MaxRetries times.
+func (src *SchemaRegistryClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "schema-registry-request")
+	defer span.Finish()
+	span.SetTag("http.method", method)
+	span.SetTag("http.path", path)
+
+	var encodedBody []byte
+	if body != nil {
+		var err error
+		if encodedBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	backoff := src.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := src.doOnce(ctx, span, method, path, encodedBody, result)
+		if err == nil || !retry || attempt >= src.MaxRetries {
+			return err
+		}
+		Logger.Warn(
+			"Retrying Schema Registry request",
+			zap.String("path", path), zap.Int("attempt", attempt+1), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// doOnce performs a single request against the Schema Registry API and
+// returns whether the request may be retried if it failed
+func (src *SchemaRegistryClient) doOnce(
+	ctx context.Context,
+	span opentracing.Span,
+	method, path string,
+	body []byte,
+	result interface{},
+) (bool, error) {
+	var requestBody io.Reader
+	if body != nil {
+		requestBody = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, src.URL+path, requestBody)
+	if err != nil {
+		return false, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", schemaRegistryContentType)
+	if body != nil {
+		request.Header.Set("Content-Type", schemaRegistryContentType)
+	}
+	if src.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+src.BearerToken)
+	} else if src.Username != "" {
+		request.SetBasicAuth(src.Username, src.Password)
+	}
+	TraceOutbound(request, span)
+
+	httpClient := src.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		// don't retry if the caller gave up
+		return ctx.Err() == nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		registryErr := &SchemaRegistryError{}
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		if err := json.Unmarshal(responseBody, registryErr); err != nil || registryErr.ErrorCode == 0 {
+			registryErr.ErrorCode = response.StatusCode
+			registryErr.Message = strings.TrimSpace(string(responseBody))
+		}
+		registryErr.StatusCode = response.StatusCode
+		retry := response.StatusCode == http.StatusTooManyRequests ||
+			response.StatusCode >= http.StatusInternalServerError
+		return retry, registryErr
+	}
+	if result == nil {
+		return false, nil
+	}
+	return false, json.NewDecoder(response.Body).Decode(result)
+}
+
+func subjectPath(subject string) string {
+	return "/subjects/" + url.PathEscape(subject)
+}
+
+// GetSchemaByID returns the schema with the given id
+func (src *SchemaRegistryClient) GetSchemaByID(ctx context.Context, schemaID int) (string, error) {
+	var response struct {
+		Schema *string `json:"schema"`
+	}
+	if err := src.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", schemaID), nil, &response); err != nil {
+		return "", err
+	}
+	if response.Schema == nil {
+		return "", fmt.Errorf("schema registry response for schema id %d has no schema", schemaID)
+	}
+	return *response.Schema, nil
+}
+
+// getSchema implements the kafkaSchemaRegistryClient interface
+func (src *SchemaRegistryClient) getSchema(ctx context.Context, schemaID int) (string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "get-avro-schema")
+	defer span.Finish()
+	schema, err := src.GetSchemaByID(ctx, schemaID)
+	if err != nil {
+		Logger.Error(
+			"Error getting schema from schema registry",
+			zap.Int("schema_id", schemaID), zap.Error(err))
+	}
+	return schema, err
+}
+
+// registerSchema implements the kafkaSchemaRegistryClient interface
+func (src *SchemaRegistryClient) registerSchema(ctx context.Context, subject, schema string) (int, error) {
+	return src.RegisterSchema(ctx, subject, schema)
+}
+
+// lookupSchema implements the kafkaSchemaRegistryClient interface
+func (src *SchemaRegistryClient) lookupSchema(ctx context.Context, subject, schema string) (int, error) {
+	metadata, err := src.LookupSchema(ctx, subject, schema)
+	if err != nil {
+		return 0, err
+	}
+	return metadata.ID, nil
+}
+
+// ListSubjects returns all subjects registered in Schema Registry
+func (src *SchemaRegistryClient) ListSubjects(ctx context.Context) ([]string, error) {
+	subjects := make([]string, 0)
+	err := src.do(ctx, http.MethodGet, "/subjects", nil, &subjects)
+	return subjects, err
+}
+
+// ListVersions returns all versions registered under a subject
+func (src *SchemaRegistryClient) ListVersions(ctx context.Context, subject string) ([]int, error) {
+	versions := make([]int, 0)
+	err := src.do(ctx, http.MethodGet, subjectPath(subject)+"/versions", nil, &versions)
+	return versions, err
+}
+
+// GetLatestSchema returns the latest schema registered under a subject
+func (src *SchemaRegistryClient) GetLatestSchema(ctx context.Context, subject string) (*SchemaMetadata, error) {
+	metadata := &SchemaMetadata{}
+	if err := src.do(ctx, http.MethodGet, subjectPath(subject)+"/versions/latest", nil, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// GetSchemaVersion returns a specific version of the schema registered under a subject
+func (src *SchemaRegistryClient) GetSchemaVersion(ctx context.Context, subject string, version int) (*SchemaMetadata, error) {
+	metadata := &SchemaMetadata{}
+	path := fmt.Sprintf("%s/versions/%d", subjectPath(subject), version)
+	if err := src.do(ctx, http.MethodGet, path, nil, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// RegisterSchema registers a schema under a subject and returns its id. If
+// the schema is already registered under the subject, the existing id is
+// returned.
+func (src *SchemaRegistryClient) RegisterSchema(ctx context.Context, subject, schema string) (int, error) {
+	var response struct {
+		ID int `json:"id"`
+	}
+	request := map[string]string{"schema": schema}
+	if err := src.do(ctx, http.MethodPost, subjectPath(subject)+"/versions", request, &response); err != nil {
+		return 0, err
+	}
+	return response.ID, nil
+}
+
+// LookupSchema returns the id and version of a schema that has already been
+// registered under a subject
+func (src *SchemaRegistryClient) LookupSchema(ctx context.Context, subject, schema string) (*SchemaMetadata, error) {
+	metadata := &SchemaMetadata{}
+	request := map[string]string{"schema": schema}
+	if err := src.do(ctx, http.MethodPost, subjectPath(subject), request, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// TestCompatibility tests whether a schema is compatible with the latest
+// schema registered under a subject according to the subject's
+// compatibility level
+func (src *SchemaRegistryClient) TestCompatibility(ctx context.Context, subject, schema string) (bool, error) {
+	var response struct {
+		IsCompatible bool `json:"is_compatible"`
+	}
+	request := map[string]string{"schema": schema}
+	path := "/compatibility" + subjectPath(subject) + "/versions/latest"
+	if err := src.do(ctx, http.MethodPost, path, request, &response); err != nil {
+		return false, err
+	}
+	return response.IsCompatible, nil
+}
+
+func configPath(subject string) string {
+	if subject == "" {
+		return "/config"
+	}
+	return "/config/" + url.PathEscape(subject)
+}
+
+// GetCompatibilityLevel returns the compatibility level of a subject. If
+// subject is empty, the global compatibility level is returned.
+func (src *SchemaRegistryClient) GetCompatibilityLevel(ctx context.Context, subject string) (CompatibilityLevel, error) {
+	var response struct {
+		CompatibilityLevel CompatibilityLevel `json:"compatibilityLevel"`
+	}
+	if err := src.do(ctx, http.MethodGet, configPath(subject), nil, &response); err != nil {
+		return "", err
+	}
+	return response.CompatibilityLevel, nil
+}
+
+// SetCompatibilityLevel sets the compatibility level of a subject. If subject
+// is empty, the global compatibility level is set.
+func (src *SchemaRegistryClient) SetCompatibilityLevel(ctx context.Context, subject string, level CompatibilityLevel) error {
+	request := map[string]CompatibilityLevel{"compatibility": level}
+	return src.do(ctx, http.MethodPut, configPath(subject), request, nil)
+}
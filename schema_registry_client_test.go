@@ -0,0 +1,273 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSchemaRegistry is an in-memory stand-in for the Schema Registry REST API
+type fakeSchemaRegistry struct {
+	mutex         sync.Mutex
+	schemas       map[int]string
+	subjects      map[string][]int
+	compatibility map[string]CompatibilityLevel
+	requests      int
+}
+
+func newFakeSchemaRegistry() *fakeSchemaRegistry {
+	return &fakeSchemaRegistry{
+		schemas:       make(map[int]string),
+		subjects:      make(map[string][]int),
+		compatibility: map[string]CompatibilityLevel{"": CompatibilityBackward},
+	}
+}
+
+func (fsr *fakeSchemaRegistry) writeError(w http.ResponseWriter, status, code int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error_code": code, "message": message})
+}
+
+func (fsr *fakeSchemaRegistry) schemaID(schema string) int {
+	for id, registered := range fsr.schemas {
+		if registered == schema {
+			return id
+		}
+	}
+	return 0
+}
+
+func (fsr *fakeSchemaRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	fsr.requests++
+	var body struct {
+		Schema        string             `json:"schema"`
+		Compatibility CompatibilityLevel `json:"compatibility"`
+	}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	path := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	encoder := json.NewEncoder(w)
+	switch {
+	case len(path) == 3 && path[0] == "schemas" && path[1] == "ids":
+		id, _ := strconv.Atoi(path[2])
+		schema, ok := fsr.schemas[id]
+		if !ok {
+			fsr.writeError(w, http.StatusNotFound, SchemaNotFoundErrorCode, "Schema not found")
+			return
+		}
+		encoder.Encode(map[string]string{"schema": schema})
+	case len(path) == 1 && path[0] == "subjects":
+		subjects := make([]string, 0, len(fsr.subjects))
+		for subject := range fsr.subjects {
+			subjects = append(subjects, subject)
+		}
+		sort.Strings(subjects)
+		encoder.Encode(subjects)
+	case len(path) >= 2 && path[0] == "subjects":
+		subject := path[1]
+		ids, ok := fsr.subjects[subject]
+		if len(path) == 3 && r.Method == http.MethodPost {
+			// register
+			if body.Schema == "" {
+				fsr.writeError(w, http.StatusUnprocessableEntity, InvalidSchemaErrorCode, "Invalid schema")
+				return
+			}
+			id := fsr.schemaID(body.Schema)
+			if id == 0 {
+				id = len(fsr.schemas) + 1
+				fsr.schemas[id] = body.Schema
+			}
+			for _, existing := range ids {
+				if existing == id {
+					encoder.Encode(map[string]int{"id": id})
+					return
+				}
+			}
+			fsr.subjects[subject] = append(ids, id)
+			encoder.Encode(map[string]int{"id": id})
+			return
+		}
+		if !ok {
+			fsr.writeError(w, http.StatusNotFound, SubjectNotFoundErrorCode, "Subject not found")
+			return
+		}
+		switch {
+		case len(path) == 2 && r.Method == http.MethodPost:
+			// lookup
+			for version, id := range ids {
+				if fsr.schemas[id] == body.Schema {
+					encoder.Encode(SchemaMetadata{Subject: subject, Version: version + 1, ID: id, Schema: body.Schema})
+					return
+				}
+			}
+			fsr.writeError(w, http.StatusNotFound, SchemaNotFoundErrorCode, "Schema not found")
+		case len(path) == 3:
+			versions := make([]int, len(ids))
+			for i := range ids {
+				versions[i] = i + 1
+			}
+			encoder.Encode(versions)
+		case len(path) == 4:
+			version := len(ids)
+			if path[3] != "latest" {
+				version, _ = strconv.Atoi(path[3])
+			}
+			if version < 1 || version > len(ids) {
+				fsr.writeError(w, http.StatusNotFound, VersionNotFoundErrorCode, "Version not found")
+				return
+			}
+			id := ids[version-1]
+			encoder.Encode(SchemaMetadata{Subject: subject, Version: version, ID: id, Schema: fsr.schemas[id]})
+		}
+	case len(path) == 5 && path[0] == "compatibility":
+		ids, ok := fsr.subjects[path[2]]
+		if !ok {
+			fsr.writeError(w, http.StatusNotFound, SubjectNotFoundErrorCode, "Subject not found")
+			return
+		}
+		// the fake considers a schema compatible if it is identical to the latest version
+		encoder.Encode(map[string]bool{"is_compatible": fsr.schemas[ids[len(ids)-1]] == body.Schema})
+	case path[0] == "config":
+		subject := ""
+		if len(path) == 2 {
+			subject = path[1]
+		}
+		if r.Method == http.MethodPut {
+			fsr.compatibility[subject] = body.Compatibility
+			encoder.Encode(map[string]CompatibilityLevel{"compatibility": body.Compatibility})
+			return
+		}
+		level, ok := fsr.compatibility[subject]
+		if !ok {
+			fsr.writeError(w, http.StatusNotFound, SubjectNotFoundErrorCode, "Subject not found")
+			return
+		}
+		encoder.Encode(map[string]CompatibilityLevel{"compatibilityLevel": level})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func setupSchemaRegistryClient(t *testing.T) (*SchemaRegistryClient, *fakeSchemaRegistry, func()) {
+	registry := newFakeSchemaRegistry()
+	server := httptest.NewServer(registry)
+	return NewSchemaRegistryClient(server.URL), registry, server.Close
+}
+
+const testRegistrySchema = `{"type": "record", "name": "test", "fields": [{"name": "name", "type": "string"}]}`
+
+func TestSchemaRegistryClient_Subjects(t *testing.T) {
+	client, _, closer := setupSchemaRegistryClient(t)
+	defer closer()
+	ctx := context.Background()
+
+	id, err := client.RegisterSchema(ctx, "flavortown-value", testRegistrySchema)
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+
+	// registering the same schema again returns the same id
+	id, err = client.RegisterSchema(ctx, "flavortown-value", testRegistrySchema)
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+
+	subjects, err := client.ListSubjects(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"flavortown-value"}, subjects)
+
+	versions, err := client.ListVersions(ctx, "flavortown-value")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, versions)
+
+	latest, err := client.GetLatestSchema(ctx, "flavortown-value")
+	require.NoError(t, err)
+	assert.Equal(t, &SchemaMetadata{Subject: "flavortown-value", Version: 1, ID: 1, Schema: testRegistrySchema}, latest)
+
+	version, err := client.GetSchemaVersion(ctx, "flavortown-value", 1)
+	require.NoError(t, err)
+	assert.Equal(t, latest, version)
+
+	schema, err := client.GetSchemaByID(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, testRegistrySchema, schema)
+
+	metadata, err := client.LookupSchema(ctx, "flavortown-value", testRegistrySchema)
+	require.NoError(t, err)
+	assert.Equal(t, 1, metadata.ID)
+	assert.Equal(t, 1, metadata.Version)
+}
+
+func TestSchemaRegistryClient_Errors(t *testing.T) {
+	client, _, closer := setupSchemaRegistryClient(t)
+	defer closer()
+	ctx := context.Background()
+
+	_, err := client.GetLatestSchema(ctx, "missing")
+	require.Error(t, err)
+	assert.True(t, IsSchemaRegistryErrorCode(err, SubjectNotFoundErrorCode))
+	registryErr := err.(*SchemaRegistryError)
+	assert.Equal(t, http.StatusNotFound, registryErr.StatusCode)
+	assert.Equal(t, "Subject not found", registryErr.Message)
+
+	_, err = client.GetSchemaByID(ctx, 42)
+	assert.True(t, IsSchemaRegistryErrorCode(err, SchemaNotFoundErrorCode))
+
+	_, err = client.RegisterSchema(ctx, "flavortown-value", testRegistrySchema)
+	require.NoError(t, err)
+	_, err = client.GetSchemaVersion(ctx, "flavortown-value", 2)
+	assert.True(t, IsSchemaRegistryErrorCode(err, VersionNotFoundErrorCode))
+
+	_, err = client.RegisterSchema(ctx, "flavortown-value", "")
+	assert.True(t, IsSchemaRegistryErrorCode(err, InvalidSchemaErrorCode))
+}
+
+func TestSchemaRegistryClient_Compatibility(t *testing.T) {
+	client, _, closer := setupSchemaRegistryClient(t)
+	defer closer()
+	ctx := context.Background()
+
+	_, err := client.RegisterSchema(ctx, "flavortown-value", testRegistrySchema)
+	require.NoError(t, err)
+
+	compatible, err := client.TestCompatibility(ctx, "flavortown-value", testRegistrySchema)
+	require.NoError(t, err)
+	assert.True(t, compatible)
+
+	compatible, err = client.TestCompatibility(ctx, "flavortown-value", `{"type": "string"}`)
+	require.NoError(t, err)
+	assert.False(t, compatible)
+
+	level, err := client.GetCompatibilityLevel(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, CompatibilityBackward, level)
+
+	require.NoError(t, client.SetCompatibilityLevel(ctx, "flavortown-value", CompatibilityFull))
+	level, err = client.GetCompatibilityLevel(ctx, "flavortown-value")
+	require.NoError(t, err)
+	assert.Equal(t, CompatibilityFull, level)
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+// SubjectNameStrategy determines the Schema Registry subject under which the
+// schema of a message key or value is registered.
+// See: https://docs.confluent.io/current/schema-registry/serdes-develop/index.html#subject-name-strategy
+type SubjectNameStrategy interface {
+	// SubjectName returns the subject for a key or value schema on a topic.
+	// recordName is the fully qualified name of the schema, or empty if the
+	// schema is not a named type.
+	SubjectName(topic string, isKey bool, recordName string) (string, error)
+}
+
+// TopicNameStrategy registers schemas under <topic>-key and <topic>-value.
+// This is the default strategy and allows a single value schema per topic.
+type TopicNameStrategy struct{}
+
+// SubjectName implements the SubjectNameStrategy interface
+func (TopicNameStrategy) SubjectName(topic string, isKey bool, _ string) (string, error) {
+	if isKey {
+		return topic + "-key", nil
+	}
+	return topic + "-value", nil
+}
+
+// RecordNameStrategy registers schemas under the fully qualified record
+// name, so that a record has the same subject on every topic it is
+// produced to, and topics may carry multiple record types
+type RecordNameStrategy struct{}
+
+// SubjectName implements the SubjectNameStrategy interface
+func (RecordNameStrategy) SubjectName(_ string, _ bool, recordName string) (string, error) {
+	if recordName == "" {
+		return "", fmt.Errorf("the record name strategy requires a named Avro schema")
+	}
+	return recordName, nil
+}
+
+// TopicRecordNameStrategy registers schemas under <topic>-<record name>, so
+// that topics may carry multiple record types that evolve independently on
+// each topic
+type TopicRecordNameStrategy struct{}
+
+// SubjectName implements the SubjectNameStrategy interface
+func (TopicRecordNameStrategy) SubjectName(topic string, _ bool, recordName string) (string, error) {
+	if recordName == "" {
+		return "", fmt.Errorf("the topic record name strategy requires a named Avro schema")
+	}
+	return topic + "-" + recordName, nil
+}
+
+var subjectNameStrategies = map[string]SubjectNameStrategy{
+	"topic":        TopicNameStrategy{},
+	"record":       RecordNameStrategy{},
+	"topic-record": TopicRecordNameStrategy{},
+}
+
+// ParseSubjectNameStrategy returns the subject name strategy with the given
+// name, one of topic, record, or topic-record
+func ParseSubjectNameStrategy(name string) (SubjectNameStrategy, error) {
+	if strategy, ok := subjectNameStrategies[strings.ToLower(name)]; ok {
+		return strategy, nil
+	}
+	return nil, fmt.Errorf("unknown subject name strategy %s", name)
+}
+
+// subjectNameStrategyValue sets a SubjectNameStrategy from its name,
+// implementing the pflag.Value interface
+type subjectNameStrategyValue struct {
+	strategy *SubjectNameStrategy
+}
+
+func (snsv subjectNameStrategyValue) String() string {
+	if snsv.strategy == nil || *snsv.strategy == nil {
+		return ""
+	}
+	for name, strategy := range subjectNameStrategies {
+		if reflect.TypeOf(strategy) == reflect.TypeOf(*snsv.strategy) {
+			return name
+		}
+	}
+	return fmt.Sprintf("%T", *snsv.strategy)
+}
+
+func (snsv subjectNameStrategyValue) Set(name string) error {
+	strategy, err := ParseSubjectNameStrategy(name)
+	if err != nil {
+		return err
+	}
+	*snsv.strategy = strategy
+	return nil
+}
+
+func (snsv subjectNameStrategyValue) Type() string {
+	return "strategy"
+}
+
+// subjectNameStrategy returns the strategy used for a topic
+func (src *SchemaRegistryConfig) subjectNameStrategy(topic string) SubjectNameStrategy {
+	if strategy, ok := src.TopicSubjectNameStrategies[topic]; ok {
+		return strategy
+	}
+	if src.SubjectNameStrategy != nil {
+		return src.SubjectNameStrategy
+	}
+	return TopicNameStrategy{}
+}
+
+// SubjectName returns the subject under which an Avro schema for the key or
+// value of messages on a topic is registered, using the strategy configured
+// for the topic
+func (src *SchemaRegistryConfig) SubjectName(topic string, isKey bool, schema string) (string, error) {
+	recordName, err := src.recordName(schema)
+	if err != nil {
+		return "", err
+	}
+	return src.subjectNameStrategy(topic).SubjectName(topic, isKey, recordName)
+}
+
+// recordName returns the full name of the record defined by a schema, or an
+// empty string if the schema is not a named type. Names are cached by schema
+// so that schemas aren't parsed for every marshaled message.
+func (src *SchemaRegistryConfig) recordName(schema string) (string, error) {
+	if name, ok := src.recordNames.Load(schema); ok {
+		return name.(string), nil
+	}
+	parsed, err := parseAvroSchema(schema)
+	if err != nil {
+		return "", err
+	}
+	src.recordNames.Store(schema, parsed.Name)
+	return parsed.Name, nil
+}
+
+// schemaID returns the id of a schema under a subject, registering the
+// schema if AutoRegisterSchemas is set. Ids are cached after the first
+// lookup.
+func (src *SchemaRegistryConfig) schemaID(ctx context.Context, subject, schema string) (int, error) {
+	cacheKey := subject + "\x00" + schema
+	if id, ok := src.schemaIDs.Load(cacheKey); ok {
+		return id.(int), nil
+	}
+	var id int
+	var err error
+	if src.AutoRegisterSchemas {
+		id, err = src.client.registerSchema(ctx, subject, schema)
+	} else {
+		id, err = src.client.lookupSchema(ctx, subject, schema)
+	}
+	if err != nil {
+		if IsSchemaRegistryErrorCode(err, SubjectNotFoundErrorCode) ||
+			IsSchemaRegistryErrorCode(err, SchemaNotFoundErrorCode) {
+			return 0, fmt.Errorf("schema is not registered under subject %s", subject)
+		}
+		return 0, err
+	}
+	src.schemaIDs.Store(cacheKey, id)
+	return id, nil
+}
+
+// MarshalMessage encodes the key or value of a message for a topic into the
+// Schema Registry wire format. The value must be in the native form used by
+// goavro, e.g. a map[string]interface{} for records. The schema is looked up
+// under the subject given by the topic's subject name strategy, and is
+// registered there first if AutoRegisterSchemas is set. Otherwise, values
+// are rejected unless their schema was already registered under the subject.
+func (src *SchemaRegistryConfig) MarshalMessage(
+	ctx context.Context,
+	topic string,
+	isKey bool,
+	schema string,
+	value interface{},
+) ([]byte, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "marshal-kafka-avro")
+	defer span.Finish()
+	// producers don't create a KafkaConsumer or call Init, so the config is
+	// initialized on first use
+	src.marshalInit.Do(func() {
+		if src.client == nil {
+			src.marshalInitErr = src.Init()
+		}
+	})
+	if src.marshalInitErr != nil {
+		return nil, src.marshalInitErr
+	}
+	subject, err := src.SubjectName(topic, isKey, schema)
+	if err != nil {
+		return nil, err
+	}
+	id, err := src.schemaID(ctx, subject, schema)
+	if err != nil {
+		Logger.Error(
+			"Unable to get schema id for subject", zap.String("subject", subject),
+			zap.String("topic", topic), zap.Error(err))
+		return nil, err
+	}
+	if _, ok := src.codecs.Load(uint32(id)); !ok {
+		// compile the schema we already have instead of fetching it by id
+		codec, err := newAvroCodec(schema)
+		if err != nil {
+			return nil, err
+		}
+		src.codecs.LoadOrStore(uint32(id), codec)
+	}
+	codec, err := src.getCodec(ctx, uint32(id))
+	if err != nil {
+		return nil, err
+	}
+	return codec.BinaryFromNative(avroWireFormatHeader(uint32(id)), value)
+}
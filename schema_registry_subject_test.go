@@ -0,0 +1,135 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const orderPlacedSchema = `{"type": "record", "name": "OrderPlaced", "namespace": "flavortown.orders",
+	"fields": [{"name": "id", "type": "long"}]}`
+
+const orderShippedSchema = `{"type": "record", "name": "OrderShipped", "namespace": "flavortown.orders",
+	"fields": [{"name": "id", "type": "long"}, {"name": "carrier", "type": "string"}]}`
+
+func TestSubjectNameStrategies(t *testing.T) {
+	tests := []struct {
+		strategy SubjectNameStrategy
+		isKey    bool
+		subject  string
+	}{
+		{TopicNameStrategy{}, false, "orders-value"},
+		{TopicNameStrategy{}, true, "orders-key"},
+		{RecordNameStrategy{}, false, "flavortown.orders.OrderPlaced"},
+		{RecordNameStrategy{}, true, "flavortown.orders.OrderPlaced"},
+		{TopicRecordNameStrategy{}, false, "orders-flavortown.orders.OrderPlaced"},
+	}
+	for _, test := range tests {
+		subject, err := test.strategy.SubjectName("orders", test.isKey, "flavortown.orders.OrderPlaced")
+		require.NoError(t, err)
+		assert.Equal(t, test.subject, subject)
+	}
+
+	_, err := RecordNameStrategy{}.SubjectName("orders", false, "")
+	assert.Error(t, err)
+	_, err = TopicRecordNameStrategy{}.SubjectName("orders", false, "")
+	assert.Error(t, err)
+}
+
+func TestSchemaRegistryConfig_SubjectName(t *testing.T) {
+	src := &SchemaRegistryConfig{
+		SubjectNameStrategy:        RecordNameStrategy{},
+		TopicSubjectNameStrategies: map[string]SubjectNameStrategy{"chefs": TopicNameStrategy{}},
+	}
+	subject, err := src.SubjectName("orders", false, orderPlacedSchema)
+	require.NoError(t, err)
+	assert.Equal(t, "flavortown.orders.OrderPlaced", subject)
+	// record names are cached by schema
+	recordName, ok := src.recordNames.Load(orderPlacedSchema)
+	assert.True(t, ok)
+	assert.Equal(t, "flavortown.orders.OrderPlaced", recordName)
+
+	subject, err = src.SubjectName("chefs", false, orderPlacedSchema)
+	require.NoError(t, err)
+	assert.Equal(t, "chefs-value", subject)
+
+	// primitive schemas have no record name
+	_, err = src.SubjectName("orders", true, `"string"`)
+	assert.Error(t, err)
+
+	var strategy SubjectNameStrategy
+	value := subjectNameStrategyValue{&strategy}
+	require.NoError(t, value.Set("Topic-Record"))
+	assert.Equal(t, TopicRecordNameStrategy{}, strategy)
+	assert.Equal(t, "topic-record", value.String())
+	assert.Error(t, value.Set("topic-name"))
+}
+
+func TestMarshalMessage(t *testing.T) {
+	client, registry, closer := setupSchemaRegistryClient(t)
+	defer closer()
+	ctx := context.Background()
+	// producers marshal messages without initializing the config first
+	src := &SchemaRegistryConfig{
+		SchemaRegistryURL:   client.URL,
+		SubjectNameStrategy: TopicRecordNameStrategy{},
+	}
+
+	// schemas must be registered unless auto-registration is enabled
+	_, err := src.MarshalMessage(ctx, "orders", false, orderPlacedSchema, map[string]interface{}{"id": int64(1)})
+	assert.Error(t, err)
+
+	// a single topic can carry multiple record types
+	src.AutoRegisterSchemas = true
+	placed, err := src.MarshalMessage(ctx, "orders", false, orderPlacedSchema, map[string]interface{}{"id": int64(1)})
+	require.NoError(t, err)
+	shipped, err := src.MarshalMessage(
+		ctx, "orders", false, orderShippedSchema, map[string]interface{}{"id": int64(1), "carrier": "Camaro"})
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, registry.subjects["orders-flavortown.orders.OrderPlaced"])
+	assert.Equal(t, []int{2}, registry.subjects["orders-flavortown.orders.OrderShipped"])
+	requests := registry.requests
+
+	// ids are cached, and encoded messages decode with the shared codec cache
+	_, err = src.MarshalMessage(ctx, "orders", false, orderPlacedSchema, map[string]interface{}{"id": int64(2)})
+	require.NoError(t, err)
+	assert.Equal(t, requests, registry.requests)
+
+	type order struct {
+		ID      int64  `kafka:"id"`
+		Carrier string `kafka:"carrier"`
+	}
+	target := &order{}
+	require.Empty(t, src.unmarshalMessage(ctx, placed, target))
+	assert.Equal(t, &order{ID: 1}, target)
+	require.Empty(t, src.unmarshalMessage(ctx, shipped, target))
+	assert.Equal(t, &order{ID: 1, Carrier: "Camaro"}, target)
+	assert.Equal(t, requests, registry.requests)
+
+	// values that don't match the schema can't be encoded
+	_, err = src.MarshalMessage(ctx, "orders", false, orderPlacedSchema, map[string]interface{}{"id": "one"})
+	assert.Error(t, err)
+}
+
+func TestMarshalMessage_InitError(t *testing.T) {
+	src := &SchemaRegistryConfig{SchemaRegistryURL: "http://localhost", TLSCaCrtPath: "/flavortown/missing.crt"}
+	_, err := src.MarshalMessage(
+		context.Background(), "orders", false, orderPlacedSchema, map[string]interface{}{"id": int64(1)})
+	assert.Error(t, err)
+}
@@ -22,8 +22,12 @@ import (
 	"net/http"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/linkedin/goavro"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -43,28 +47,16 @@ func (m *mockTransport) RoundTrip(request *http.Request) (*http.Response, error)
 
 func TestGetSchema(t *testing.T) {
 	ctx := context.Background()
-	var httpDefaultClient *http.Client
-	// need to mutex the http client because this is a global
-	httpClientMutex := &sync.Mutex{}
-
-	setUp := func(transport *mockTransport) {
-		// Save the http default client to restore state after tests complete
-		httpDefaultClient = http.DefaultClient
-		// Set the http transport to our mocked transport
-		transport.On("RoundTrip", mock.Anything)
-		httpClientMutex.Lock()
-		http.DefaultClient = &http.Client{Transport: transport}
-	}
 
-	tearDown := func() {
-		// Restore the http default client
-		http.DefaultClient = httpDefaultClient
-		httpClientMutex.Unlock()
+	setUp := func(transport *mockTransport) *SchemaRegistryClient {
+		transport.On("RoundTrip", mock.Anything)
+		client := NewSchemaRegistryClient("http://schema.registry")
+		client.HTTPClient = &http.Client{Transport: transport}
+		return client
 	}
 
 	// Test that schemas are retrieved from schema registry
 	t.Run("retrieve schemas from Kafka schema registry", func(t *testing.T) {
-		defer tearDown()
 		transport := &mockTransport{
 			Response: &http.Response{
 				StatusCode: 200,
@@ -72,9 +64,8 @@ func TestGetSchema(t *testing.T) {
 			},
 			Err: nil,
 		}
-		setUp(transport)
-		client := &schemaRegistryClient{}
-		schema, err := client.getSchema(ctx, 2, "http://schema.registry")
+		client := setUp(transport)
+		schema, err := client.getSchema(ctx, 2)
 		assert.Nil(t, err)
 		assert.Equal(t, "test", schema)
 		require.Len(t, transport.Calls, 1)
@@ -86,21 +77,18 @@ func TestGetSchema(t *testing.T) {
 
 	// Test handling errors from schema registry
 	t.Run("handle schema registry errors", func(t *testing.T) {
-		defer tearDown()
 		transport := &mockTransport{
 			Response: nil,
 			Err:      fmt.Errorf("something happened"),
 		}
-		setUp(transport)
-		client := &schemaRegistryClient{}
-		schema, err := client.getSchema(ctx, 2, "http://schema.registry")
+		client := setUp(transport)
+		schema, err := client.getSchema(ctx, 2)
 		assert.Empty(t, schema)
 		assert.Contains(t, err.Error(), "something happened")
 	})
 
 	// Test handling invalid JSON returned from schema registry
 	t.Run("handle json decode errors", func(t *testing.T) {
-		defer tearDown()
 		transport := &mockTransport{
 			Response: &http.Response{
 				StatusCode: 200,
@@ -108,12 +96,137 @@ func TestGetSchema(t *testing.T) {
 			},
 			Err: nil,
 		}
-		setUp(transport)
-		client := &schemaRegistryClient{}
-		schema, err := client.getSchema(ctx, 2, "http://schema.registry")
+		client := setUp(transport)
+		schema, err := client.getSchema(ctx, 2)
 		assert.Empty(t, schema)
 		assert.Equal(t, "unexpected EOF", err.Error())
 	})
+
+	// Test that a missing schema is returned as a typed error
+	t.Run("handle schema not found", func(t *testing.T) {
+		transport := &mockTransport{
+			Response: &http.Response{
+				StatusCode: 404,
+				Body: ioutil.NopCloser(bytes.NewBufferString(
+					"{\"error_code\": 40403, \"message\": \"Schema not found\"}")),
+			},
+			Err: nil,
+		}
+		client := setUp(transport)
+		client.MaxRetries = 3
+		schema, err := client.getSchema(ctx, 2)
+		assert.Empty(t, schema)
+		assert.True(t, IsSchemaRegistryErrorCode(err, SchemaNotFoundErrorCode))
+		// 404s are not retried
+		assert.Len(t, transport.Calls, 1)
+	})
+}
+
+// retryTransport fails with a 503 a fixed number of times before succeeding
+type retryTransport struct {
+	failures int
+	requests []*http.Request
+}
+
+func (rt *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, request)
+	if len(rt.requests) <= rt.failures {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("unavailable")),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString("{\"schema\": \"test\"}")),
+	}, nil
+}
+
+func TestGetSchema_Retries(t *testing.T) {
+	ctx := context.Background()
+	t.Run("retries until success", func(t *testing.T) {
+		transport := &retryTransport{failures: 2}
+		client := &SchemaRegistryClient{
+			URL:          "http://schema.registry",
+			HTTPClient:   &http.Client{Transport: transport},
+			MaxRetries:   2,
+			RetryBackoff: time.Millisecond,
+		}
+		schema, err := client.GetSchemaByID(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, "test", schema)
+		assert.Len(t, transport.requests, 3)
+	})
+	t.Run("gives up after max retries", func(t *testing.T) {
+		transport := &retryTransport{failures: 5}
+		client := &SchemaRegistryClient{
+			URL:          "http://schema.registry",
+			HTTPClient:   &http.Client{Transport: transport},
+			MaxRetries:   2,
+			RetryBackoff: time.Millisecond,
+		}
+		_, err := client.GetSchemaByID(ctx, 2)
+		require.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, err.(*SchemaRegistryError).StatusCode)
+		assert.Len(t, transport.requests, 3)
+	})
+}
+
+func TestGetSchema_Authentication(t *testing.T) {
+	ctx := context.Background()
+	t.Run("basic auth", func(t *testing.T) {
+		transport := &retryTransport{}
+		client := &SchemaRegistryClient{
+			URL:        "http://schema.registry",
+			HTTPClient: &http.Client{Transport: transport},
+			Username:   "guy",
+			Password:   "fieri",
+		}
+		_, err := client.GetSchemaByID(ctx, 2)
+		require.NoError(t, err)
+		require.Len(t, transport.requests, 1)
+		username, password, ok := transport.requests[0].BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "guy", username)
+		assert.Equal(t, "fieri", password)
+	})
+	t.Run("bearer token", func(t *testing.T) {
+		transport := &retryTransport{}
+		client := &SchemaRegistryClient{
+			URL:         "http://schema.registry",
+			HTTPClient:  &http.Client{Transport: transport},
+			Username:    "guy",
+			BearerToken: "flavortown",
+		}
+		_, err := client.GetSchemaByID(ctx, 2)
+		require.NoError(t, err)
+		require.Len(t, transport.requests, 1)
+		assert.Equal(t, "Bearer flavortown", transport.requests[0].Header.Get("Authorization"))
+	})
+}
+
+func TestSchemaRegistryConfig_NewClient(t *testing.T) {
+	src := &SchemaRegistryConfig{
+		SchemaRegistryURL: "http://schema.registry/",
+		Username:          "guy",
+		MaxRetries:        3,
+	}
+	client, err := src.NewClient()
+	require.NoError(t, err)
+	assert.Equal(t, "http://schema.registry", client.URL)
+	assert.Equal(t, "guy", client.Username)
+	assert.Equal(t, 3, client.MaxRetries)
+	assert.Equal(t, defaultSchemaRegistryTimeout, client.HTTPClient.Timeout)
+
+	src.TLSCaCrtPath = "/does/not/exist"
+	_, err = src.NewClient()
+	assert.Error(t, err)
+
+	// a client certificate requires a key
+	src.TLSCaCrtPath = ""
+	src.TLSCrtPath = "client.crt"
+	_, err = src.NewClient()
+	assert.Error(t, err)
 }
 
 // Implement a mocked out schema registry client
@@ -121,11 +234,21 @@ type SchemaRegistryClientMock struct {
 	mock.Mock
 }
 
-func (sm *SchemaRegistryClientMock) getSchema(ctx context.Context, schemaID int, _ string) (string, error) {
+func (sm *SchemaRegistryClientMock) getSchema(ctx context.Context, schemaID int) (string, error) {
 	args := sm.Called(schemaID, ctx)
 	return args.String(0), args.Error(1)
 }
 
+func (sm *SchemaRegistryClientMock) registerSchema(ctx context.Context, subject, schema string) (int, error) {
+	args := sm.Called(subject, schema)
+	return args.Int(0), args.Error(1)
+}
+
+func (sm *SchemaRegistryClientMock) lookupSchema(ctx context.Context, subject, schema string) (int, error) {
+	args := sm.Called(subject, schema)
+	return args.Int(0), args.Error(1)
+}
+
 func (sm *SchemaRegistryClientMock) unmarshalKafkaMessageMap(kafkaMessageMap map[string]interface{}, target interface{}) []error {
 	args := sm.Called(kafkaMessageMap)
 	return args.Get(0).([]error)
@@ -163,9 +286,49 @@ func TestUnmarshalMessage(t *testing.T) {
 	mockClient.On("unmarshalKafkaMessageMap", avroMessage).Return([]error{})
 	errs := mockSchemaRegistry.unmarshalMessage(context.Background(), kafkaMessage, nil)
 	assert.Empty(t, errs, "there should be no errors unmarshaling")
-	cachedSchema, schemaInCache := mockSchemaRegistry.schemas.Load(uint32(77))
-	require.True(t, schemaInCache, "schema should be in cache")
-	assert.Equal(t, schema, cachedSchema.(string))
+	cachedCodec, codecInCache := mockSchemaRegistry.codecs.Load(uint32(77))
+	require.True(t, codecInCache, "codec should be in cache")
+	assert.IsType(t, &avroCodec{}, cachedCodec)
+
+	// Decoding again should be served from cache
+	errs = mockSchemaRegistry.unmarshalMessage(context.Background(), kafkaMessage, nil)
+	assert.Empty(t, errs, "there should be no errors unmarshaling")
+	mockClient.AssertNumberOfCalls(t, "getSchema", 1)
+}
+
+// Test that concurrent lookups of an uncached schema make a single request
+// to schema registry
+func TestGetCodec_SingleFlight(t *testing.T) {
+	mockSchemaRegistry, mockClient, schema, _, _ := setupMockSchemaRegistry(t)
+	mockSchemaRegistry.initSchemaRegistryMetrics(prometheus.NewRegistry())
+	mockClient.On("getSchema", 77, mock.Anything).After(50*time.Millisecond).Return(schema, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codec, err := mockSchemaRegistry.getCodec(context.Background(), 77)
+			assert.NoError(t, err)
+			assert.NotNil(t, codec)
+		}()
+	}
+	wg.Wait()
+	mockClient.AssertNumberOfCalls(t, "getSchema", 1)
+	_, err := mockSchemaRegistry.getCodec(context.Background(), 77)
+	require.NoError(t, err)
+	metric := &dto.Metric{}
+	require.NoError(t, mockSchemaRegistry.cacheHits.Write(metric))
+	assert.Equal(t, 1.0, metric.GetCounter().GetValue())
+}
+
+// Test that configs for keys and values in the same process share metrics
+func TestInitSchemaRegistryMetrics_Shared(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	keys, values := &SchemaRegistryConfig{}, &SchemaRegistryConfig{}
+	keys.initSchemaRegistryMetrics(registry)
+	assert.NotPanics(t, func() { values.initSchemaRegistryMetrics(registry) })
+	assert.True(t, keys.cacheHits == values.cacheHits)
+	assert.True(t, keys.fetchDuration == values.fetchDuration)
 }
 
 // Test that an error is returned when schema registry has an error
@@ -174,9 +337,9 @@ func TestUnmarshalMessage_InvalidSchema(t *testing.T) {
 	mockClient.On("getSchema", 77, mock.Anything).Return("", fmt.Errorf("some error"))
 	errs := mockSchemaRegistry.unmarshalMessage(context.Background(), kafkaMessage, nil)
 	assert.Len(t, errs, 1)
-	_, schemaInCache := mockSchemaRegistry.schemas.Load(uint32(77))
+	_, codecInCache := mockSchemaRegistry.codecs.Load(uint32(77))
 	assert.Contains(t, errs[0].Error(), "some error")
-	assert.False(t, schemaInCache, "schema should not be in cache")
+	assert.False(t, codecInCache, "codec should not be in cache")
 }
 
 // Test that an error is returned when there is a problem unmarshaling the Avro
@@ -186,7 +349,37 @@ func TestUnmarshalMessage_InvalidAvro(t *testing.T) {
 	mockClient.On("unmarshalKafkaMessageMap", avroMessage).Return([]error{fmt.Errorf("some error")})
 	errs := mockSchemaRegistry.unmarshalMessage(context.Background(), kafkaMessage, nil)
 	assert.Len(t, errs, 1)
-	_, schemaInCache := mockSchemaRegistry.schemas.Load(uint32(77))
+	_, codecInCache := mockSchemaRegistry.codecs.Load(uint32(77))
 	assert.Contains(t, errs[0].Error(), "some error")
-	assert.True(t, schemaInCache, "schema should be in cache")
+	assert.True(t, codecInCache, "codec should be in cache")
+}
+
+func TestParseAvroWireFormat(t *testing.T) {
+	schemaID, payload, err := parseAvroWireFormat([]byte{0, 0, 0, 1, 2, 42})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(258), schemaID)
+	assert.Equal(t, []byte{42}, payload)
+
+	_, _, err = parseAvroWireFormat(nil)
+	assert.Equal(t, ErrTombstone, err)
+	_, _, err = parseAvroWireFormat([]byte{0, 0, 0})
+	assert.Equal(t, ErrNotAvroWireFormat, err)
+	_, _, err = parseAvroWireFormat([]byte(`{"name": "Guy Fieri"}`))
+	assert.Equal(t, ErrNotAvroWireFormat, err)
+}
+
+// Test that malformed messages and unknown schemas return typed errors
+func TestUnmarshalMessage_TypedErrors(t *testing.T) {
+	mockSchemaRegistry, mockClient, _, kafkaMessage, _ := setupMockSchemaRegistry(t)
+	mockClient.On("getSchema", 77, mock.Anything).Return(
+		"", &SchemaRegistryError{StatusCode: 404, ErrorCode: SchemaNotFoundErrorCode})
+	ctx := context.Background()
+
+	err := mockSchemaRegistry.UnmarshalMessage(ctx, &sarama.ConsumerMessage{Value: nil}, nil)
+	assert.Equal(t, ErrTombstone, err)
+	err = mockSchemaRegistry.UnmarshalMessage(ctx, &sarama.ConsumerMessage{Value: []byte{1}}, nil)
+	assert.Equal(t, ErrNotAvroWireFormat, err)
+	err = mockSchemaRegistry.UnmarshalMessage(ctx, &sarama.ConsumerMessage{Value: kafkaMessage}, nil)
+	assert.Equal(t, ErrUnknownSchemaID, err)
+	mockClient.AssertNumberOfCalls(t, "getSchema", 1)
 }
@@ -46,11 +46,24 @@ func (sc *SentryConfig) InitializeRaven() {
 // SentryCore Implements a zapcore.Core that sends logged errors to Sentry
 type SentryCore struct {
 	zapcore.LevelEnabler
+	// fields added with With, e.g. by request-scoped loggers
+	fields []zapcore.Field
+}
+
+// Enabled returns whether logs at the level are sent to Sentry, which is
+// error logs and above unless the core has a LevelEnabler
+func (c *SentryCore) Enabled(level zapcore.Level) bool {
+	if c.LevelEnabler == nil {
+		return level >= zapcore.ErrorLevel
+	}
+	return c.LevelEnabler.Enabled(level)
 }
 
 // With adds structured context to the Sentry Core
 func (c *SentryCore) With(fields []zapcore.Field) zapcore.Core {
-	return c.With(fields)
+	withFields := make([]zapcore.Field, 0, len(c.fields)+len(fields))
+	withFields = append(withFields, c.fields...)
+	return &SentryCore{LevelEnabler: c.LevelEnabler, fields: append(withFields, fields...)}
 }
 
 // Check must be called before calling Write. This determines whether or not logs are sent to
@@ -84,7 +97,7 @@ func (c *SentryCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
 	// This block was adapted from the way zap encodes messages internally
 	// See https://github.com/uber-go/zap/blob/v1.7.1/zapcore/field.go#L107
 	ravenExtra := make(map[string]interface{})
-	for _, field := range fields {
+	for _, field := range append(c.fields[:len(c.fields):len(c.fields)], fields...) {
 		switch field.Type {
 		case zapcore.ArrayMarshalerType:
 			ravenExtra[field.Key] = field.Interface
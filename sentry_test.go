@@ -0,0 +1,40 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSentryCore_With(t *testing.T) {
+	core := &SentryCore{}
+	child := core.With([]zapcore.Field{zap.String("request_id", "flavortown")})
+	grandchild := child.With([]zapcore.Field{zap.String("route", "/chefs")})
+	assert.Empty(t, core.fields)
+	assert.Len(t, child.(*SentryCore).fields, 1)
+	assert.Len(t, grandchild.(*SentryCore).fields, 2)
+}
+
+func TestSentryCore_Enabled(t *testing.T) {
+	core := &SentryCore{}
+	assert.False(t, core.Enabled(zapcore.WarnLevel))
+	assert.True(t, core.Enabled(zapcore.ErrorLevel))
+	core = &SentryCore{LevelEnabler: zapcore.WarnLevel}
+	assert.True(t, core.Enabled(zapcore.WarnLevel))
+}
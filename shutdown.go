@@ -0,0 +1,79 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultShutdownHookTimeout = 5 * time.Second
+
+// ShutdownHook is a named step of a graceful shutdown, such as closing a
+// Kafka consumer or producer, or flushing traces
+type ShutdownHook struct {
+	Name string
+	// Hook is given a context that is cancelled after Timeout
+	Hook func(ctx context.Context) error
+	// Timeout after which the hook is abandoned. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// run runs the hook with its timeout, returning when the timeout expires
+// even if the hook ignores its context
+func (sh ShutdownHook) run() error {
+	timeout := sh.Timeout
+	if timeout == 0 {
+		timeout = defaultShutdownHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errs <- fmt.Errorf("shutdown hook panicked: %v", r)
+			}
+		}()
+		errs <- sh.Hook(ctx)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown hook timed out after %s", timeout)
+	}
+}
+
+// runShutdownHooks runs hooks one at a time in order, logging the outcome
+// of each. Hooks that fail or time out don't stop later hooks from running.
+func runShutdownHooks(hooks []ShutdownHook) {
+	for _, hook := range hooks {
+		start := time.Now()
+		Logger.Info("Running shutdown hook", zap.String("hook", hook.Name))
+		if err := hook.run(); err != nil {
+			Logger.Error(
+				"Shutdown hook failed", zap.String("hook", hook.Name),
+				zap.Duration("duration", time.Since(start)), zap.Error(err))
+			continue
+		}
+		Logger.Info(
+			"Shutdown hook completed", zap.String("hook", hook.Name),
+			zap.Duration("duration", time.Since(start)))
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunShutdownHooks(t *testing.T) {
+	var ran []string
+	hook := func(name string, err error) ShutdownHook {
+		return ShutdownHook{Name: name, Hook: func(context.Context) error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+	blocked := make(chan struct{})
+	defer close(blocked)
+	start := time.Now()
+	runShutdownHooks([]ShutdownHook{
+		hook("consumer", nil),
+		hook("producer", fmt.Errorf("unable to flush")),
+		// a hook that ignores its context is abandoned after its timeout
+		{Name: "stuck", Timeout: 10 * time.Millisecond, Hook: func(context.Context) error {
+			<-blocked
+			return nil
+		}},
+		{Name: "panics", Hook: func(context.Context) error { panic("flavortown") }},
+		hook("tracer", nil),
+	})
+	// failures don't stop later hooks
+	assert.Equal(t, []string{"consumer", "producer", "tracer"}, ran)
+	assert.True(t, time.Since(start) < defaultShutdownHookTimeout)
+}
+
+func TestShutdownHook_Run(t *testing.T) {
+	hook := ShutdownHook{Name: "consumer", Hook: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, Timeout: 10 * time.Millisecond}
+	assert.Error(t, hook.run())
+	hook.Hook = func(context.Context) error { return nil }
+	assert.NoError(t, hook.run())
+}
@@ -76,6 +76,22 @@ func (tc *TracingConfig) ConfigureTracer() io.Closer {
 	return closer
 }
 
+// spanLogFields returns the trace and span IDs of a Jaeger span as log
+// fields, or no fields if there is no span or it isn't a Jaeger span
+func spanLogFields(span opentracing.Span) []zap.Field {
+	if span == nil {
+		return nil
+	}
+	spanContext, ok := span.Context().(jaeger.SpanContext)
+	if !ok {
+		return nil
+	}
+	return []zap.Field{
+		zap.String("trace_id", spanContext.TraceID().String()),
+		zap.String("span_id", spanContext.SpanID().String()),
+	}
+}
+
 // TraceOutbound injects outbound HTTP requests with OpenTracing headers
 func TraceOutbound(r *http.Request, span opentracing.Span) {
 	opentracing.GlobalTracer().Inject(
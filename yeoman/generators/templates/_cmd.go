@@ -32,7 +32,7 @@ func newRootCmd(args []string) *cobra.Command {
 		Version:          fmt.Sprintf("%s (%s)", version, gitSHA),
 		PersistentPreRun: core.CobraBindEnvironmentVariables("server"),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			config.RunHTTPServer(nil, nil, <%=appName%>.RegisterMuxes)
+			config.RunHTTPServer(nil, nil, <%=appName%>.RegisterRoutes)
 			return nil
 		},
 	}
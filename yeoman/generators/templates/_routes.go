@@ -5,14 +5,15 @@ import (
 	"net/http"
 
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/spothero/core"
 )
 
-// RegisterMuxes is a callback used to register HTTP endpoints to the default server
+// RegisterRoutes is a callback used to register HTTP endpoints to the default server
 // NOTE: The HTTP server automatically registers /health and /metrics -- Have a look in your
 // browser!
-func RegisterMuxes(mux *http.ServeMux) {
-	mux.HandleFunc("/", helloWorld)
-	mux.HandleFunc("/best-language", bestLanguage)
+func RegisterRoutes(router core.HTTPRouter) {
+	router.Handle("/", http.HandlerFunc(helloWorld))
+	router.Handle("/best-language", http.HandlerFunc(bestLanguage))
 }
 
 // helloWorld simply writes "hello world" to the caller. It is ended for use as an HTTP callback.